@@ -1,42 +1,122 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 )
 
 //go:embed web.html
 var webHTML string
 
-// corsMiddleware adds CORS headers to allow cross-origin requests
+// corsMiddleware applies the origin policy. Cross-origin callers must be
+// approved in RemotesAllowed and are limited to their scope; only they get
+// CORS headers. Same-origin browser requests must carry the UI's CSRF token.
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Allow all origins
 		origin := r.Header.Get("Origin")
-		if origin != "" {
+
+		if origin != "" && !sameOrigin(r, origin) {
+			scope := state.OriginScope(origin)
+			if scope == "" {
+				writeError(w, http.StatusForbidden, "origin %s is not approved; approve it under Remotes in the web UI", origin)
+				return
+			}
+
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Vary", "Origin")
+
+			// Handle preflight OPTIONS request
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			if need := requiredScope(r); scopeRank[scope] < scopeRank[need] {
+				writeError(w, http.StatusForbidden, "origin %s has %s scope, %s requires %s", origin, scope, r.URL.Path, need)
+				return
+			}
+			next(w, r)
+			return
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-		// Handle preflight OPTIONS request
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
+		// A cross-site request that hid its Origin is never trusted to mutate
+		if isMutating(r) && r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+			writeError(w, http.StatusForbidden, "cross-site request without an origin")
+			return
+		}
+
+		// curl and other non-browser clients can't be forged by a web page
+		if isMutating(r) && fromBrowser(r) && !validCSRF(r) {
+			writeError(w, http.StatusForbidden, "missing or invalid CSRF token, reload the page")
+			return
+		}
+
 		next(w, r)
 	}
 }
 
+// heldState is the state lock a request holds; see stateMiddleware
+type heldState struct {
+	once   sync.Once
+	unlock func()
+}
+
+// release unlocks the state the first time it is called
+func (h *heldState) release() {
+	h.once.Do(h.unlock)
+}
+
+// heldStateKey is the request context key for the request's heldState
+type heldStateKey struct{}
+
+// stateMiddleware runs each request with state.mu held, serializing it with
+// other requests and with the reconciler and the other background loops.
+// Requests that go on streaming let go of it with releaseState once they
+// have what they need from the state.
+func stateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := state
+		s.mu.Lock()
+		held := &heldState{unlock: s.mu.Unlock}
+		defer held.release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), heldStateKey{}, held)))
+	})
+}
+
+// releaseState lets go of the state lock a request holds, if it holds it
+func releaseState(r *http.Request) {
+	if held, ok := r.Context().Value(heldStateKey{}).(*heldState); ok {
+		held.release()
+	}
+}
+
+// ServeOptions configures the listeners of the HTTP server
+type ServeOptions struct {
+	Listen   string   // TCP address, e.g. 127.0.0.1:8080
+	Socket   string   // Optional unix socket path (authorized by peer uid)
+	TLSCert  string   // Serve HTTPS with this certificate...
+	TLSKey   string   // ...and key
+	ClientCA string   // Require client certificates signed by this CA (mTLS)
+	Hosts    []string // Extra names clients reach the server by, besides localhost and the listen address
+}
+
 // ServeHTTP starts the HTTP server
-func ServeHTTP(addr string) error {
+func ServeHTTP(opts ServeOptions) error {
 	// Web UI
 	http.HandleFunc("/", serveWeb)
 
@@ -49,9 +129,52 @@ func ServeHTTP(addr string) error {
 	http.HandleFunc("/api/discover-port", corsMiddleware(handleDiscoverPort))
 	http.HandleFunc("/api/config", corsMiddleware(handleConfig))
 	http.HandleFunc("/api/monitor", corsMiddleware(handleMonitor))
+	http.HandleFunc("/api/adopt", corsMiddleware(handleAdopt))
 	http.HandleFunc("/api/execute-action", corsMiddleware(handleExecuteAction))
+	http.HandleFunc("/api/projects", corsMiddleware(handleProjects))
+	http.HandleFunc("/api/events", corsMiddleware(handleEventsAPI))
+	http.HandleFunc("/api/stream", corsMiddleware(handleStream))
+	http.HandleFunc("/api/logs", corsMiddleware(handleLogs))
+	http.HandleFunc("/api/remotes", corsMiddleware(handleRemotes))
+	http.HandleFunc("/api/groups", corsMiddleware(handleGroups))
+	http.HandleFunc("/api/jobs", corsMiddleware(handleJobs))
+
+	// Resource-oriented routes
+	http.HandleFunc("/api/instances/", corsMiddleware(handleInstanceResource))
+	http.HandleFunc("/api/templates/", corsMiddleware(handleTemplateResource))
+	http.HandleFunc("/api/resource-types/", corsMiddleware(handleResourceTypeResource))
+	http.HandleFunc("/api/groups/", corsMiddleware(handleGroupResource))
+	http.HandleFunc("/api/jobs/", corsMiddleware(handleJobResource))
+	http.HandleFunc("/api/openapi.json", corsMiddleware(handleOpenAPI))
+	http.HandleFunc("/metrics", handleMetrics)
+
+	server := &http.Server{
+		Handler:     hostMiddleware(serverNames(opts.Listen, opts.Hosts), stateMiddleware(authMiddleware(http.DefaultServeMux))),
+		ConnContext: peerCredContext,
+	}
+
+	if opts.Socket != "" {
+		os.Remove(opts.Socket) // Clear a stale socket from a previous run
+		ln, err := net.Listen("unix", opts.Socket)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", opts.Socket, err)
+		}
+		os.Chmod(opts.Socket, 0666) // Access is decided by SO_PEERCRED, not file mode
+		go server.Serve(ln)
+	}
 
-	return http.ListenAndServe(addr, nil)
+	ln, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return err
+	}
+	if opts.TLSCert != "" {
+		// The unix socket above stays plain; the TLS config only applies here
+		if server.TLSConfig, err = serverTLSConfig(opts); err != nil {
+			return err
+		}
+		return server.ServeTLS(ln, opts.TLSCert, opts.TLSKey)
+	}
+	return server.Serve(ln)
 }
 
 func serveWeb(w http.ResponseWriter, r *http.Request) {
@@ -60,7 +183,7 @@ func serveWeb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(webHTML))
+	w.Write([]byte(strings.Replace(webHTML, "{{CSRF_TOKEN}}", csrfToken, 1)))
 }
 
 func handleInstances(w http.ResponseWriter, r *http.Request) {
@@ -70,7 +193,11 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		// Run discovery and matching to update instance status and PIDs
 		MatchAndUpdateInstances(state)
-		json.NewEncoder(w).Encode(state.Instances)
+		if r.URL.Query().Has("project") {
+			json.NewEncoder(w).Encode(visibleInstances(r, state.ProjectInstances(r.URL.Query().Get("project"))))
+			return
+		}
+		json.NewEncoder(w).Encode(visibleInstances(r, state.Instances))
 
 	case "POST":
 		var req struct {
@@ -79,6 +206,7 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 			Name       string            `json:"name"`
 			Vars       map[string]string `json:"vars"`
 			InstanceID string            `json:"instance_id"`
+			Project    string            `json:"project"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -86,15 +214,30 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		verb, name := req.Action, req.InstanceID
+		if req.Action == "start" {
+			var err error
+			if name, err = qualifiedKey(req.Project, req.Name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !authorize(w, r, verb, "instance", name) {
+			return
+		}
+
 		switch req.Action {
 		case "start":
-			tmpl := state.Templates[req.Template]
+			tmpl := state.LookupTemplate(req.Project, req.Template)
 			if tmpl == nil {
 				http.Error(w, "template not found", http.StatusNotFound)
 				return
 			}
+			if !authorize(w, r, VerbStart, "template", projectKey(tmpl.Project, tmpl.ID)) {
+				return
+			}
 
-			inst, err := StartProcess(state, tmpl, req.Name, req.Vars)
+			inst, err := StartProcess(state, tmpl, name, req.Vars, httpActor(r))
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -109,12 +252,12 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err := StopProcess(state, inst); err != nil {
+			if err := StopProcess(state, inst, httpActor(r)); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			state.ReleaseResources(req.InstanceID)
+			state.ReleaseResources(req.InstanceID, httpActor(r))
 			state.Save()
 
 			json.NewEncoder(w).Encode(inst)
@@ -126,18 +269,11 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Stop the process if it's running
-			if inst.Status == "running" {
-				if err := StopProcess(state, inst); err != nil {
-					http.Error(w, fmt.Sprintf("failed to stop process: %v", err), http.StatusInternalServerError)
-					return
-				}
+			if err := DeleteInstance(state, inst, httpActor(r)); err != nil {
+				http.Error(w, fmt.Sprintf("failed to stop process: %v", err), http.StatusInternalServerError)
+				return
 			}
 
-			state.ReleaseResources(req.InstanceID)
-			delete(state.Instances, req.InstanceID)
-			state.Save()
-
 			json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 
 		case "restart":
@@ -147,7 +283,7 @@ func handleInstances(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err := RestartProcess(state, inst); err != nil {
+			if err := RestartProcess(state, inst, httpActor(r)); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
@@ -168,7 +304,11 @@ func handleTemplates(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		json.NewEncoder(w).Encode(state.Templates)
+		if r.URL.Query().Has("project") {
+			json.NewEncoder(w).Encode(visibleTemplates(r, state.ProjectTemplates(r.URL.Query().Get("project"))))
+			return
+		}
+		json.NewEncoder(w).Encode(visibleTemplates(r, state.Templates))
 
 	case "POST":
 		var tmpl Template
@@ -177,8 +317,17 @@ func handleTemplates(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		state.Templates[tmpl.ID] = &tmpl
+		if !authorize(w, r, VerbEditTemplate, "template", projectKey(tmpl.Project, tmpl.ID)) {
+			return
+		}
+		if err := validateTemplate(&tmpl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		state.Templates[projectKey(tmpl.Project, tmpl.ID)] = &tmpl
 		state.Save()
+		state.RecordEvent(httpActor(r), "template", "", "saved "+projectKey(tmpl.Project, tmpl.ID))
 
 		json.NewEncoder(w).Encode(tmpl)
 
@@ -193,7 +342,7 @@ func handleResources(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		// Group resources by type for better display
 		grouped := make(map[string][]Resource)
-		for _, res := range state.Resources {
+		for _, res := range visibleResources(r, state.Resources) {
 			grouped[res.Type] = append(grouped[res.Type], *res)
 		}
 		json.NewEncoder(w).Encode(grouped)
@@ -207,6 +356,9 @@ func handleResourceTypes(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
+		if !authorize(w, r, VerbView, "", "") {
+			return
+		}
 		json.NewEncoder(w).Encode(state.Types)
 
 	case "POST":
@@ -216,6 +368,10 @@ func handleResourceTypes(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !authorize(w, r, VerbEditConfig, "", "") {
+			return
+		}
+
 		// Validate required fields
 		if rt.Name == "" {
 			http.Error(w, "name is required", http.StatusBadRequest)
@@ -227,6 +383,7 @@ func handleResourceTypes(w http.ResponseWriter, r *http.Request) {
 
 		state.Types[rt.Name] = &rt
 		state.Save()
+		state.RecordEvent(httpActor(r), "resource-type", "", "saved "+rt.Name)
 
 		json.NewEncoder(w).Encode(rt)
 
@@ -238,6 +395,11 @@ func handleResourceTypes(w http.ResponseWriter, r *http.Request) {
 func handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	// The config holds every instance, template, token hash and role
+	if !authorize(w, r, VerbEditConfig, "", "") {
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		// Return entire state as JSON
@@ -270,6 +432,12 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		if newState.RemotesAllowed == nil {
 			newState.RemotesAllowed = make(map[string]bool)
 		}
+		if newState.RemoteScopes == nil {
+			newState.RemoteScopes = make(map[string]string)
+		}
+		if newState.Projects == nil {
+			newState.Projects = make(map[string]*Project)
+		}
 
 		// Update global state
 		state.Instances = newState.Instances
@@ -278,9 +446,15 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		state.Counters = newState.Counters
 		state.Types = newState.Types
 		state.RemotesAllowed = newState.RemotesAllowed
+		state.RemoteScopes = newState.RemoteScopes
+		state.Projects = newState.Projects
+		// Tokens and roles are left alone: they are managed only through
+		// their own endpoints and commands, so a config replacement can't
+		// turn auth off or grant itself more
 
 		// Save to disk
 		state.Save()
+		state.RecordEvent(httpActor(r), "config", "", "replaced entire state")
 
 		json.NewEncoder(w).Encode(map[string]string{"status": "saved"})
 
@@ -289,6 +463,36 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleAdopt serves POST /api/adopt, which names the instance in the body;
+// POST /api/instances/{name}:adopt does the same
+func handleAdopt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	var req struct {
+		adoptRequest
+		Name    string `json:"name"`
+		Project string `json:"project"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	name, err := qualifiedKey(req.Project, req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	adoptInstance(w, r, name, req.adoptRequest)
+}
+
 func handleMonitor(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -298,8 +502,9 @@ func handleMonitor(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		PID  int    `json:"pid"`
-		Name string `json:"name"`
+		PID     int    `json:"pid"`
+		Name    string `json:"name"`
+		Project string `json:"project"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -307,7 +512,16 @@ func handleMonitor(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	inst, err := MonitorProcess(state, req.PID, req.Name)
+	name, err := qualifiedKey(req.Project, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, VerbStart, "instance", name) || !authorize(w, r, VerbStart, "template", templateDiscovered) {
+		return
+	}
+
+	inst, err := MonitorProcess(state, req.PID, name, httpActor(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -324,6 +538,11 @@ func handleDiscover(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lists every process on the host, not just instances
+	if !authorize(w, r, VerbEditConfig, "", "") {
+		return
+	}
+
 	// Parse query parameters
 	portsOnly := r.URL.Query().Get("ports_only") != "false"
 
@@ -345,8 +564,9 @@ func handleDiscoverPort(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Port int    `json:"port"`
-		Name string `json:"name"`
+		Port    int    `json:"port"`
+		Name    string `json:"name"`
+		Project string `json:"project"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -354,7 +574,16 @@ func handleDiscoverPort(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	inst, err := DiscoverAndImportProcessOnPort(state, req.Port, req.Name)
+	name, err := qualifiedKey(req.Project, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, VerbStart, "instance", name) || !authorize(w, r, VerbStart, "template", templateDiscovered) {
+		return
+	}
+
+	inst, err := DiscoverAndImportProcessOnPort(state, req.Port, name, httpActor(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -371,32 +600,6 @@ func handleExecuteAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get origin from request
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		// If no origin header, it's a same-origin request (allow)
-		origin = "localhost"
-	}
-
-	// Check if origin is allowed
-	state.mu.Lock()
-	allowed, exists := state.RemotesAllowed[origin]
-	if !exists {
-		// First time seeing this origin - add it as blocked
-		state.RemotesAllowed[origin] = false
-		state.Save()
-		state.mu.Unlock()
-
-		http.Error(w, fmt.Sprintf("Remote origin '%s' not allowed. Enable it in configuration under remotes_allowed to execute actions.", origin), http.StatusForbidden)
-		return
-	}
-	state.mu.Unlock()
-
-	if !allowed {
-		http.Error(w, fmt.Sprintf("Remote origin '%s' is blocked. Set to true in configuration under remotes_allowed to execute actions.", origin), http.StatusForbidden)
-		return
-	}
-
 	var req struct {
 		InstanceName string `json:"instance_name"`
 	}
@@ -406,6 +609,10 @@ func handleExecuteAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authorize(w, r, VerbExecAction, "instance", req.InstanceName) {
+		return
+	}
+
 	inst := state.Instances[req.InstanceName]
 	if inst == nil {
 		http.Error(w, "instance not found", http.StatusNotFound)
@@ -423,6 +630,18 @@ func handleExecuteAction(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to execute action: %v", err), http.StatusInternalServerError)
 		return
 	}
+	state.RecordEvent(httpActor(r), "action", inst.Name, inst.Action)
 
 	json.NewEncoder(w).Encode(map[string]string{"status": "executed", "action": inst.Action})
 }
+
+func handleProjects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(visibleProjects(r))
+}
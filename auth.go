@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// APIToken is a bearer token for the HTTP API. Only its hash is stored.
+type APIToken struct {
+	Name    string `json:"name"`    // Token name, used as the actor
+	Hash    string `json:"hash"`    // hex(sha256(token))
+	Created int64  `json:"created"` // Unix timestamp
+}
+
+// principalKey is the request context key for the authenticated principal
+type principalKey struct{}
+
+// peerUIDKey is the connection context key for a unix socket peer's uid
+type peerUIDKey struct{}
+
+// hashToken returns the stored form of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken generates a new token, stores its hash and returns the plaintext
+func CreateToken(state *State, name string) (string, error) {
+	if state.Tokens[name] != nil {
+		return "", fmt.Errorf("token %s already exists", name)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := "vp_" + hex.EncodeToString(buf)
+
+	state.Tokens[name] = &APIToken{
+		Name:    name,
+		Hash:    hashToken(token),
+		Created: time.Now().Unix(),
+	}
+	state.Save()
+
+	return token, nil
+}
+
+// lookupToken returns the stored token matching a presented bearer token
+func lookupToken(state *State, token string) *APIToken {
+	hash := []byte(hashToken(token))
+	for _, t := range state.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// requestToken extracts a bearer token from the Authorization header, or the
+// vp_token cookie the web UI sets (EventSource can't send headers)
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := r.Cookie("vp_token"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// principal returns the authenticated principal of a request, if any
+func principal(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(string)
+	return p
+}
+
+// authMiddleware authenticates /api requests. Verified client certificates
+// and unix socket peers identify the caller; other TCP clients need a bearer
+// token once any token exists.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The static web UI needs no credentials; it prompts for a token
+		if (!strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/metrics") || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var who string
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			// mTLS: the handshake already verified the client certificate
+			who = "cert:" + certSubject(r.TLS.VerifiedChains[0][0])
+		} else if uid, ok := r.Context().Value(peerUIDKey{}).(int); ok {
+			if !peerAllowed(uid) {
+				writeError(w, http.StatusForbidden, "uid %d may not use this socket", uid)
+				return
+			}
+			who = "unix:" + usernameForUID(uid)
+		} else if token := requestToken(r); token != "" {
+			t := lookupToken(state, token)
+			if t == nil {
+				writeError(w, http.StatusUnauthorized, "invalid token")
+				return
+			}
+			who = "token:" + t.Name
+		} else if len(state.Tokens) > 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vp"`)
+			writeError(w, http.StatusUnauthorized, "bearer token required")
+			return
+		}
+
+		if who != "" {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, who))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peerAllowed reports whether a unix socket peer may use the API:
+// the daemon's own user, root, and users bound to a role
+func peerAllowed(uid int) bool {
+	return uid == os.Getuid() || uid == 0 || len(state.RolesFor("unix:"+usernameForUID(uid))) > 0
+}
+
+// usernameForUID returns the user name for a uid, or the number if unknown
+func usernameForUID(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
+
+// peerCredContext records the uid of unix socket peers via SO_PEERCRED
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		// Mark the connection with an impossible uid so it is refused
+		return context.WithValue(ctx, peerUIDKey{}, -1)
+	}
+	return context.WithValue(ctx, peerUIDKey{}, int(cred.Uid))
+}
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func handleToken(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp token <list|create|revoke>\n")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		// Hashes stay out of the output
+		type tokenRow struct {
+			Name    string `json:"name"`
+			Created int64  `json:"created"`
+		}
+		var rows []tokenRow
+		for name, t := range state.Tokens {
+			rows = append(rows, tokenRow{name, t.Created})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+
+		printList(rows, func(t tokenRow) string { return t.Name }, func(rows []tokenRow, wide bool) {
+			for _, t := range rows {
+				fmt.Printf("%-20s created %s\n", t.Name, time.Unix(t.Created, 0).Format("2006-01-02 15:04:05"))
+			}
+		})
+	case "create":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp token create <name>\n")
+			os.Exit(1)
+		}
+		token, err := CreateToken(state, args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		state.RecordEvent(cliActor(), "token", "", "created "+args[1])
+		fmt.Printf("Created token %s (shown only once):\n%s\n", args[1], token)
+	case "revoke":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp token revoke <name>\n")
+			os.Exit(1)
+		}
+		if state.Tokens[args[1]] == nil {
+			fmt.Fprintf(os.Stderr, "Token not found: %s\n", args[1])
+			os.Exit(1)
+		}
+		delete(state.Tokens, args[1])
+		state.Save()
+		state.RecordEvent(cliActor(), "token", "", "revoked "+args[1])
+		fmt.Printf("Revoked token %s\n", args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown token command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAuthMiddleware tests that tokens are only required once one exists,
+// and that the authenticated token becomes the request's principal
+func TestAuthMiddleware(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	state = &State{
+		Instances: make(map[string]*Instance),
+		Templates: make(map[string]*Template),
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types:     DefaultResourceTypes(),
+		Tokens:    make(map[string]*APIToken),
+	}
+
+	var seen string
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = httpActor(r)
+	}))
+	do := func(path, token string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("/api/instances", ""); code != http.StatusOK {
+		t.Fatalf("Expected open API without tokens, got %d", code)
+	}
+
+	token, err := CreateToken(state, "ci")
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if state.Tokens["ci"].Hash == token {
+		t.Errorf("Expected only the token hash to be stored")
+	}
+
+	if code := do("/api/instances", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+	if code := do("/api/instances", "vp_wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", code)
+	}
+	if code := do("/", ""); code != http.StatusOK {
+		t.Errorf("Expected the web UI to load without a token, got %d", code)
+	}
+	if code := do("/api/instances", token); code != http.StatusOK || seen != "token:ci" {
+		t.Errorf("Expected 200 as token:ci, got %d as %q", code, seen)
+	}
+
+	// Replacing the config keeps the tokens and roles, even when it lists none
+	state.Roles = map[string]*Role{"viewer": {Name: "viewer"}}
+	req := httptest.NewRequest("POST", "/api/config", strings.NewReader(`{"tokens":{},"roles":{}}`))
+	rec := httptest.NewRecorder()
+	handleConfig(rec, req)
+	if rec.Code != http.StatusOK || state.Tokens["ci"] == nil || state.Roles["viewer"] == nil {
+		t.Errorf("Expected the config to keep tokens and roles, got %d with %v %v", rec.Code, state.Tokens, state.Roles)
+	}
+}
+
+// TestIsLoopback tests the listen addresses served without a token
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		"0.0.0.0:8080":   false,
+		":8080":          false,
+		"10.0.0.5:8080":  false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daemonSocket returns the unix socket of a running `vp serve --socket` that
+// instance commands should go through (VP_DAEMON), or "" to act on local
+// state. Going through the daemon lets teammates share one vp, with their
+// roles enforced by the daemon.
+func daemonSocket() string {
+	return os.Getenv("VP_DAEMON")
+}
+
+// daemonCall performs an API request over the daemon socket and decodes the
+// JSON response into out (if non-nil)
+func daemonCall(method, path string, body, out interface{}) error {
+	resp, err := daemonRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return daemonError(data)
+	}
+
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// daemonRequest sends an API request over the daemon socket and returns the
+// response for the caller to read
+func daemonRequest(method, path string, body interface{}) (*http.Response, error) {
+	socket := daemonSocket()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://vp"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("daemon at %s: %w", socket, err)
+	}
+	return resp, nil
+}
+
+// daemonError turns an error response body into an error
+func daemonError(data []byte) error {
+	var apiErr struct {
+		Error APIError `json:"error"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+		return fmt.Errorf("%s", apiErr.Error.Message)
+	}
+	return fmt.Errorf("%s", strings.TrimSpace(string(data)))
+}
+
+// daemonExec runs vp exec on the daemon, copying the output to stdout, and
+// returns the command's exit code
+func daemonExec(name string, req execRequest) (int, error) {
+	resp, err := daemonRequest("POST", instancePath(name, "exec"), req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		return -1, daemonError(data)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return -1, err
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get(execExitHeader))
+	if err != nil {
+		return -1, fmt.Errorf("daemon closed the connection before the command finished")
+	}
+	return code, nil
+}
+
+// instancePath returns the REST path of an instance in the current project
+func instancePath(name, verb string) string {
+	path := "/api/instances/" + url.PathEscape(name)
+	if verb != "" {
+		path += ":" + verb
+	}
+	return path + "?project=" + url.QueryEscape(currentProject)
+}
+
+// runOnDaemon forwards an instance command to the daemon. It reports false
+// for commands that only work on local state.
+func runOnDaemon(cmd string, args []string) bool {
+	var err error
+
+	switch cmd {
+	case "ps":
+		path := "/api/instances?project=" + url.QueryEscape(currentProject)
+		if parseVars(args)["all"] == "true" {
+			path = "/api/instances"
+		}
+		var instances map[string]*Instance
+		if err = daemonCall("GET", path, nil, &instances); err == nil {
+			printInstances(instances)
+		}
+
+	case "start":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp start <template> <name> [--key=value...]\n")
+			os.Exit(1)
+		}
+		body := map[string]interface{}{"template": args[0], "vars": parseVars(args[2:])}
+		var inst Instance
+		if err = daemonCall("PUT", instancePath(args[1], ""), body, &inst); err == nil {
+			printObject(&inst, displayName(&inst), func(bool) {
+				fmt.Printf("Started %s (PID %d)\n", inst.Name, inst.PID)
+			})
+		}
+
+	case "stop", "restart", "reload":
+		if len(args) < 1 {
+			fmt.Fprintf(os.Stderr, "Usage: vp %s <name>\n", cmd)
+			os.Exit(1)
+		}
+		var body interface{}
+		if cmd == "restart" {
+			if flags := parseRestartFlags(args[1:]); flags != (restartFlags{}) {
+				body = flags
+			}
+		}
+		var inst Instance
+		if err = daemonCall("POST", instancePath(args[0], cmd), body, &inst); err == nil {
+			printObject(&inst, displayName(&inst), func(bool) {
+				switch cmd {
+				case "stop":
+					fmt.Printf("Stopped %s\n", inst.Name)
+				case "reload":
+					fmt.Printf("Reloaded %s\n", inst.Name)
+				default:
+					fmt.Printf("Restarted %s (PID %d)\n", inst.Name, inst.PID)
+				}
+			})
+		}
+
+	case "signal":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp signal <name> <SIGNAL>\n")
+			os.Exit(1)
+		}
+		sig, parseErr := parseSignal(args[1])
+		if parseErr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", parseErr)
+			os.Exit(1)
+		}
+		var inst Instance
+		body := map[string]string{"signal": args[1]}
+		if err = daemonCall("POST", instancePath(args[0], "signal"), body, &inst); err == nil {
+			printObject(&inst, displayName(&inst), func(bool) {
+				fmt.Printf("Sent %s to %s (PID %d)\n", signalName(sig), inst.Name, inst.PID)
+			})
+		}
+
+	case "scale":
+		if len(args) < 1 || strings.HasPrefix(args[0], "--") {
+			fmt.Fprintf(os.Stderr, "Usage: vp scale <group> --replicas=N [--template=<id>] [--key=value...]\n")
+			os.Exit(1)
+		}
+		vars := parseVars(args[1:])
+		n, convErr := strconv.Atoi(vars["replicas"])
+		if convErr != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --replicas must be a number of replicas\n")
+			os.Exit(1)
+		}
+		body := map[string]interface{}{"template": vars["template"], "replicas": n}
+		delete(vars, "replicas")
+		delete(vars, "template")
+		body["vars"] = vars
+		path := "/api/groups/" + url.PathEscape(args[0]) + "?project=" + url.QueryEscape(currentProject)
+		var g Group
+		if err = daemonCall("PUT", path, body, &g); err == nil {
+			printGroup(&g)
+		}
+
+	case "job":
+		if len(args) < 1 {
+			return false // Prints the usage
+		}
+		switch args[0] {
+		case "list":
+			var infos []*JobInfo
+			if err = daemonCall("GET", "/api/jobs?project="+url.QueryEscape(currentProject), nil, &infos); err == nil {
+				printJobs(infos)
+			}
+		case "run", "history", "logs":
+			if len(args) < 2 {
+				return false
+			}
+			path := "/api/jobs/" + url.PathEscape(args[1])
+			query := "?project=" + url.QueryEscape(currentProject)
+			switch args[0] {
+			case "run":
+				var run JobRun
+				if err = daemonCall("POST", path+":run"+query, nil, &run); err == nil {
+					printObject(&run, run.owner(), func(bool) {
+						fmt.Printf("Started run %d of %s (%s)\n", run.ID, run.Job, run.Status)
+					})
+				}
+			case "history":
+				var runs []*JobRun
+				if err = daemonCall("GET", path+"/runs"+query, nil, &runs); err == nil {
+					limit, _ := strconv.Atoi(parseVars(args[2:])["limit"])
+					printRuns(runs, limit)
+				}
+			case "logs":
+				if len(args) < 3 {
+					var runs []*JobRun
+					if err = daemonCall("GET", path+"/runs"+query, nil, &runs); err == nil && len(runs) == 0 {
+						err = fmt.Errorf("no runs of %s", args[1])
+					}
+					if err != nil {
+						break
+					}
+					args = append(args, strconv.Itoa(runs[len(runs)-1].ID))
+				}
+				var resp *http.Response
+				if resp, err = daemonRequest("GET", path+"/runs/"+url.PathEscape(args[2])+"/log"+query, nil); err == nil {
+					data, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode >= 400 {
+						err = daemonError(data)
+					} else {
+						os.Stdout.Write(data)
+					}
+				}
+			}
+		default:
+			return false
+		}
+
+	case "exec":
+		name, command := execArgs(args)
+		req := execRequest{Command: command}
+		// Piped input is sent along; a terminal can't be
+		if fi, statErr := os.Stdin.Stat(); statErr == nil && fi.Mode()&os.ModeCharDevice == 0 {
+			data, _ := io.ReadAll(os.Stdin)
+			req.Stdin = string(data)
+		}
+		var code int
+		if code, err = daemonExec(name, req); err == nil {
+			os.Exit(code)
+		}
+
+	case "delete":
+		if len(args) < 1 {
+			fmt.Fprintf(os.Stderr, "Usage: vp delete <name>\n")
+			os.Exit(1)
+		}
+		if err = daemonCall("DELETE", instancePath(args[0], ""), nil, nil); err == nil {
+			fmt.Printf("Deleted %s\n", projectKey(currentProject, args[0]))
+		}
+
+	default:
+		return false
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseSchedule tests parsing of cron fields, names and macros
+func TestParseSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		expr  string
+		time  string
+		match bool
+	}{
+		{"*/15 * * * *", "2025-03-04 10:30", true},
+		{"*/15 * * * *", "2025-03-04 10:31", false},
+		{"0 2-4 * * *", "2025-03-04 03:00", true},
+		{"0 2-4 * * *", "2025-03-04 05:00", false},
+		{"30 9 * * MON-FRI", "2025-03-08 09:30", false}, // Saturday
+		{"30 9 * * mon-fri", "2025-03-07 09:30", true},
+		{"0 0 * * 7", "2025-03-09 00:00", true}, // 7 is Sunday
+		{"0 0 1 JAN *", "2025-01-01 00:00", true},
+		{"5/20 * * * *", "2025-01-01 00:45", true},
+		{"0 0 13 * FRI", "2025-03-13 00:00", true}, // Either day field matches
+		{"0 0 13 * FRI", "2025-03-14 00:00", true},
+		{"0 0 13 * FRI", "2025-03-15 00:00", false},
+		{"@daily", "2025-03-04 00:00", true},
+		{"@hourly", "2025-03-04 07:01", false},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", tt.expr, err)
+		}
+		if got := s.Matches(at(tt.time)); got != tt.match {
+			t.Errorf("%q at %s = %v, want %v", tt.expr, tt.time, got, tt.match)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@sometimes"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("Expected error for %q", expr)
+		}
+	}
+}
+
+// TestScheduleNext tests finding the next time a schedule fires
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2025, 3, 4, 10, 31, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2025, 3, 4, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2025, 3, 5, 2, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, _ := ParseSchedule(tt.expr)
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
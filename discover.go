@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// noisyEnv are variables shells change on their own, which say nothing about
+// how a process was launched
+var noisyEnv = map[string]bool{
+	"_": true, "SHLVL": true, "PWD": true, "OLDPWD": true, "LINES": true, "COLUMNS": true,
+}
+
+// isShellProcess reports whether a process is a shell
+func isShellProcess(p ProcessInfo) bool {
+	return IsShell(p.Name) || IsShell(filepath.Base(p.Exe))
+}
+
+// wrapperShell reports whether a shell runs a script or a -c command, such
+// as the sh -c that npm scripts run in, rather than taking typed commands
+func wrapperShell(p ProcessInfo) bool {
+	if !isShellProcess(p) {
+		return false
+	}
+	for _, arg := range p.Argv[min(1, len(p.Argv)):] {
+		if arg == "-c" || !strings.HasPrefix(arg, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+// launchProcess finds the process a user launched to end up with the first
+// one in a parent chain, and the shell it was launched from (nil if none).
+// Shells that only wrap a command count as part of the launch.
+func launchProcess(chain []ProcessInfo) (launch, shell *ProcessInfo) {
+	masked := make([]ProcessInfo, len(chain))
+	copy(masked, chain)
+	for i := range masked {
+		if wrapperShell(masked[i]) {
+			masked[i].Name, masked[i].Exe = "", ""
+		}
+	}
+	if found := FindLaunchScript(masked); found != nil {
+		for i := range chain {
+			if chain[i].PID == found.PID && i+1 < len(chain) && isShellProcess(masked[i+1]) {
+				return &chain[i], &chain[i+1]
+			}
+		}
+	}
+	// Not started from a shell (a service manager, a terminal emulator):
+	// the process itself is what to launch
+	return &chain[0], nil
+}
+
+// TemplateFromProcess generates a template that launches a running process
+// again the way it was started: the launch command found by walking its
+// parents, its working directory, the environment variables it was given on
+// top of its shell's and vp's, and its listening port replaced by ${tcpport}. It
+// also returns notes on what the template can't reproduce.
+func TemplateFromProcess(pid int, id string) (*Template, []string, error) {
+	chain, err := GetParentChain(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(chain) == 0 {
+		return nil, nil, fmt.Errorf("could not read process info for PID %d", pid)
+	}
+	target := chain[0]
+	launch, shell := launchProcess(chain)
+	if len(launch.Argv) == 0 {
+		return nil, nil, fmt.Errorf("PID %d has no command line (a kernel thread?)", launch.PID)
+	}
+
+	name := filepath.Base(launch.Argv[0])
+	if id == "" {
+		id = name
+	}
+	tmpl := &Template{
+		ID:        id,
+		Label:     fmt.Sprintf("%s (generated from PID %d)", name, pid),
+		Command:   launch.Cmdline,
+		Resources: []string{},
+		Vars:      make(map[string]string),
+	}
+	var notes []string
+	for _, arg := range launch.Argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n") {
+			notes = append(notes, fmt.Sprintf("argument %q can't be written in a template command, which is split on spaces; vp adopt keeps it", arg))
+		}
+	}
+
+	// A shell's environ is what it started with, not what its rc files
+	// exported since, so variables vp has too are left out as well
+	if shell != nil {
+		for k, v := range launch.Environ {
+			if !noisyEnv[k] && shell.Environ[k] != v && os.Getenv(k) != v {
+				if tmpl.Env == nil {
+					tmpl.Env = make(map[string]string)
+				}
+				tmpl.Env[k] = v
+			}
+		}
+	}
+
+	// The first listening port the command or env mentions becomes a
+	// resource, so each instance gets a free one
+	ports := append([]int{}, target.Ports...)
+	sort.Ints(ports)
+	parametrized := false
+	for _, port := range ports {
+		re := regexp.MustCompile(`\b` + strconv.Itoa(port) + `\b`)
+		mentioned := re.MatchString(tmpl.Command)
+		for _, v := range tmpl.Env {
+			mentioned = mentioned || re.MatchString(v)
+		}
+		if !mentioned {
+			continue
+		}
+		tmpl.Command = re.ReplaceAllLiteralString(tmpl.Command, "${tcpport}")
+		for k, v := range tmpl.Env {
+			tmpl.Env[k] = re.ReplaceAllLiteralString(v, "${tcpport}")
+		}
+		tmpl.Resources = append(tmpl.Resources, "tcpport")
+		parametrized = true
+		break
+	}
+	if !parametrized {
+		for _, port := range ports {
+			notes = append(notes, fmt.Sprintf("listens on port %d, which neither its command nor its env mention, so every instance will use it", port))
+		}
+	}
+
+	if launch.Cwd != "" {
+		tmpl.Resources = append(tmpl.Resources, "workdir")
+		tmpl.Vars["workdir"] = launch.Cwd
+	}
+	if launch.PID != pid {
+		notes = append(notes, fmt.Sprintf("launched by PID %d: %s", launch.PID, launch.Cmdline))
+	}
+	return tmpl, notes, nil
+}
+
+// AdoptProcess takes over a running process as a managed instance. It
+// records what vp needs to launch the process again itself: its exact
+// arguments, working directory, environment and user. With restart, the
+// process is relaunched right away so that vp supervises it and captures
+// its output.
+func AdoptProcess(state *State, pid int, name string, restart bool, actor string) (*Instance, error) {
+	if state.Instances[name] != nil {
+		return nil, fmt.Errorf("instance %s already exists", name)
+	}
+	if !IsProcessRunning(pid) {
+		return nil, fmt.Errorf("process %d not running", pid)
+	}
+	for _, other := range state.Instances {
+		if other.PID == pid {
+			return nil, fmt.Errorf("process %d is instance %s already", pid, other.Name)
+		}
+	}
+	if !canManageProcess(pid) {
+		return nil, fmt.Errorf("cannot signal process %d, adopting it needs vp to be able to stop it", pid)
+	}
+
+	info, err := ReadProcessInfo(pid)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read process %d: %w", pid, err)
+	}
+	argv := info.Argv
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("cannot read the arguments of process %d", pid)
+	}
+	cred, err := processCredential(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The environment vp launches with already has what the process shares
+	// with vp, and only the rest is worth keeping, secrets vp has included
+	env := make(map[string]string)
+	for k, v := range info.Environ {
+		if own, ok := os.LookupEnv(k); (!ok || own != v) && !noisyEnv[k] && k != instanceEnv && k != execEnv {
+			env[k] = v
+		}
+	}
+
+	inst := &Instance{
+		Name:      name,
+		Template:  templateAdopted,
+		Command:   strings.Join(argv, " "),
+		Argv:      argv,
+		PID:       pid,
+		Status:    "running",
+		Resources: make(map[string]string),
+		Started:   info.StartTime,
+		Cwd:       info.Cwd,
+		Managed:   true,
+		Env:       env,
+		UID:       int(cred.Uid),
+		GID:       int(cred.Gid),
+	}
+	for _, g := range cred.Groups {
+		inst.Groups = append(inst.Groups, int(g))
+	}
+	inst.Project, _ = splitProjectKey(name)
+
+	// Only resource types vp can claim again when it relaunches the process
+	if info.Cwd != "" {
+		inst.Resources["workdir"] = info.Cwd
+	}
+	if len(info.Ports) > 0 {
+		ports := append([]int{}, info.Ports...)
+		sort.Ints(ports)
+		inst.Resources["tcpport"] = strconv.Itoa(ports[0])
+	}
+	for rtype, value := range inst.Resources {
+		state.ClaimResource(rtype, value, name, actor)
+	}
+
+	state.Instances[name] = inst
+	state.Save()
+	state.RecordEvent(actor, "adopt", name, fmt.Sprintf("PID %d: %s", pid, inst.Command))
+
+	if !restart {
+		go awaitExit(state, name, pid)
+		return inst, nil
+	}
+	if err := StopProcess(state, inst, actor); err != nil {
+		return inst, err
+	}
+	state.ReleaseResources(name, actor)
+	if err := RestartProcess(state, inst, actor); err != nil {
+		return inst, err
+	}
+	return inst, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLaunchProcess tests that shells wrapping a command count as part of
+// the launch and that processes not started from a shell launch themselves
+func TestLaunchProcess(t *testing.T) {
+	chain := []ProcessInfo{
+		{PID: 40, Name: "node", Cmdline: "node server.js", Argv: []string{"node", "server.js"}},
+		{PID: 30, Name: "sh", Cmdline: "sh -c node server.js", Argv: []string{"sh", "-c", "node server.js"}},
+		{PID: 20, Name: "npm run dev", Cmdline: "npm run dev", Argv: []string{"npm", "run", "dev"}},
+		{PID: 10, Name: "bash", Cmdline: "-bash", Argv: []string{"-bash"}},
+		{PID: 1, Name: "systemd", Cmdline: "/sbin/init", Argv: []string{"/sbin/init"}},
+	}
+	launch, shell := launchProcess(chain)
+	if launch.PID != 20 || shell == nil || shell.PID != 10 {
+		t.Errorf("Expected npm launched from bash, got %+v from %+v", launch, shell)
+	}
+
+	chain = []ProcessInfo{
+		{PID: 40, Name: "nginx", Cmdline: "nginx -g daemon off;", Argv: []string{"nginx", "-g", "daemon off;"}},
+		{PID: 1, Name: "systemd", Cmdline: "/sbin/init", Argv: []string{"/sbin/init"}},
+	}
+	if launch, shell := launchProcess(chain); launch.PID != 40 || shell != nil {
+		t.Errorf("Expected nginx to launch itself, got %+v from %+v", launch, shell)
+	}
+}
+
+// TestTemplateFromProcess tests the template generated from a running process
+func TestTemplateFromProcess(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("sleep", "30")
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tmpl, _, err := TemplateFromProcess(cmd.Process.Pid, "")
+	if err != nil {
+		t.Fatalf("TemplateFromProcess failed: %v", err)
+	}
+	if tmpl.ID != "sleep" || tmpl.Command != "sleep 30" {
+		t.Errorf("Unexpected template %s: %s", tmpl.ID, tmpl.Command)
+	}
+	if len(tmpl.Resources) != 1 || tmpl.Resources[0] != "workdir" || tmpl.Vars["workdir"] != dir {
+		t.Errorf("Expected workdir %s, got %v %v", dir, tmpl.Resources, tmpl.Vars)
+	}
+}
+
+// TestAdoptProcess tests that an adopted process is relaunched with its
+// exact arguments, directory and environment, plus the VP_INSTANCE marker
+func TestAdoptProcess(t *testing.T) {
+	state := jobTestState(t)
+	dir := t.TempDir()
+	cmd := exec.Command("sh", "-c", `echo "$1" "$(pwd)" "$VP_TEST_ADOPT" "$VP_INSTANCE"; sleep 30`, "sh", "a  b")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "VP_TEST_ADOPT=yes")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	go cmd.Wait()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	time.Sleep(50 * time.Millisecond)
+
+	inst, err := AdoptProcess(state, cmd.Process.Pid, "svc", true, "test")
+	if err != nil {
+		t.Fatalf("AdoptProcess failed: %v", err)
+	}
+	defer func() {
+		state.mu.Lock() // As vp serve would, since the reaper takes it too
+		StopProcess(state, inst, "test")
+		state.mu.Unlock()
+	}()
+	if len(inst.Argv) != 5 || inst.Argv[4] != "a  b" || inst.UID != os.Getuid() {
+		t.Errorf("Unexpected argv %q or UID %d", inst.Argv, inst.UID)
+	}
+	if len(inst.Env) != 1 || inst.Env["VP_TEST_ADOPT"] != "yes" {
+		t.Errorf("Expected only the variable vp doesn't share to be kept, got %v", inst.Env)
+	}
+	if inst.PID == cmd.Process.Pid || inst.Status != "running" {
+		t.Fatalf("Expected a relaunched process, got PID %d (%s)", inst.PID, inst.Status)
+	}
+	if _, err := AdoptProcess(state, inst.PID, "svc2", false, "test"); err == nil {
+		t.Errorf("Expected adopting an instance's process again to fail")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	data, _ := os.ReadFile(InstanceLogPath("svc"))
+	if want := "a  b " + dir + " yes svc\n"; !strings.Contains(string(data), want) {
+		t.Errorf("Expected %q in the log, got %q", want, data)
+	}
+}
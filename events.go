@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// actorReconciler is the actor for changes vp makes on its own
+// (process exits, re-attaching instances to running processes)
+const actorReconciler = "reconciler"
+
+// actorScheduler is the actor for scheduled job runs
+const actorScheduler = "scheduler"
+
+// actorWatcher is the actor for restarts and reloads after files changed
+const actorWatcher = "watcher"
+
+// cliActor returns the actor for commands run from the CLI
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return fmt.Sprintf("cli:uid=%d", os.Getuid())
+}
+
+// httpActor returns the actor for an HTTP request: the authenticated
+// principal, else its Origin, else the remote address
+func httpActor(r *http.Request) string {
+	if p := principal(r); p != "" {
+		return p
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return "http:" + origin
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "http:" + host
+	}
+	return "http:" + r.RemoteAddr
+}
+
+// EventFilter selects events from the journal
+type EventFilter struct {
+	Instance string // Only events for this instance (empty = all)
+	Since    int64  // Only events at or after this Unix time
+	Limit    int    // Only the last N matching events (0 = all)
+}
+
+// QueryEvents reads the event journal and applies a filter
+func QueryEvents(state *State, filter EventFilter) ([]*Event, error) {
+	events, err := state.backend().ReadEvents()
+	if err != nil {
+		return nil, err
+	}
+	return filterEvents(events, filter), nil
+}
+
+// filterEvents applies a filter to events read from the journal
+func filterEvents(events []*Event, filter EventFilter) []*Event {
+	result := make([]*Event, 0, len(events))
+	for _, ev := range events {
+		if filter.Instance != "" && ev.Instance != filter.Instance {
+			continue
+		}
+		if ev.Time < filter.Since {
+			continue
+		}
+		result = append(result, ev)
+	}
+
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result
+}
+
+// formatEvent renders an event as a single human-readable line
+func formatEvent(ev *Event) string {
+	return fmt.Sprintf("%s  %-24s %-10s %-20s %s",
+		time.Unix(ev.Time, 0).Format("2006-01-02 15:04:05"), ev.Actor, ev.Type, ev.Instance, ev.Detail)
+}
+
+// printEvents prints journal entries in the format chosen with --output
+func printEvents(events []*Event) {
+	printList(events, func(ev *Event) string { return ev.Instance }, func(events []*Event, wide bool) {
+		for _, ev := range events {
+			fmt.Println(formatEvent(ev))
+		}
+	})
+}
+
+func handleEvents(args []string) {
+	vars := parseVars(args)
+
+	filter := EventFilter{}
+	if vars["instance"] != "" {
+		filter.Instance = cliKey(vars["instance"])
+	}
+	if vars["limit"] != "" {
+		filter.Limit, _ = strconv.Atoi(vars["limit"])
+	}
+
+	// --follow continues from the same read, so no event is missed in between
+	all, cursor, err := state.backend().ReadEventsAfter(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading events: %v\n", err)
+		os.Exit(1)
+	}
+	printEvents(filterEvents(all, filter))
+
+	if vars["follow"] != "true" {
+		return
+	}
+
+	// Poll the journal for entries past the cursor; works the same for
+	// every backend
+	for {
+		time.Sleep(1 * time.Second)
+
+		fresh, next, err := state.backend().ReadEventsAfter(cursor)
+		if err != nil {
+			continue
+		}
+		cursor = next
+		if fresh = filterEvents(fresh, EventFilter{Instance: filter.Instance}); len(fresh) > 0 {
+			printEvents(fresh)
+		}
+	}
+}
+
+// canViewEvent reports whether a subject may see events about an instance.
+// Events not about an instance (templates, config) need edit-config.
+func canViewEvent(subject, instance string) bool {
+	if instance == "" {
+		return state.Permits(subject, VerbEditConfig, "", "")
+	}
+	return state.Permits(subject, VerbView, "instance", instance)
+}
+
+func handleEventsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := EventFilter{Instance: query.Get("instance")}
+	if since := query.Get("since"); since != "" {
+		filter.Since, _ = strconv.ParseInt(since, 10, 64)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, _ = strconv.Atoi(limit)
+	}
+
+	events, err := QueryEvents(state, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Role-restricted callers only see events for instances they can view
+	visible := make([]*Event, 0, len(events))
+	for _, ev := range events {
+		if canViewEvent(principal(r), ev.Instance) {
+			visible = append(visible, ev)
+		}
+	}
+
+	json.NewEncoder(w).Encode(visible)
+}
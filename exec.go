@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ExecVars returns the variables a command run with `vp exec` sees: the
+// instance's vars, overridden by its current resources
+func ExecVars(state *State, inst *Instance) map[string]string {
+	vars := make(map[string]string)
+	if inst.Vars != nil {
+		for k, v := range inst.Vars {
+			vars[k] = v
+		}
+	} else if tmpl := state.Templates[inst.Template]; tmpl != nil {
+		// Started before instances kept their vars
+		for k, v := range tmpl.Vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range inst.Resources {
+		vars[k] = v
+	}
+	return vars
+}
+
+// execEnv marks commands run with vp exec
+const execEnv = "VP_EXEC"
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// envName turns a var into an environment variable name: tcpport -> TCPPORT
+func envName(key string) string {
+	return envUnsafe.ReplaceAllString(strings.ToUpper(key), "_")
+}
+
+// RunExec runs a one-off command in the context of an instance: ${var}
+// interpolated into its arguments, the vars in its environment, in the
+// instance's workdir and, while it runs, as the instance's user and in its
+// cgroup. It returns the command's exit code.
+func RunExec(ctx context.Context, state *State, inst *Instance, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if len(args) == 0 {
+		return -1, fmt.Errorf("no command given")
+	}
+
+	vars := ExecVars(state, inst)
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		argv[i] = interpolate(arg, vars)
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = inst.Resources["workdir"] // Like launch
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	cmd.Env = os.Environ()
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, envName(k)+"="+v)
+	}
+	for k, v := range inst.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	// VP_EXEC keeps the command from being taken for the instance's process
+	cmd.Env = append(cmd.Env, instanceEnv+"="+inst.Name, execEnv+"=1")
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if inst.Status == "running" && inst.PID > 0 {
+		// Run as the instance's user when we can switch to it
+		if cred, err := processCredential(inst.PID); err == nil && os.Getuid() == 0 && (cred.Uid != 0 || cred.Gid != 0) {
+			cmd.SysProcAttr.Credential = cred
+		}
+		if cgroup := processCgroup(inst.PID); cgroup != "" {
+			if dir, err := os.Open(cgroup); err == nil {
+				defer dir.Close()
+				cmd.SysProcAttr.UseCgroupFD = true
+				cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+			}
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	return exitCode(cmd.Wait())
+}
+
+// exitCode turns the result of waiting for a command into its exit code,
+// 128+n for a command killed by signal n as shells report it
+func exitCode(err error) (int, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// processCredential returns the user, group and supplementary groups a
+// process runs as, from /proc/<pid>/status
+func processCredential(pid int) (*syscall.Credential, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cred := &syscall.Credential{}
+	found := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		fields := strings.Fields(value)
+		switch key {
+		case "Uid", "Gid":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("cannot read %s of process %d", key, pid)
+			}
+			id, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s of process %d: %w", key, pid, err)
+			}
+			if key == "Uid" {
+				cred.Uid = uint32(id)
+			} else {
+				cred.Gid = uint32(id)
+			}
+			found++
+		case "Groups":
+			for _, g := range fields {
+				if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+					cred.Groups = append(cred.Groups, uint32(id))
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found < 2 {
+		return nil, fmt.Errorf("cannot read the owner of process %d", pid)
+	}
+	return cred, nil
+}
+
+// processCgroup returns the cgroup v2 directory of a process if it differs
+// from ours and we may move processes into it, else ""
+func processCgroup(pid int) string {
+	own, theirs := readCgroup("self"), readCgroup(strconv.Itoa(pid))
+	if theirs == "" || theirs == own {
+		return ""
+	}
+	dir := "/sys/fs/cgroup" + theirs
+	if syscall.Access(dir+"/cgroup.procs", 2 /* W_OK */) != nil {
+		return ""
+	}
+	return dir
+}
+
+// readCgroup returns the unified (v2) cgroup path from /proc/<pid>/cgroup
+func readCgroup(pid string) string {
+	data, err := os.ReadFile("/proc/" + pid + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// execRequest is the body of POST /api/instances/{name}:exec
+type execRequest struct {
+	Command []string `json:"command"`
+	Stdin   string   `json:"stdin,omitempty"`
+}
+
+// execExitHeader is the trailer that carries the exit code of an exec
+const execExitHeader = "X-VP-Exit-Code"
+
+// handleInstanceExec runs a command for POST /api/instances/{name}:exec and
+// streams its combined output. The exit code follows as a trailer, since
+// the status is sent before the command finishes.
+func handleInstanceExec(w http.ResponseWriter, r *http.Request, inst *Instance, actor string) {
+	var req execRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	if len(req.Command) == 0 {
+		writeError(w, http.StatusBadRequest, "command required")
+		return
+	}
+	state.RecordEvent(actor, "exec", inst.Name, strings.Join(req.Command, " "))
+
+	// The command runs on a copy of what it reads from the instance, so the
+	// state is free for other requests meanwhile
+	run := *inst
+	run.Vars = ExecVars(state, inst)
+	run.Resources = maps.Clone(inst.Resources)
+	run.Env = maps.Clone(inst.Env)
+	inst = &run
+	releaseState(r)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", execExitHeader)
+	w.WriteHeader(http.StatusOK)
+
+	out := &flushWriter{w: w}
+	code, err := RunExec(r.Context(), state, inst, req.Command, strings.NewReader(req.Stdin), out, out)
+	if err != nil {
+		fmt.Fprintf(out, "vp exec: %v\n", err)
+		code = 127
+	}
+	w.Header().Set(execExitHeader, strconv.Itoa(code))
+}
+
+// flushWriter flushes after every write so output streams to the client
+type flushWriter struct {
+	w  http.ResponseWriter
+	mu sync.Mutex
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// execArgs splits `vp exec <name> [--] <command...>` into the name and the
+// command
+func execArgs(args []string) (string, []string) {
+	if len(args) > 1 && args[1] == "--" {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: vp exec <name> -- <command> [args...]\n")
+		os.Exit(1)
+	}
+	return args[0], args[1:]
+}
+
+func handleExec(args []string) {
+	name, command := execArgs(args)
+	name = cliKey(name)
+	if err := MatchAndUpdateInstances(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
+	}
+	inst := state.Instances[name]
+	if inst == nil {
+		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
+		state.Save()
+		os.Exit(1)
+	}
+	state.RecordEvent(cliActor(), "exec", name, strings.Join(command, " "))
+
+	code, err := RunExec(context.Background(), state, inst, command, os.Stdin, os.Stdout, os.Stderr)
+	// os.Exit skips main's deferred Save, which keeps what discovery found
+	state.Save()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(127)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestExecVars tests that resources override vars and that instances
+// without vars fall back to their template's
+func TestExecVars(t *testing.T) {
+	s := &State{Templates: map[string]*Template{"web": {ID: "web", Vars: map[string]string{"mode": "dev"}}}}
+
+	inst := &Instance{Name: "w1", Template: "web", Vars: map[string]string{"mode": "prod", "tcpport": "1"}, Resources: map[string]string{"tcpport": "3000"}}
+	if vars := ExecVars(s, inst); vars["mode"] != "prod" || vars["tcpport"] != "3000" {
+		t.Errorf("Unexpected vars %v", vars)
+	}
+
+	old := &Instance{Name: "w2", Template: "web"}
+	if vars := ExecVars(s, old); vars["mode"] != "dev" {
+		t.Errorf("Expected template vars, got %v", vars)
+	}
+}
+
+// TestRunExec tests interpolation, environment, directory and exit code
+func TestRunExec(t *testing.T) {
+	dir := t.TempDir()
+	inst := &Instance{Name: "w1", Status: "stopped", Vars: map[string]string{"db-name": "app"}, Resources: map[string]string{"tcpport": "3000", "workdir": dir}}
+	s := &State{Templates: map[string]*Template{}}
+
+	var out bytes.Buffer
+	code, err := RunExec(context.Background(), s, inst, []string{"sh", "-c", `echo ${tcpport} $TCPPORT $DB_NAME $VP_INSTANCE "$(pwd)"; read x; echo $x; exit 4`}, strings.NewReader("in\n"), &out, &out)
+	if err != nil {
+		t.Fatalf("RunExec failed: %v", err)
+	}
+	if code != 4 {
+		t.Errorf("Expected exit code 4, got %d", code)
+	}
+	if want := "3000 3000 app w1 " + dir + "\nin\n"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+
+	if _, err := RunExec(context.Background(), s, inst, []string{"vp-no-such-command"}, nil, &out, &out); err == nil {
+		t.Error("Expected error for missing command")
+	}
+}
@@ -3,6 +3,8 @@ module github.com/dagelf/vp
 go 1.24.7
 
 require (
-	github.com/fsnotify/fsnotify v1.9.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	github.com/fsnotify/fsnotify v1.9.0
+	go.etcd.io/bbolt v1.3.11
 )
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Group is a set of replicas of one template, named <group>-0 to
+// <group>-(N-1). Groups aren't stored: an instance's Group field makes it
+// a member.
+type Group struct {
+	Name      string   `json:"name"`
+	Project   string   `json:"project,omitempty"`
+	Template  string   `json:"template"`
+	Replicas  int      `json:"replicas"`
+	Running   int      `json:"running"`
+	Instances []string `json:"instances"` // Member names by replica index
+}
+
+// replicaName returns the instance name of replica i of a group
+func replicaName(group string, i int) string {
+	return fmt.Sprintf("%s-%d", group, i)
+}
+
+// groupsOf collects the groups of a set of instances
+func groupsOf(instances map[string]*Instance) map[string]*Group {
+	groups := make(map[string]*Group)
+	var members []*Instance
+	for _, inst := range instances {
+		if inst.Group != "" {
+			members = append(members, inst)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Replica < members[j].Replica })
+
+	for _, inst := range members {
+		g := groups[inst.Group]
+		if g == nil {
+			project, _ := splitProjectKey(inst.Group)
+			g = &Group{Name: inst.Group, Project: project, Template: inst.Template, Instances: []string{}}
+			groups[inst.Group] = g
+		}
+		g.Replicas++
+		if inst.Status == "running" {
+			g.Running++
+		}
+		g.Instances = append(g.Instances, inst.Name)
+	}
+	return groups
+}
+
+// groupMembers returns the replicas of a group
+func (s *State) groupMembers(group string) []*Instance {
+	var members []*Instance
+	for _, inst := range s.Instances {
+		if inst.Group == group {
+			members = append(members, inst)
+		}
+	}
+	return members
+}
+
+// groupTemplate returns the template to scale a group with: the given one,
+// which must match the group's, or else the one its replicas run
+func (s *State) groupTemplate(group, templateID string) (*Template, error) {
+	project, _ := splitProjectKey(group)
+	members := s.groupMembers(group)
+
+	var tmpl *Template
+	if templateID != "" {
+		if tmpl = s.LookupTemplate(project, templateID); tmpl == nil {
+			return nil, fmt.Errorf("template %s not found", templateID)
+		}
+	} else if len(members) > 0 {
+		if tmpl = s.Templates[members[0].Template]; tmpl == nil {
+			return nil, fmt.Errorf("template %s no longer exists", members[0].Template)
+		}
+	} else {
+		return nil, fmt.Errorf("group %s does not exist, a template is needed to create it", group)
+	}
+
+	key := projectKey(tmpl.Project, tmpl.ID)
+	for _, inst := range members {
+		if inst.Template != key {
+			return nil, fmt.Errorf("group %s runs template %s, not %s", group, inst.Template, key)
+		}
+	}
+	return tmpl, nil
+}
+
+// scalePlan returns the replicas that scaling a group to n starts (missing
+// or stopped ones) and removes (the highest indexes first)
+func (s *State) scalePlan(group string, n int) (start, remove []string, err error) {
+	for i := 0; i < n; i++ {
+		name := replicaName(group, i)
+		inst := s.Instances[name]
+		if inst != nil && inst.Group != group {
+			return nil, nil, fmt.Errorf("instance %s already exists and is not part of group %s", name, group)
+		}
+		if inst == nil || inst.Status == "stopped" {
+			start = append(start, name)
+		}
+	}
+
+	members := s.groupMembers(group)
+	sort.Slice(members, func(i, j int) bool { return members[i].Replica > members[j].Replica })
+	for _, inst := range members {
+		if inst.Replica >= n {
+			remove = append(remove, inst.Name)
+		}
+	}
+	return start, remove, nil
+}
+
+// ScaleGroup starts or removes replicas until a group has n of them. New
+// replicas are started like `vp start`, each allocating its own resources,
+// with ${replica} set to their index. Surplus replicas are stopped and
+// deleted from the highest index down.
+func ScaleGroup(state *State, group string, tmpl *Template, n int, vars map[string]string, actor string) error {
+	if n < 0 {
+		return fmt.Errorf("replicas must not be negative")
+	}
+	start, remove, err := state.scalePlan(group, n)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range start {
+		if inst := state.Instances[name]; inst != nil {
+			if err := RestartProcess(state, inst, actor); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			continue
+		}
+
+		i, _ := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+		replicaVars := map[string]string{"replica": strconv.Itoa(i)}
+		for k, v := range vars {
+			replicaVars[k] = v
+		}
+		inst, err := StartProcess(state, tmpl, name, replicaVars, actor)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		inst.Group = group
+		inst.Replica = i
+		state.Save()
+	}
+
+	for _, name := range remove {
+		if err := DeleteInstance(state, state.Instances[name], actor); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if len(start) > 0 || len(remove) > 0 {
+		state.RecordEvent(actor, "scale", group, fmt.Sprintf("%d replicas", n))
+	}
+	return nil
+}
+
+// handleGroups serves GET /api/groups: the groups of the instances the
+// caller may view
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	instances := state.Instances
+	if r.URL.Query().Has("project") {
+		instances = state.ProjectInstances(r.URL.Query().Get("project"))
+	}
+	writeJSON(w, http.StatusOK, groupsOf(visibleInstances(r, instances)))
+}
+
+// handleGroupResource serves GET, PUT (scale) and DELETE /api/groups/{name}
+func handleGroupResource(w http.ResponseWriter, r *http.Request) {
+	name, err := qualifiedKey(r.URL.Query().Get("project"), strings.TrimPrefix(r.URL.Path, "/api/groups/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if name == "" {
+		writeError(w, http.StatusNotFound, "group name required")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		g := groupsOf(visibleInstances(r, state.Instances))[name]
+		if g == nil {
+			writeError(w, http.StatusNotFound, "group %s not found", name)
+			return
+		}
+		writeJSON(w, http.StatusOK, g)
+
+	case "PUT", "DELETE":
+		var req struct {
+			Template string            `json:"template"`
+			Replicas int               `json:"replicas"`
+			Vars     map[string]string `json:"vars"`
+		}
+		if r.Method == "PUT" {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+				return
+			}
+			if req.Replicas < 0 {
+				writeError(w, http.StatusBadRequest, "replicas must not be negative")
+				return
+			}
+		} else if len(state.groupMembers(name)) == 0 {
+			writeError(w, http.StatusNotFound, "group %s not found", name)
+			return
+		}
+
+		// Scaling is starting and deleting the affected replicas
+		start, remove, err := state.scalePlan(name, req.Replicas)
+		if err != nil {
+			writeError(w, http.StatusConflict, "%v", err)
+			return
+		}
+		for _, inst := range start {
+			if !authorize(w, r, VerbStart, "instance", inst) {
+				return
+			}
+		}
+		for _, inst := range remove {
+			if !authorize(w, r, VerbDelete, "instance", inst) {
+				return
+			}
+		}
+
+		var tmpl *Template
+		if len(start) > 0 {
+			if tmpl, err = state.groupTemplate(name, req.Template); err != nil {
+				writeError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			if !authorize(w, r, VerbStart, "template", projectKey(tmpl.Project, tmpl.ID)) {
+				return
+			}
+		}
+		if err := ScaleGroup(state, name, tmpl, req.Replicas, req.Vars, httpActor(r)); err != nil {
+			writeError(w, http.StatusConflict, "%v", err)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		g := groupsOf(state.Instances)[name]
+		if g == nil {
+			g = &Group{Name: name, Instances: []string{}}
+		}
+		writeJSON(w, http.StatusOK, g)
+
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+func handleScale(args []string) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "--") {
+		fmt.Fprintf(os.Stderr, "Usage: vp scale <group> --replicas=N [--template=<id>] [--key=value...]\n")
+		os.Exit(1)
+	}
+	group := cliKey(args[0])
+	vars := parseVars(args[1:])
+	n, err := strconv.Atoi(vars["replicas"])
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --replicas must be a number of replicas\n")
+		os.Exit(1)
+	}
+	templateID := vars["template"]
+	delete(vars, "replicas")
+	delete(vars, "template")
+
+	if err := MatchAndUpdateInstances(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
+	}
+
+	var tmpl *Template
+	if start, _, err := state.scalePlan(group, n); err == nil && len(start) > 0 {
+		tmpl, err = state.groupTemplate(group, templateID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := ScaleGroup(state, group, tmpl, n, vars, cliActor()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	g := groupsOf(state.Instances)[group]
+	if g == nil {
+		g = &Group{Name: group, Instances: []string{}}
+	}
+	printGroup(g)
+}
+
+// printGroup prints a group after scaling
+func printGroup(g *Group) {
+	printObject(g, g.Name, func(bool) {
+		noun := "replicas"
+		if g.Replicas == 1 {
+			noun = "replica"
+		}
+		fmt.Printf("Scaled %s to %d %s (%d running)\n", g.Name, g.Replicas, noun, g.Running)
+		for _, name := range g.Instances {
+			fmt.Printf("  %s\n", name)
+		}
+	})
+}
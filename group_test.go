@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func groupFixture() *State {
+	return &State{Instances: map[string]*Instance{
+		"work-0":  {Name: "work-0", Template: "worker", Status: "running", Group: "work"},
+		"work-1":  {Name: "work-1", Template: "worker", Status: "stopped", Group: "work", Replica: 1},
+		"work-3":  {Name: "work-3", Template: "worker", Status: "running", Group: "work", Replica: 3},
+		"work-2x": {Name: "work-2x", Template: "worker", Status: "running"},
+		"p/db-0":  {Name: "p/db-0", Template: "p/pg", Status: "running", Group: "p/db", Project: "p"},
+		"solo":    {Name: "solo", Template: "worker", Status: "running"},
+		"taken-1": {Name: "taken-1", Template: "worker", Status: "running"},
+		"taken-0": {Name: "taken-0", Template: "worker", Status: "running", Group: "taken"},
+	}}
+}
+
+// TestGroupsOf tests that groups are collected from their replicas
+func TestGroupsOf(t *testing.T) {
+	groups := groupsOf(groupFixture().Instances)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %v", groups)
+	}
+	want := &Group{Name: "work", Template: "worker", Replicas: 3, Running: 2, Instances: []string{"work-0", "work-1", "work-3"}}
+	if !reflect.DeepEqual(groups["work"], want) {
+		t.Errorf("Expected %+v, got %+v", want, groups["work"])
+	}
+	if g := groups["p/db"]; g == nil || g.Project != "p" {
+		t.Errorf("Expected project group p/db, got %+v", g)
+	}
+}
+
+// TestScalePlan tests which replicas scaling starts and removes
+func TestScalePlan(t *testing.T) {
+	s := groupFixture()
+
+	start, remove, err := s.scalePlan("work", 3)
+	if err != nil {
+		t.Fatalf("scalePlan failed: %v", err)
+	}
+	if !reflect.DeepEqual(start, []string{"work-1", "work-2"}) || !reflect.DeepEqual(remove, []string{"work-3"}) {
+		t.Errorf("Expected start [work-1 work-2] and remove [work-3], got %v %v", start, remove)
+	}
+
+	start, remove, _ = s.scalePlan("work", 0)
+	if start != nil || !reflect.DeepEqual(remove, []string{"work-3", "work-1", "work-0"}) {
+		t.Errorf("Expected all replicas removed highest first, got %v %v", start, remove)
+	}
+
+	if _, _, err := s.scalePlan("taken", 2); err == nil {
+		t.Error("Expected error when a replica name belongs to another instance")
+	}
+}
+
+// TestGroupTemplate tests choosing the template to scale with
+func TestGroupTemplate(t *testing.T) {
+	s := groupFixture()
+	s.Templates = map[string]*Template{"worker": {ID: "worker"}, "other": {ID: "other"}}
+
+	if tmpl, err := s.groupTemplate("work", ""); err != nil || tmpl.ID != "worker" {
+		t.Errorf("Expected the replicas' template, got %v, %v", tmpl, err)
+	}
+	if _, err := s.groupTemplate("work", "other"); err == nil {
+		t.Error("Expected error for a different template")
+	}
+	if _, err := s.groupTemplate("new", ""); err == nil {
+		t.Error("Expected error creating a group without a template")
+	}
+	if tmpl, err := s.groupTemplate("new", "other"); err != nil || tmpl.ID != "other" {
+		t.Errorf("Expected template other, got %v, %v", tmpl, err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sample is one point of an instance's resource usage history, taken from
+// its process tree totals
+type Sample struct {
+	Time       int64   `json:"t"`           // Unix seconds
+	CPUPercent float64 `json:"cpu_percent"` // CPU% over the last sample
+	RSS        int64   `json:"rss"`         // Resident bytes
+	PSS        int64   `json:"pss,omitempty"`
+	Threads    int     `json:"threads"`
+	FDs        int     `json:"fds"` // -1 when not readable
+	ReadBytes  int64   `json:"read_bytes"`
+	WriteBytes int64   `json:"write_bytes"`
+	Processes  int     `json:"processes"`
+}
+
+// sampleRing is a fixed-size ring buffer of samples, oldest first
+type sampleRing struct {
+	buf  []Sample
+	next int  // Where the next sample goes
+	full bool // Whether buf has wrapped
+}
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{buf: make([]Sample, size)}
+}
+
+// Add appends a sample, overwriting the oldest once full
+func (r *sampleRing) Add(s Sample) {
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Since returns the samples taken at or after t, oldest first
+func (r *sampleRing) Since(t int64) []Sample {
+	var ordered []Sample
+	if r.full {
+		ordered = append(ordered, r.buf[r.next:]...)
+	}
+	ordered = append(ordered, r.buf[:r.next]...)
+
+	i := sort.Search(len(ordered), func(i int) bool { return ordered[i].Time >= t })
+	return ordered[i:]
+}
+
+// History keeps a bounded usage history per instance in memory, optionally
+// persisted to a file so it survives restarts of vp serve
+type History struct {
+	mu       sync.Mutex
+	interval time.Duration
+	size     int // Samples kept per instance
+	series   map[string]*sampleRing
+	file     string // "" to keep history in memory only
+}
+
+// maxHistorySamples bounds memory use however the interval and retention are set
+const maxHistorySamples = 10000
+
+// NewHistory creates a history sampled every interval and kept for retention
+func NewHistory(interval, retention time.Duration, file string) *History {
+	size := int(retention / interval)
+	if size < 1 {
+		size = 1
+	}
+	if size > maxHistorySamples {
+		size = maxHistorySamples
+	}
+	return &History{interval: interval, size: size, series: make(map[string]*sampleRing), file: file}
+}
+
+// globalHistory is set by vp serve
+var globalHistory *History
+
+// Record adds a sample for an instance
+func (h *History) Record(name string, s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring := h.series[name]
+	if ring == nil {
+		ring = newSampleRing(h.size)
+		h.series[name] = ring
+	}
+	ring.Add(s)
+}
+
+// Range returns an instance's samples from the last d
+func (h *History) Range(name string, d time.Duration) []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring := h.series[name]
+	if ring == nil {
+		return []Sample{}
+	}
+	return ring.Since(time.Now().Add(-d).Unix())
+}
+
+// Sample records the current usage of every running instance and drops the
+// history of deleted ones. Stopped instances keep their history, which is
+// what shows how an instance behaved before it died.
+func (h *History) Sample(s *State) {
+	now := time.Now().Unix()
+
+	s.mu.RLock()
+	samples := make(map[string]Sample)
+	names := make(map[string]bool, len(s.Instances))
+	for name, inst := range s.Instances {
+		names[name] = true
+		if inst.Status != "running" || inst.Totals == nil {
+			continue
+		}
+		t := inst.Totals
+		samples[name] = Sample{
+			Time:       now,
+			CPUPercent: t.CPUPercent,
+			RSS:        t.RSS,
+			PSS:        t.PSS,
+			Threads:    t.Threads,
+			FDs:        t.FDs,
+			ReadBytes:  t.ReadBytes,
+			WriteBytes: t.WriteBytes,
+			Processes:  t.Processes,
+		}
+	}
+	s.mu.RUnlock()
+
+	for name, sample := range samples {
+		h.Record(name, sample)
+	}
+
+	h.mu.Lock()
+	for name := range h.series {
+		if !names[name] {
+			delete(h.series, name)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// Run samples every interval and, when persisting, saves about once a minute
+func (h *History) Run(s *State) {
+	lastSave := time.Now()
+	for {
+		h.Sample(s)
+		if h.file != "" && time.Since(lastSave) >= time.Minute {
+			if err := h.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to save history: %v\n", err)
+			}
+			lastSave = time.Now()
+		}
+		time.Sleep(h.interval)
+	}
+}
+
+// Save writes the history to its file
+func (h *History) Save() error {
+	h.mu.Lock()
+	out := make(map[string][]Sample, len(h.series))
+	for name, ring := range h.series {
+		out[name] = ring.Since(0)
+	}
+	h.mu.Unlock()
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.file), 0755); err != nil {
+		return err
+	}
+	tmp := h.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+// Load reads history saved by an earlier run. A missing file is not an error.
+func (h *History) Load() error {
+	data, err := os.ReadFile(h.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var in map[string][]Sample
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", h.file, err)
+	}
+	for name, samples := range in {
+		for _, s := range samples {
+			h.Record(name, s)
+		}
+	}
+	return nil
+}
+
+// historyFile is where --history-file=true persists history
+func historyFile() string {
+	return filepath.Join(stateDir(), "history.json")
+}
+
+// handleInstanceHistory serves GET /api/instances/{name}/metrics?range=1h
+func handleInstanceHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !authorize(w, r, VerbView, "instance", name) {
+		return
+	}
+	if state.Instances[name] == nil {
+		writeError(w, http.StatusNotFound, "instance %s not found", name)
+		return
+	}
+	if globalHistory == nil {
+		writeError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+
+	rng := time.Hour
+	if v := r.URL.Query().Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid range %q, use a duration like 15m or 1h", v)
+			return
+		}
+		rng = d
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"instance": name,
+		"interval": globalHistory.interval.Seconds(),
+		"samples":  globalHistory.Range(name, rng),
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSampleRing tests that the ring keeps the newest samples in order
+func TestSampleRing(t *testing.T) {
+	r := newSampleRing(3)
+	if got := r.Since(0); len(got) != 0 {
+		t.Fatalf("Expected empty ring, got %v", got)
+	}
+
+	for i := int64(1); i <= 5; i++ {
+		r.Add(Sample{Time: i})
+	}
+	got := r.Since(0)
+	if len(got) != 3 || got[0].Time != 3 || got[2].Time != 5 {
+		t.Errorf("Expected samples 3..5, got %v", got)
+	}
+	if got := r.Since(4); len(got) != 2 || got[0].Time != 4 {
+		t.Errorf("Expected samples 4..5, got %v", got)
+	}
+}
+
+// TestHistorySample tests sampling running instances, keeping history of
+// stopped ones and dropping deleted ones
+func TestHistorySample(t *testing.T) {
+	s := &State{Instances: map[string]*Instance{
+		"web": {Name: "web", Status: "running", Totals: &TreeTotals{Processes: 2, ProcessStats: ProcessStats{RSS: 4096, CPUPercent: 12.5}}},
+		"db":  {Name: "db", Status: "stopped"},
+	}}
+
+	h := NewHistory(time.Second, time.Hour, "")
+	h.Record("gone", Sample{Time: time.Now().Unix()})
+	h.Sample(s)
+
+	got := h.Range("web", time.Minute)
+	if len(got) != 1 || got[0].RSS != 4096 || got[0].CPUPercent != 12.5 || got[0].Processes != 2 {
+		t.Errorf("Unexpected web history: %v", got)
+	}
+	if got := h.Range("db", time.Minute); len(got) != 0 {
+		t.Errorf("Expected no samples for stopped instance, got %v", got)
+	}
+	if got := h.Range("gone", time.Minute); len(got) != 0 {
+		t.Errorf("Expected history of deleted instance to be dropped, got %v", got)
+	}
+
+	// Retention bounds the samples kept per instance
+	if h := NewHistory(time.Minute, time.Hour, ""); h.size != 60 {
+		t.Errorf("Expected 60 samples per instance, got %d", h.size)
+	}
+}
+
+// TestHistoryPersistence tests saving and reloading history
+func TestHistoryPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	now := time.Now().Unix()
+
+	h := NewHistory(time.Second, time.Hour, file)
+	h.Record("web", Sample{Time: now - 10, RSS: 1})
+	h.Record("web", Sample{Time: now, RSS: 2})
+	if err := h.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded := NewHistory(time.Second, time.Hour, file)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	got := loaded.Range("web", time.Hour)
+	if len(got) != 2 || got[1].RSS != 2 {
+		t.Errorf("Expected reloaded samples, got %v", got)
+	}
+	if got := loaded.Range("web", 5*time.Second); len(got) != 1 {
+		t.Errorf("Expected range to limit samples, got %v", got)
+	}
+}
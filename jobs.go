@@ -0,0 +1,699 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kinds of template
+const (
+	KindService = "service" // Runs until stopped (the default)
+	KindJob     = "job"     // Runs to completion, on demand or on a schedule
+)
+
+// Overlap policies decide what happens when a job is due while earlier runs
+// of it are still going
+const (
+	OverlapSkip    = "skip"    // Don't run (the default)
+	OverlapQueue   = "queue"   // Run once the earlier runs have finished
+	OverlapReplace = "replace" // Stop the earlier runs, then run
+)
+
+// maxJobRuns is how many runs of a job are kept, with their logs
+const maxJobRuns = 100
+
+// JobRun is one run of a job. Runs are kept in ~/.vibeprocess/jobs/<job>/
+// as <id>.json next to the <id>.log their output goes to, so the CLI and a
+// running vp serve see each other's runs.
+type JobRun struct {
+	Job      string `json:"job"`               // Template key
+	ID       int    `json:"id"`                // Run number, counting up per job
+	Trigger  string `json:"trigger"`           // manual|schedule
+	Actor    string `json:"actor"`             // Who ran it
+	Status   string `json:"status"`            // queued|running|succeeded|failed|skipped|canceled|unknown
+	Command  string `json:"command,omitempty"` // Final interpolated command
+	PID      int    `json:"pid,omitempty"`
+	Runner   int    `json:"runner,omitempty"` // PID of the vp process that waits for it
+	Queued   int64  `json:"queued"`           // Unix timestamps
+	Started  int64  `json:"started,omitempty"`
+	Finished int64  `json:"finished,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	done chan struct{} // Closed once the run has finished
+}
+
+// validateJob checks the kind, schedule and overlap policy of a template
+func validateJob(tmpl *Template) error {
+	switch tmpl.Kind {
+	case "", KindService:
+		if tmpl.Schedule != "" || tmpl.Overlap != "" {
+			return fmt.Errorf("schedule and overlap only apply to templates of kind %q", KindJob)
+		}
+		return nil
+	case KindJob:
+	default:
+		return fmt.Errorf("unknown kind %q, use %q or %q", tmpl.Kind, KindService, KindJob)
+	}
+
+	if tmpl.Schedule != "" {
+		if _, err := ParseSchedule(tmpl.Schedule); err != nil {
+			return err
+		}
+	}
+	switch tmpl.Overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapReplace:
+		return nil
+	}
+	return fmt.Errorf("unknown overlap policy %q, use skip, queue or replace", tmpl.Overlap)
+}
+
+// jobDir returns the directory holding a job's runs
+func jobDir(job string) string {
+	// Project keys contain '/', which can't be part of a file name
+	return filepath.Join(stateDir(), "jobs", strings.ReplaceAll(job, "/", "__"))
+}
+
+func (run *JobRun) path() string {
+	return filepath.Join(jobDir(run.Job), strconv.Itoa(run.ID)+".json")
+}
+
+// LogPath returns the file a run's stdout and stderr go to
+func (run *JobRun) LogPath() string {
+	return filepath.Join(jobDir(run.Job), strconv.Itoa(run.ID)+".log")
+}
+
+// owner is the owner of the resources a run holds
+func (run *JobRun) owner() string {
+	return run.Job + "#" + strconv.Itoa(run.ID)
+}
+
+// Wait blocks until a run started by this process has finished
+func (run *JobRun) Wait() {
+	<-run.done
+}
+
+// save writes a run's record
+func (run *JobRun) save() error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := run.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, run.path())
+}
+
+// newJobRun records a queued run of a job under the next free number
+func newJobRun(job, trigger, actor string) (*JobRun, error) {
+	if err := os.MkdirAll(jobDir(job), 0755); err != nil {
+		return nil, err
+	}
+	id := 1
+	if ids := jobRunIDs(job); len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+
+	for {
+		run := &JobRun{
+			Job:     job,
+			ID:      id,
+			Trigger: trigger,
+			Actor:   actor,
+			Status:  "queued",
+			Runner:  os.Getpid(),
+			Queued:  time.Now().Unix(),
+			done:    make(chan struct{}),
+		}
+		// Another vp may be recording a run of the same job
+		f, err := os.OpenFile(run.path(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if os.IsExist(err) {
+			id++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return run, run.save()
+	}
+}
+
+// jobRunIDs returns the numbers of a job's recorded runs in order
+func jobRunIDs(job string) []int {
+	entries, _ := os.ReadDir(jobDir(job))
+	var ids []int
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			if id, err := strconv.Atoi(name); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// loadJobRun reads a run's record. A run whose vp exited before recording
+// its result is reported as unknown.
+func loadJobRun(job string, id int) (*JobRun, error) {
+	data, err := os.ReadFile(filepath.Join(jobDir(job), strconv.Itoa(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var run JobRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, err
+	}
+
+	orphaned := (run.Status == "queued" || run.Status == "running") && !IsProcessRunning(run.Runner)
+	if orphaned && (run.Status == "queued" || !IsProcessRunning(run.PID)) {
+		run.Status = "unknown"
+		run.Error = "vp exited before the run finished"
+	}
+	return &run, nil
+}
+
+// JobRuns returns the recorded runs of a job, oldest first
+func JobRuns(job string) []*JobRun {
+	runs := []*JobRun{}
+	for _, id := range jobRunIDs(job) {
+		// Records being created are empty for a moment
+		if run, err := loadJobRun(job, id); err == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// activeJobRuns returns the queued and running runs of a job numbered below id
+func activeJobRuns(job string, id int) []*JobRun {
+	var active []*JobRun
+	for _, run := range JobRuns(job) {
+		if run.ID < id && (run.Status == "queued" || run.Status == "running") {
+			active = append(active, run)
+		}
+	}
+	return active
+}
+
+// pruneJobRuns deletes the oldest finished runs beyond maxJobRuns
+func pruneJobRuns(job string) {
+	runs := JobRuns(job)
+	for _, run := range runs[:max(0, len(runs)-maxJobRuns)] {
+		if run.Status != "queued" && run.Status != "running" {
+			os.Remove(run.path())
+			os.Remove(run.LogPath())
+		}
+	}
+}
+
+// RunJob starts a run of a job template and returns its record; Wait blocks
+// until it has finished. Output goes to the run's log and, if out is not
+// nil, to out as well. While earlier runs are still going, the template's
+// overlap policy decides whether the run is skipped (and recorded as such),
+// waits its turn, or stops them first.
+func RunJob(state *State, tmpl *Template, trigger, actor string, out io.Writer) (*JobRun, error) {
+	if tmpl.Kind != KindJob {
+		return nil, fmt.Errorf("template %s is not a job", tmpl.ID)
+	}
+	job := projectKey(tmpl.Project, tmpl.ID)
+	run, err := newJobRun(job, trigger, actor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record run: %w", err)
+	}
+
+	active := activeJobRuns(job, run.ID)
+	switch tmpl.Overlap {
+	case OverlapQueue:
+		if len(active) > 0 {
+			state.RecordEvent(actor, "job", job, fmt.Sprintf("run %d queued behind run %d", run.ID, active[len(active)-1].ID))
+			go func() {
+				if run.waitTurn() {
+					state.mu.Lock()
+					run.start(state, tmpl, out)
+					state.mu.Unlock()
+				}
+			}()
+			return run, nil
+		}
+	case OverlapReplace:
+		for _, prev := range active {
+			state.RecordEvent(actor, "job", job, fmt.Sprintf("run %d replaced by run %d", prev.ID, run.ID))
+			prev.cancel()
+		}
+	default:
+		if len(active) > 0 {
+			run.Status = "skipped"
+			run.Error = fmt.Sprintf("run %d is still running", active[0].ID)
+			run.Finished = time.Now().Unix()
+			run.save()
+			close(run.done)
+			state.RecordEvent(actor, "job", job, fmt.Sprintf("run %d skipped: %s", run.ID, run.Error))
+			return run, nil
+		}
+	}
+
+	return run, run.start(state, tmpl, out)
+}
+
+// waitTurn waits until the runs before a queued one have finished. It
+// reports false if the run was canceled meanwhile.
+func (run *JobRun) waitTurn() bool {
+	for {
+		if cur, err := loadJobRun(run.Job, run.ID); err == nil && cur.Status == "canceled" {
+			run.Status, run.Finished = cur.Status, cur.Finished
+			close(run.done)
+			return false
+		}
+		if len(activeJobRuns(run.Job, run.ID)) == 0 {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// cancel marks a queued or running run canceled and stops its process. The
+// vp waiting for it keeps the status when it records the exit.
+func (run *JobRun) cancel() {
+	status := run.Status
+	run.Status = "canceled"
+	run.Finished = time.Now().Unix()
+	run.save()
+	if status == "running" && run.PID > 0 {
+		terminate(run.PID)
+	}
+}
+
+// start allocates the resources of a run and launches its command like an
+// instance's, with ${run} set to the run number
+func (run *JobRun) start(state *State, tmpl *Template, out io.Writer) error {
+	owner := run.owner()
+	fail := func(err error) error {
+		state.ReleaseResources(owner, run.Actor)
+		run.Status = "failed"
+		run.Error = err.Error()
+		run.Finished = time.Now().Unix()
+		run.save()
+		close(run.done)
+		state.RecordEvent(run.Actor, "job", run.Job, fmt.Sprintf("run %d failed: %v", run.ID, err))
+		return err
+	}
+
+	vars := map[string]string{"run": strconv.Itoa(run.ID)}
+	for k, v := range tmpl.Vars {
+		vars[k] = v
+	}
+	command, _, err := resolveCommand(state, tmpl.Command, tmpl.Resources, vars, owner, owner, run.Actor)
+	if err != nil {
+		return fail(err)
+	}
+
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return fail(fmt.Errorf("empty command"))
+	}
+	logFile, err := os.OpenFile(run.LogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fail(err)
+	}
+
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Dir = vars["workdir"]
+	cmd.Env = append(os.Environ(), "VP_JOB="+run.Job, "VP_JOB_RUN="+strconv.Itoa(run.ID))
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, envName(k)+"="+v)
+	}
+	for k, v := range tmpl.Env {
+		cmd.Env = append(cmd.Env, k+"="+interpolate(v, vars))
+	}
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if out != nil {
+		both := io.MultiWriter(logFile, out)
+		cmd.Stdout, cmd.Stderr = both, both
+	}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fail(fmt.Errorf("failed to start: %w", err))
+	}
+
+	run.Status = "running"
+	run.Command = command
+	run.PID = cmd.Process.Pid
+	run.Started = time.Now().Unix()
+	run.save()
+	state.Save()
+	state.RecordEvent(run.Actor, "job", run.Job, fmt.Sprintf("run %d started (%s): PID %d: %s", run.ID, run.Trigger, run.PID, command))
+
+	go func() {
+		code, err := exitCode(cmd.Wait())
+		logFile.Close()
+		state.mu.Lock()
+		run.finish(state, code, err)
+		state.mu.Unlock()
+	}()
+	return nil
+}
+
+// finish records how a run ended and frees its resources
+func (run *JobRun) finish(state *State, code int, err error) {
+	run.Finished = time.Now().Unix()
+	switch cur, loadErr := loadJobRun(run.Job, run.ID); {
+	case loadErr == nil && cur.Status == "canceled":
+		run.Status = "canceled"
+	case err != nil:
+		run.Status, run.Error = "failed", err.Error()
+	case code == 0:
+		run.Status = "succeeded"
+	default:
+		run.Status = "failed"
+	}
+	if err == nil {
+		run.ExitCode = &code
+	}
+	run.save()
+
+	state.ReleaseResources(run.owner(), run.Actor)
+	state.Save()
+	state.RecordEvent(run.Actor, "job", run.Job, fmt.Sprintf("run %d %s (exit code %d)", run.ID, run.Status, code))
+	pruneJobRuns(run.Job)
+	close(run.done)
+}
+
+// RunScheduler starts scheduled jobs at the start of every minute their
+// schedule matches. It runs in vp serve; runs missed while that is down are
+// not made up.
+func RunScheduler(state *State) {
+	for {
+		minute := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(minute))
+
+		state.mu.Lock()
+		var due []*Template
+		for _, tmpl := range state.Templates {
+			if tmpl.Kind != KindJob || tmpl.Schedule == "" {
+				continue
+			}
+			if sched, err := ParseSchedule(tmpl.Schedule); err == nil && sched.Matches(minute) {
+				due = append(due, tmpl)
+			}
+		}
+		for _, tmpl := range due {
+			if _, err := RunJob(state, tmpl, "schedule", actorScheduler, nil); err != nil {
+				fmt.Printf("Scheduler: %s: %v\n", projectKey(tmpl.Project, tmpl.ID), err)
+			}
+		}
+		state.mu.Unlock()
+	}
+}
+
+// JobInfo is a job template with its last run and next scheduled time
+type JobInfo struct {
+	Job      string  `json:"job"` // Template key
+	Label    string  `json:"label,omitempty"`
+	Command  string  `json:"command"`
+	Schedule string  `json:"schedule,omitempty"`
+	Overlap  string  `json:"overlap"`
+	Next     int64   `json:"next,omitempty"` // Unix timestamp of the next scheduled run
+	Last     *JobRun `json:"last,omitempty"`
+}
+
+// jobInfo describes a job template
+func jobInfo(tmpl *Template) *JobInfo {
+	info := &JobInfo{
+		Job:      projectKey(tmpl.Project, tmpl.ID),
+		Label:    tmpl.Label,
+		Command:  tmpl.Command,
+		Schedule: tmpl.Schedule,
+		Overlap:  tmpl.Overlap,
+	}
+	if info.Overlap == "" {
+		info.Overlap = OverlapSkip
+	}
+	if sched, err := ParseSchedule(tmpl.Schedule); err == nil {
+		if next := sched.Next(time.Now()); !next.IsZero() {
+			info.Next = next.Unix()
+		}
+	}
+	if runs := JobRuns(info.Job); len(runs) > 0 {
+		info.Last = runs[len(runs)-1]
+	}
+	return info
+}
+
+// jobInfos describes the job templates among templates, sorted by key
+func jobInfos(templates map[string]*Template) []*JobInfo {
+	infos := []*JobInfo{}
+	for _, tmpl := range templates {
+		if tmpl.Kind == KindJob {
+			infos = append(infos, jobInfo(tmpl))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Job < infos[j].Job })
+	return infos
+}
+
+// handleJobs serves GET /api/jobs: the jobs the caller may view
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	templates := state.Templates
+	if r.URL.Query().Has("project") {
+		templates = state.ProjectTemplates(r.URL.Query().Get("project"))
+	}
+	writeJSON(w, http.StatusOK, jobInfos(visibleTemplates(r, templates)))
+}
+
+// jobRunsPath matches the runs routes after /api/jobs/: {job}/runs,
+// {job}/runs/{id} and {job}/runs/{id}/log
+var jobRunsPath = regexp.MustCompile(`^(.+)/runs(?:/(\d+)(/log)?)?$`)
+
+// handleJobResource serves GET /api/jobs/{job}, POST /api/jobs/{job}:run,
+// GET /api/jobs/{job}/runs, /api/jobs/{job}/runs/{id} and
+// /api/jobs/{job}/runs/{id}/log
+func handleJobResource(w http.ResponseWriter, r *http.Request) {
+	path, run := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), ":run")
+	runs := jobRunsPath.FindStringSubmatch(path)
+	if runs != nil && !run {
+		path = runs[1]
+	}
+
+	tmpl := state.LookupTemplate(r.URL.Query().Get("project"), path)
+	if tmpl == nil || tmpl.Kind != KindJob {
+		writeError(w, http.StatusNotFound, "job %s not found", path)
+		return
+	}
+	job := projectKey(tmpl.Project, tmpl.ID)
+
+	if run {
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		if !authorize(w, r, VerbStart, "template", job) {
+			return
+		}
+		started, err := RunJob(state, tmpl, "manual", httpActor(r), nil)
+		if err != nil && started == nil {
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		// A run that failed to start is recorded like any other
+		writeJSON(w, http.StatusAccepted, started)
+		return
+	}
+
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !authorize(w, r, VerbView, "template", job) {
+		return
+	}
+
+	switch {
+	case runs == nil:
+		writeJSON(w, http.StatusOK, jobInfo(tmpl))
+
+	case runs[2] == "":
+		writeJSON(w, http.StatusOK, JobRuns(job))
+
+	default:
+		id, _ := strconv.Atoi(runs[2])
+		found, err := loadJobRun(job, id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "run %d of %s not found", id, job)
+			return
+		}
+		if runs[3] == "" {
+			writeJSON(w, http.StatusOK, found)
+			return
+		}
+		data, _ := os.ReadFile(found.LogPath())
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	}
+}
+
+func handleJob(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp job <list|run|history|logs>\n")
+		os.Exit(1)
+	}
+
+	lookup := func(usage string) *Template {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp job %s\n", usage)
+			os.Exit(1)
+		}
+		tmpl := state.LookupTemplate(currentProject, args[1])
+		if tmpl == nil || tmpl.Kind != KindJob {
+			fmt.Fprintf(os.Stderr, "Job not found: %s\n", args[1])
+			os.Exit(1)
+		}
+		return tmpl
+	}
+
+	switch args[0] {
+	case "list":
+		printJobs(jobInfos(state.ProjectTemplates(currentProject)))
+
+	case "run":
+		tmpl := lookup("run <job>")
+		// Output is shown as it happens unless the result is wanted as data
+		var out io.Writer = os.Stdout
+		if output.Format != "" || output.Tmpl != nil {
+			out = nil
+		}
+		run, err := RunJob(state, tmpl, "manual", cliActor(), out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if run.Status == "queued" {
+			fmt.Fprintf(os.Stderr, "Run %d is queued behind earlier runs\n", run.ID)
+		}
+		run.Wait()
+		printRun(run)
+		if run.ExitCode != nil && *run.ExitCode != 0 {
+			os.Exit(*run.ExitCode)
+		}
+		if run.Status != "succeeded" {
+			os.Exit(1)
+		}
+
+	case "history":
+		tmpl := lookup("history <job> [--limit=N]")
+		runs := JobRuns(projectKey(tmpl.Project, tmpl.ID))
+		limit, _ := strconv.Atoi(parseVars(args[2:])["limit"])
+		printRuns(runs, limit)
+
+	case "logs":
+		tmpl := lookup("logs <job> [run]")
+		job := projectKey(tmpl.Project, tmpl.ID)
+		id := 0
+		if len(args) > 2 {
+			id, _ = strconv.Atoi(args[2])
+		} else if ids := jobRunIDs(job); len(ids) > 0 {
+			id = ids[len(ids)-1]
+		} else {
+			fmt.Fprintf(os.Stderr, "No runs of %s\n", job)
+			os.Exit(1)
+		}
+		run, err := loadJobRun(job, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "No run %d of %s\n", id, job)
+			os.Exit(1)
+		}
+		data, _ := os.ReadFile(run.LogPath())
+		os.Stdout.Write(data)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown job command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// printJobs prints the job list
+func printJobs(infos []*JobInfo) {
+	printList(infos, func(j *JobInfo) string { return j.Job }, func(infos []*JobInfo, wide bool) {
+		fmt.Printf("%-20s %-16s %-8s %-20s %s\n", "JOB", "SCHEDULE", "OVERLAP", "LAST RUN", "NEXT RUN")
+		for _, j := range infos {
+			schedule, last, next := j.Schedule, "-", "-"
+			if schedule == "" {
+				schedule = "-"
+			}
+			if j.Last != nil {
+				last = fmt.Sprintf("#%d %s", j.Last.ID, j.Last.Status)
+			}
+			if j.Next != 0 {
+				next = time.Unix(j.Next, 0).Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-20s %-16s %-8s %-20s %s\n", j.Job, schedule, j.Overlap, last, next)
+			if wide {
+				fmt.Printf("  %s\n", j.Command)
+			}
+		}
+	})
+}
+
+// printRuns prints the last limit runs of a job (all if limit <= 0), newest
+// first
+func printRuns(runs []*JobRun, limit int) {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	printList(runs, func(r *JobRun) string { return r.owner() }, func(runs []*JobRun, wide bool) {
+		fmt.Printf("%-6s %-10s %-5s %-20s %-10s %s\n", "RUN", "STATUS", "EXIT", "STARTED", "DURATION", "TRIGGER")
+		for _, r := range runs {
+			exit, started, duration := "-", "-", "-"
+			if r.ExitCode != nil {
+				exit = strconv.Itoa(*r.ExitCode)
+			}
+			if r.Started != 0 {
+				started = time.Unix(r.Started, 0).Format("2006-01-02 15:04:05")
+				end := r.Finished
+				if end == 0 {
+					end = time.Now().Unix()
+				}
+				duration = (time.Duration(end-r.Started) * time.Second).String()
+			}
+			fmt.Printf("%-6d %-10s %-5s %-20s %-10s %s\n", r.ID, r.Status, exit, started, duration, r.Trigger)
+			if wide && r.Error != "" {
+				fmt.Printf("       %s\n", r.Error)
+			}
+		}
+	})
+}
+
+// printRun prints how a run ended
+func printRun(run *JobRun) {
+	printObject(run, run.owner(), func(bool) {
+		switch {
+		case run.ExitCode != nil:
+			fmt.Printf("Run %d of %s %s (exit code %d)\n", run.ID, run.Job, run.Status, *run.ExitCode)
+		case run.Error != "":
+			fmt.Printf("Run %d of %s %s: %s\n", run.ID, run.Job, run.Status, run.Error)
+		default:
+			fmt.Printf("Run %d of %s %s\n", run.ID, run.Job, run.Status)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// jobTestState returns a state for running jobs with its files in a temp dir
+func jobTestState(t *testing.T) *State {
+	t.Setenv("HOME", t.TempDir())
+	return &State{
+		Instances: map[string]*Instance{},
+		Resources: map[string]*Resource{},
+		Counters:  map[string]int{},
+		Types:     DefaultResourceTypes(),
+		store:     &jsonStore{dir: stateDir()},
+	}
+}
+
+// TestValidateJob tests the checks on job settings
+func TestValidateJob(t *testing.T) {
+	valid := []*Template{
+		{ID: "web"},
+		{ID: "backup", Kind: KindJob},
+		{ID: "warm", Kind: KindJob, Schedule: "*/5 * * * *", Overlap: OverlapQueue},
+	}
+	for _, tmpl := range valid {
+		if err := validateJob(tmpl); err != nil {
+			t.Errorf("validateJob(%+v): %v", tmpl, err)
+		}
+	}
+
+	invalid := []*Template{
+		{ID: "web", Schedule: "@daily"},
+		{ID: "x", Kind: "daemon"},
+		{ID: "x", Kind: KindJob, Schedule: "daily"},
+		{ID: "x", Kind: KindJob, Overlap: "parallel"},
+	}
+	for _, tmpl := range invalid {
+		if err := validateJob(tmpl); err == nil {
+			t.Errorf("Expected error for %+v", tmpl)
+		}
+	}
+}
+
+// TestRunJob tests that runs record their exit code and output
+func TestRunJob(t *testing.T) {
+	s := jobTestState(t)
+
+	ok := &Template{ID: "hello", Kind: KindJob, Command: "echo run ${run} of ${VP}", Vars: map[string]string{"VP": "vp"}}
+	run, err := RunJob(s, ok, "manual", "test", nil)
+	if err != nil {
+		t.Fatalf("RunJob failed: %v", err)
+	}
+	run.Wait()
+	if run.Status != "succeeded" || run.ExitCode == nil || *run.ExitCode != 0 {
+		t.Errorf("Expected success, got %s %v", run.Status, run.ExitCode)
+	}
+
+	fail := &Template{ID: "hello", Kind: KindJob, Command: "ls /nonexistent-vp-test"}
+	run, _ = RunJob(s, fail, "manual", "test", nil)
+	run.Wait()
+	if run.ID != 2 || run.Status != "failed" || run.ExitCode == nil || *run.ExitCode == 0 {
+		t.Errorf("Expected run 2 to fail, got %d %s %v", run.ID, run.Status, run.ExitCode)
+	}
+
+	runs := JobRuns("hello")
+	if len(runs) != 2 || runs[0].Status != "succeeded" {
+		t.Fatalf("Expected 2 recorded runs, got %+v", runs)
+	}
+	data, err := os.ReadFile(runs[0].LogPath())
+	if err != nil || string(data) != "run 1 of vp\n" {
+		t.Errorf("Expected the run's output in its log, got %q, %v", data, err)
+	}
+}
+
+// TestJobOverlap tests the skip, queue and replace policies
+func TestJobOverlap(t *testing.T) {
+	s := jobTestState(t)
+	tmpl := &Template{ID: "slow", Kind: KindJob, Command: "sleep 0.5"}
+
+	first, _ := RunJob(s, tmpl, "manual", "test", nil)
+	skipped, _ := RunJob(s, tmpl, "schedule", "test", nil)
+	if skipped.Status != "skipped" {
+		t.Errorf("Expected the overlapping run to be skipped, got %s", skipped.Status)
+	}
+	first.Wait()
+
+	tmpl.Overlap = OverlapQueue
+	first, _ = RunJob(s, tmpl, "manual", "test", nil)
+	queued, _ := RunJob(s, tmpl, "manual", "test", nil)
+	s.mu.Lock() // Its goroutine starts it with the lock held
+	if queued.Status != "queued" {
+		t.Errorf("Expected the overlapping run to be queued, got %s", queued.Status)
+	}
+	s.mu.Unlock()
+	first.Wait()
+	queued.Wait()
+	if queued.Status != "succeeded" || queued.Started < first.Finished {
+		t.Errorf("Expected the queued run to succeed after the first, got %s", queued.Status)
+	}
+
+	tmpl.Overlap = OverlapReplace
+	tmpl.Command = "sleep 30"
+	first, _ = RunJob(s, tmpl, "manual", "test", nil)
+	tmpl.Command = "true"
+	start := time.Now()
+	replacing, _ := RunJob(s, tmpl, "manual", "test", nil)
+	first.Wait()
+	replacing.Wait()
+	if first.Status != "canceled" || replacing.Status != "succeeded" || time.Since(start) > 10*time.Second {
+		t.Errorf("Expected the earlier run to be replaced, got %s and %s", first.Status, replacing.Status)
+	}
+}
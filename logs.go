@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// InstanceLogPath returns the file an instance's stdout and stderr go to
+func InstanceLogPath(name string) string {
+	// Project keys contain '/', which can't be part of a file name
+	return filepath.Join(stateDir(), "logs", strings.ReplaceAll(name, "/", "__")+".log")
+}
+
+// openInstanceLog opens an instance's log file for appending. The file is
+// handed to the child directly, so output keeps flowing after vp exits.
+func openInstanceLog(name string) (*os.File, error) {
+	path := InstanceLogPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+// TailLog returns up to the last n lines of an instance's log
+func TailLog(name string, n int) ([]string, error) {
+	data, err := os.ReadFile(InstanceLogPath(name))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// logTailer follows instance log files and publishes new lines to the stream
+type logTailer struct {
+	mu      sync.Mutex
+	offsets map[string]int64 // instance -> bytes already published
+}
+
+var globalLogTailer = &logTailer{offsets: make(map[string]int64)}
+
+// Poll publishes complete lines appended to each instance's log since the last poll
+func (t *logTailer) Poll(names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, name := range names {
+		f, err := os.Open(InstanceLogPath(name))
+		if err != nil {
+			continue
+		}
+
+		info, err := f.Stat()
+		offset, seen := t.offsets[name]
+		if err != nil || !seen || info.Size() < offset {
+			// First sight or truncated: start from the current end
+			if err == nil {
+				t.offsets[name] = info.Size()
+			}
+			f.Close()
+			continue
+		}
+
+		f.Seek(offset, io.SeekStart)
+		data, _ := io.ReadAll(f)
+		f.Close()
+
+		// Only publish complete lines; the rest is picked up next poll
+		end := bytes.LastIndexByte(data, '\n')
+		if end < 0 {
+			continue
+		}
+		for _, line := range strings.Split(string(data[:end]), "\n") {
+			streamBroker.Publish(&StreamMessage{Kind: "log", Instance: name, Data: line})
+		}
+		t.offsets[name] = offset + int64(end) + 1
+	}
+}
+
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("instance")
+	if !authorize(w, r, VerbView, "instance", name) {
+		return
+	}
+	if state.Instances[name] == nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	n := 200
+	if lines := r.URL.Query().Get("lines"); lines != "" {
+		n, _ = strconv.Atoi(lines)
+	}
+
+	lines, err := TailLog(name, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(lines)
+}
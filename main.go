@@ -4,22 +4,50 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var state *State
 
 func main() {
-	state = LoadState()
+	// The tty host outlives the vp that started it and must not touch state
+	if len(os.Args) > 1 && os.Args[1] == "tty-host" {
+		runTTYHost(os.Args[2:])
+		return
+	}
+
+	var err error
+	state, err = LoadState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	defer state.Save()
 
-	if len(os.Args) < 2 {
-		listInstances()
+	// -o may appear anywhere; --output, --filter and --format up to the first argument after the subcommand
+	var rest []string
+	output, rest, err = parseOutputFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	currentProject, rest = parseProjectFlag(rest)
+
+	if len(rest) < 1 {
+		listInstances(nil)
 		return
 	}
 
-	cmd := os.Args[1]
-	args := os.Args[2:]
+	cmd := rest[0]
+	args := rest[1:]
+
+	if daemonSocket() != "" && runOnDaemon(cmd, args) {
+		return
+	}
 
 	switch cmd {
 	case "start":
@@ -31,7 +59,7 @@ func main() {
 	case "delete":
 		handleDelete(args)
 	case "ps":
-		listInstances()
+		listInstances(args)
 	case "serve":
 		handleServe(args)
 	case "template":
@@ -42,11 +70,38 @@ func main() {
 		handleDiscoverCLI(args)
 	case "discover-port":
 		handleDiscoverPortCLI(args)
+	case "adopt":
+		handleAdoptCLI(args)
 	case "inspect":
 		handleInspect(args)
+	case "project":
+		handleProject(args)
+	case "events":
+		handleEvents(args)
+	case "token":
+		handleToken(args)
+	case "role":
+		handleRole(args)
+	case "tree":
+		handleTree(args)
+	case "top":
+		handleTop(args)
+	case "attach":
+		handleAttach(args)
+	case "exec":
+		handleExec(args)
+	case "scale":
+		handleScale(args)
+	case "job":
+		handleJob(args)
+	case "signal":
+		handleSignal(args)
+	case "reload":
+		handleReload(args)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
-		fmt.Fprintf(os.Stderr, "Commands: start, stop, restart, delete, ps, serve, template, resource-type, discover, discover-port, inspect\n")
+		fmt.Fprintf(os.Stderr, "Usage: vp [-p project] <command>\n")
+		fmt.Fprintf(os.Stderr, "Commands: start, stop, restart, delete, ps, serve, template, resource-type, discover, discover-port, adopt, inspect, tree, top, attach, exec, signal, reload, scale, job, project, events, token, role\n")
 		os.Exit(1)
 	}
 }
@@ -63,31 +118,33 @@ func handleStart(args []string) {
 	}
 
 	templateID := args[0]
-	name := args[1]
+	name := cliKey(args[1])
 	vars := parseVars(args[2:])
 
-	template := state.Templates[templateID]
+	template := state.LookupTemplate(currentProject, templateID)
 	if template == nil {
 		fmt.Fprintf(os.Stderr, "Template not found: %s\n", templateID)
 		fmt.Fprintf(os.Stderr, "Available templates:\n")
-		for id, tmpl := range state.Templates {
+		for id, tmpl := range state.ProjectTemplates(currentProject) {
 			fmt.Fprintf(os.Stderr, "  %s - %s\n", id, tmpl.Label)
 		}
 		os.Exit(1)
 	}
 
-	inst, err := StartProcess(state, template, name, vars)
+	inst, err := StartProcess(state, template, name, vars, cliActor())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Started %s (PID %d)\n", inst.Name, inst.PID)
-	fmt.Printf("Command: %s\n", inst.Command)
-	fmt.Printf("Resources:\n")
-	for k, v := range inst.Resources {
-		fmt.Printf("  %s = %s\n", k, v)
-	}
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Started %s (PID %d)\n", inst.Name, inst.PID)
+		fmt.Printf("Command: %s\n", inst.Command)
+		fmt.Printf("Resources:\n")
+		for k, v := range inst.Resources {
+			fmt.Printf("  %s = %s\n", k, v)
+		}
+	})
 }
 
 func handleStop(args []string) {
@@ -101,22 +158,24 @@ func handleStop(args []string) {
 		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
 	}
 
-	name := args[0]
+	name := cliKey(args[0])
 	inst := state.Instances[name]
 	if inst == nil {
 		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
 		os.Exit(1)
 	}
 
-	if err := StopProcess(state, inst); err != nil {
+	if err := StopProcess(state, inst, cliActor()); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	state.ReleaseResources(name)
+	state.ReleaseResources(name, cliActor())
 	state.Save()
 
-	fmt.Printf("Stopped %s\n", name)
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Stopped %s\n", name)
+	})
 }
 
 func handleDelete(args []string) {
@@ -130,31 +189,32 @@ func handleDelete(args []string) {
 		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
 	}
 
-	name := args[0]
+	name := cliKey(args[0])
 	inst := state.Instances[name]
 	if inst == nil {
 		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
 		os.Exit(1)
 	}
 
-	// Stop the process if it's running
-	if inst.Status == "running" {
-		if err := StopProcess(state, inst); err != nil {
-			fmt.Fprintf(os.Stderr, "Error stopping process: %v\n", err)
-			os.Exit(1)
-		}
+	if err := DeleteInstance(state, inst, cliActor()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping process: %v\n", err)
+		os.Exit(1)
 	}
 
-	state.ReleaseResources(name)
-	delete(state.Instances, name)
-	state.Save()
-
-	fmt.Printf("Deleted %s\n", name)
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Deleted %s\n", name)
+	})
 }
 
 func handleRestart(args []string) {
 	if len(args) < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: vp restart <name>\n")
+		fmt.Fprintf(os.Stderr, "Usage: vp restart <name> [--zero-downtime] [--timeout=30s]\n")
+		os.Exit(1)
+	}
+	flags := parseRestartFlags(args[1:])
+	timeout, err := flags.timeout()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
@@ -163,30 +223,89 @@ func handleRestart(args []string) {
 		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
 	}
 
-	name := args[0]
+	name := cliKey(args[0])
 	inst := state.Instances[name]
 	if inst == nil {
 		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
 		os.Exit(1)
 	}
 
-	if err := RestartProcess(state, inst); err != nil {
+	if flags.ZeroDowntime {
+		state.mu.Lock() // RollingRestart lets go of it while it waits
+		err = RollingRestart(state, inst, timeout, cliActor())
+		state.mu.Unlock()
+	} else {
+		err = RestartProcess(state, inst, cliActor())
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Restarted %s (PID %d)\n", inst.Name, inst.PID)
-	fmt.Printf("Command: %s\n", inst.Command)
-	fmt.Printf("Resources:\n")
-	for k, v := range inst.Resources {
-		fmt.Printf("  %s = %s\n", k, v)
-	}
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Restarted %s (PID %d)\n", inst.Name, inst.PID)
+		fmt.Printf("Command: %s\n", inst.Command)
+		fmt.Printf("Resources:\n")
+		for k, v := range inst.Resources {
+			fmt.Printf("  %s = %s\n", k, v)
+		}
+	})
 }
 
 func handleServe(args []string) {
-	port := "8080"
-	if len(args) > 0 {
-		port = args[0]
+	vars := parseVars(args)
+
+	// Bind to localhost unless --listen says otherwise; a bare port is kept
+	// for compatibility
+	opts := ServeOptions{Listen: "127.0.0.1:8080"}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		opts.Listen = "127.0.0.1:" + args[0]
+	}
+	if vars["listen"] != "" {
+		opts.Listen = vars["listen"]
+	}
+	if socket := vars["socket"]; socket == "true" {
+		opts.Socket = filepath.Join(stateDir(), "vp.sock")
+	} else if socket != "" {
+		opts.Socket = socket
+	}
+
+	if vars["hosts"] != "" {
+		opts.Hosts = strings.Split(vars["hosts"], ",")
+	}
+
+	opts.TLSCert, opts.TLSKey, opts.ClientCA = vars["tls-cert"], vars["tls-key"], vars["client-ca"]
+	if vars["self-signed"] == "true" {
+		cert, key, ca, err := EnsureSelfSigned(serverNames(opts.Listen, opts.Hosts))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating self-signed certificate: %v\n", err)
+			os.Exit(1)
+		}
+		opts.TLSCert, opts.TLSKey = cert, key
+		fmt.Printf("Using self-signed certificate; clients should trust %s\n", ca)
+	}
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		fmt.Fprintf(os.Stderr, "--tls-cert and --tls-key must be given together\n")
+		os.Exit(1)
+	}
+	if opts.ClientCA != "" && opts.TLSCert == "" {
+		fmt.Fprintf(os.Stderr, "--client-ca requires TLS (--tls-cert/--tls-key or --self-signed)\n")
+		os.Exit(1)
+	}
+
+	// Client certificates authenticate callers just like tokens do
+	if !isLoopback(opts.Listen) && len(state.Tokens) == 0 && opts.ClientCA == "" && vars["insecure"] != "true" {
+		fmt.Fprintf(os.Stderr, "Refusing to listen on %s without API tokens.\n", opts.Listen)
+		fmt.Fprintf(os.Stderr, "Create one with 'vp token create <name>', use --client-ca, or pass --insecure.\n")
+		os.Exit(1)
+	}
+
+	// Reconcile interval for the live stream (--interval=seconds)
+	interval := 2 * time.Second
+	if v := vars["interval"]; v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			interval = time.Duration(secs * float64(time.Second))
+		}
 	}
 
 	// Run discovery on startup to match existing processes with instances
@@ -200,8 +319,52 @@ func handleServe(args []string) {
 		fmt.Fprintf(os.Stderr, "Warning: failed to start config watcher: %v\n", err)
 	}
 
-	fmt.Printf("Starting web UI on http://localhost:%s\n", port)
-	if err := ServeHTTP(":" + port); err != nil {
+	// Refresh instances and tail logs in the background for /api/stream
+	go RunReconciler(interval)
+
+	// Start jobs whose schedule is due
+	go RunScheduler(state)
+
+	// Restart or reload instances whose watched files change
+	go RunWatches(state, interval)
+
+	// Usage history for /api/instances/{name}/metrics (--history-interval=seconds,
+	// --history-retention=duration, --history-file[=path] to keep it across restarts)
+	historyInterval, retention := 10*time.Second, 6*time.Hour
+	if v := vars["history-interval"]; v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			historyInterval = time.Duration(secs * float64(time.Second))
+		}
+	}
+	if v := vars["history-retention"]; v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			retention = d
+		}
+	}
+	file := vars["history-file"]
+	if file == "true" {
+		file = historyFile()
+	}
+	globalHistory = NewHistory(historyInterval, retention, file)
+	if file != "" {
+		if err := globalHistory.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	go globalHistory.Run(state)
+
+	scheme := "http"
+	if opts.TLSCert != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Starting web UI on %s://%s\n", scheme, opts.Listen)
+	if opts.Socket != "" {
+		fmt.Printf("Listening on unix socket %s\n", opts.Socket)
+	}
+	if len(state.Tokens) == 0 && opts.ClientCA == "" {
+		fmt.Println("Warning: no API tokens configured, the API is unauthenticated")
+	}
+	if err := ServeHTTP(opts); err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
 		os.Exit(1)
 	}
@@ -215,9 +378,26 @@ func handleTemplate(args []string) {
 
 	switch args[0] {
 	case "list":
-		for id, tmpl := range state.Templates {
-			fmt.Printf("%-20s %s\n", id, tmpl.Label)
+		templates := state.ProjectTemplates(currentProject)
+		ids := make([]string, 0, len(templates))
+		for id := range templates {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		list := make([]*Template, len(ids))
+		for i, id := range ids {
+			list[i] = templates[id]
 		}
+
+		printList(list, func(t *Template) string { return projectKey(t.Project, t.ID) }, func(list []*Template, wide bool) {
+			for _, tmpl := range list {
+				if wide {
+					fmt.Printf("%-20s %-30s %s\n", projectKey(tmpl.Project, tmpl.ID), tmpl.Label, tmpl.Command)
+				} else {
+					fmt.Printf("%-20s %s\n", projectKey(tmpl.Project, tmpl.ID), tmpl.Label)
+				}
+			}
+		})
 	case "add":
 		if len(args) < 2 {
 			fmt.Fprintf(os.Stderr, "Usage: vp template add <file.json>\n")
@@ -244,9 +424,25 @@ func handleResourceType(args []string) {
 
 	switch args[0] {
 	case "list":
-		for name, rt := range state.Types {
-			fmt.Printf("%-15s counter=%-5v check=%s\n", name, rt.Counter, rt.Check)
+		names := make([]string, 0, len(state.Types))
+		for name := range state.Types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]*ResourceType, len(names))
+		for i, name := range names {
+			list[i] = state.Types[name]
 		}
+
+		printList(list, func(rt *ResourceType) string { return rt.Name }, func(list []*ResourceType, wide bool) {
+			for _, rt := range list {
+				if wide && rt.Counter {
+					fmt.Printf("%-15s counter=%-5v range=%d-%-11d check=%s\n", rt.Name, rt.Counter, rt.Start, rt.End, rt.Check)
+				} else {
+					fmt.Printf("%-15s counter=%-5v check=%s\n", rt.Name, rt.Counter, rt.Check)
+				}
+			}
+		})
 	case "add":
 		if len(args) < 2 {
 			fmt.Fprintf(os.Stderr, "Usage: vp resource-type add <name> --check=<cmd> [--counter] [--start=N] [--end=N]\n")
@@ -259,6 +455,45 @@ func handleResourceType(args []string) {
 	}
 }
 
+// discoverTemplate prints a template generated from a running process, or
+// saves it with --save
+func discoverTemplate(pid int, vars map[string]string) {
+	tmpl, notes, err := TemplateFromProcess(pid, vars["id"])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error discovering process: %v\n", err)
+		os.Exit(1)
+	}
+	for _, note := range notes {
+		fmt.Fprintf(os.Stderr, "Note: %s\n", note)
+	}
+
+	if vars["save"] != "true" {
+		printObject(tmpl, tmpl.ID, func(bool) {
+			data, _ := json.MarshalIndent(tmpl, "", "  ")
+			fmt.Println(string(data))
+		})
+		return
+	}
+
+	tmpl.Project = currentProject
+	if err := validateTemplate(tmpl); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	key := projectKey(tmpl.Project, tmpl.ID)
+	if state.Templates[key] != nil {
+		fmt.Fprintf(os.Stderr, "Error: template %s already exists, pick another with --id\n", key)
+		os.Exit(1)
+	}
+	state.Templates[key] = tmpl
+	state.Save()
+	state.RecordEvent(cliActor(), "template", "", "saved "+key)
+
+	printObject(tmpl, key, func(bool) {
+		fmt.Printf("Added template: %s\n", key)
+	})
+}
+
 func addTemplate(filename string) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -272,25 +507,36 @@ func addTemplate(filename string) {
 		os.Exit(1)
 	}
 
-	state.Templates[tmpl.ID] = &tmpl
+	tmpl.Project = currentProject
+	if err := validateTemplate(&tmpl); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	state.Templates[projectKey(tmpl.Project, tmpl.ID)] = &tmpl
 	state.Save()
+	state.RecordEvent(cliActor(), "template", "", "saved "+projectKey(tmpl.Project, tmpl.ID))
 
-	fmt.Printf("Added template: %s\n", tmpl.ID)
+	printObject(&tmpl, projectKey(tmpl.Project, tmpl.ID), func(bool) {
+		fmt.Printf("Added template: %s\n", projectKey(tmpl.Project, tmpl.ID))
+	})
 }
 
 func showTemplate(id string) {
-	tmpl := state.Templates[id]
+	tmpl := state.LookupTemplate(currentProject, id)
 	if tmpl == nil {
 		fmt.Fprintf(os.Stderr, "Template not found: %s\n", id)
 		os.Exit(1)
 	}
 
-	data, err := json.MarshalIndent(tmpl, "", "  ")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error formatting template: %v\n", err)
-		os.Exit(1)
-	}
-	fmt.Println(string(data))
+	// The template's JSON is its human-readable form too
+	printObject(tmpl, projectKey(tmpl.Project, tmpl.ID), func(bool) {
+		data, err := json.MarshalIndent(tmpl, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error formatting template: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	})
 }
 
 func addResourceType(name string, args []string) {
@@ -313,35 +559,126 @@ func addResourceType(name string, args []string) {
 
 	state.Types[name] = rt
 	state.Save()
+	state.RecordEvent(cliActor(), "resource-type", "", "saved "+name)
 
-	fmt.Printf("Added resource type: %s\n", name)
+	printObject(rt, name, func(bool) {
+		fmt.Printf("Added resource type: %s\n", name)
+	})
 }
 
-func listInstances() {
+func listInstances(args []string) {
 	// Run discovery to match existing processes with stopped instances
 	if err := MatchAndUpdateInstances(state); err != nil {
 		// Don't fail on discovery errors, just warn
 		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
 	}
 
-	if len(state.Instances) == 0 {
-		fmt.Println("No instances running")
-		return
+	// Only show the current project unless --all is given
+	instances := state.ProjectInstances(currentProject)
+	if parseVars(args)["all"] == "true" {
+		instances = state.Instances
 	}
+	printInstances(instances)
+}
 
-	fmt.Printf("%-20s %-10s %-8s %-12s %-40s %s\n", "NAME", "STATUS", "PID", "CPU TIME", "COMMAND", "RESOURCES")
-	for name, inst := range state.Instances {
-		resources := ""
-		for k, v := range inst.Resources {
-			resources += fmt.Sprintf("%s=%s ", k, v)
+// printInstances prints the instances sorted by name, in the format chosen
+// with --output
+func printInstances(instances map[string]*Instance) {
+	keys := make([]string, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*Instance, len(keys))
+	for i, key := range keys {
+		list[i] = instances[key]
+	}
+
+	printList(list, displayName, func(list []*Instance, wide bool) {
+		if len(list) == 0 {
+			fmt.Println("No instances running")
+			return
+		}
+
+		if wide {
+			fmt.Printf("%-20s %-10s %-8s %-6s %-8s %-4s %-5s %-13s %-12s %-15s %-15s %-15s %-30s %-50s %s\n",
+				"NAME", "STATUS", "PID", "CPU%", "MEM", "THR", "FDS", "IO R/W", "CPU TIME", "TEMPLATE", "GROUP", "PORTS", "CWD", "COMMAND", "RESOURCES")
+		} else {
+			fmt.Printf("%-20s %-10s %-8s %-6s %-8s %-4s %-5s %-13s %-12s %-40s %s\n",
+				"NAME", "STATUS", "PID", "CPU%", "MEM", "THR", "FDS", "IO R/W", "CPU TIME", "COMMAND", "RESOURCES")
 		}
+		for _, inst := range list {
+			resources := ""
+			for _, k := range sortedKeys(inst.Resources) {
+				resources += fmt.Sprintf("%s=%s ", k, inst.Resources[k])
+			}
+
+			// Format CPU time
+			cpuTimeStr := formatCPUTime(inst.CPUTime)
 
-		// Format CPU time
-		cpuTimeStr := formatCPUTime(inst.CPUTime)
+			// Resource usage is only known while running; totals cover child processes
+			cpu, mem, threads, fds, io := "-", "-", "-", "-", "-"
+			s := inst.Stats
+			if inst.Totals != nil {
+				s = &inst.Totals.ProcessStats
+			}
+			if s != nil {
+				cpu = fmt.Sprintf("%.1f", s.CPUPercent)
+				mem = formatBytes(s.RSS)
+				threads = strconv.Itoa(s.Threads)
+				if s.FDs >= 0 {
+					fds = strconv.Itoa(s.FDs)
+				}
+				io = formatBytes(s.ReadBytes) + "/" + formatBytes(s.WriteBytes)
+			}
+
+			if wide {
+				group := "-"
+				if inst.Group != "" {
+					group = inst.Group
+				}
+				fmt.Printf("%-20s %-10s %-8d %-6s %-8s %-4s %-5s %-13s %-12s %-15s %-15s %-15s %-30s %-50s %s\n",
+					displayName(inst), inst.Status, inst.PID, cpu, mem, threads, fds, io, cpuTimeStr, inst.Template, group, topPorts(inst), inst.Cwd, inst.Command, resources)
+				continue
+			}
+			fmt.Printf("%-20s %-10s %-8d %-6s %-8s %-4s %-5s %-13s %-12s %-40s %s\n",
+				displayName(inst), inst.Status, inst.PID, cpu, mem, threads, fds, io, cpuTimeStr, truncate(inst.Command, 40), resources)
+		}
+	})
+}
 
-		fmt.Printf("%-20s %-10s %-8d %-12s %-40s %s\n",
-			name, inst.Status, inst.PID, cpuTimeStr, truncate(inst.Command, 40), resources)
+// displayName is an instance's name as the CLI shows it: without the
+// project prefix when it is in the current project
+func displayName(inst *Instance) string {
+	if inst.Project == currentProject {
+		_, name := splitProjectKey(inst.Name)
+		return name
 	}
+	return inst.Name
+}
+
+// sortedKeys returns a string map's keys in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatBytes formats a byte count with a binary unit (1.5M)
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func formatCPUTime(seconds float64) string {
@@ -385,9 +722,12 @@ func truncate(s string, n int) string {
 }
 
 func handleDiscoverCLI(args []string) {
-	if len(args) < 2 {
+	asTemplate := len(args) > 0 && parseVars(args[1:])["as-template"] == "true"
+	if len(args) < 2 || strings.HasPrefix(args[1], "--") && !asTemplate {
 		fmt.Fprintf(os.Stderr, "Usage: vp discover <pid> <name>\n")
-		fmt.Fprintf(os.Stderr, "  Discovers a process by PID and imports it as a managed instance\n")
+		fmt.Fprintf(os.Stderr, "       vp discover <pid> --as-template [--id=<id>] [--save]\n")
+		fmt.Fprintf(os.Stderr, "  Discovers a process by PID and imports it as a managed instance,\n")
+		fmt.Fprintf(os.Stderr, "  or generates a template that launches it the way it was started\n")
 		os.Exit(1)
 	}
 
@@ -396,18 +736,57 @@ func handleDiscoverCLI(args []string) {
 		fmt.Fprintf(os.Stderr, "Invalid PID: %s\n", args[0])
 		os.Exit(1)
 	}
+	if asTemplate {
+		discoverTemplate(pid, parseVars(args[1:]))
+		return
+	}
 
-	name := args[1]
+	name := cliKey(args[1])
 
-	inst, err := DiscoverAndImportProcess(state, pid, name)
+	inst, err := DiscoverAndImportProcess(state, pid, name, cliActor())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error discovering process: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Discovered and imported process: %s\n", inst.Name)
-	fmt.Printf("  PID:     %d\n", inst.PID)
-	fmt.Printf("  Command: %s\n", inst.Command)
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Discovered and imported process: %s\n", inst.Name)
+		fmt.Printf("  PID:     %d\n", inst.PID)
+		fmt.Printf("  Command: %s\n", inst.Command)
+	})
+}
+
+func handleAdoptCLI(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: vp adopt <pid> <name> [--restart]\n")
+		fmt.Fprintf(os.Stderr, "  Takes over a running process so vp can stop and restart it;\n")
+		fmt.Fprintf(os.Stderr, "  --restart relaunches it under vp right away to capture its logs\n")
+		os.Exit(1)
+	}
+
+	var pid int
+	if _, err := fmt.Sscanf(args[0], "%d", &pid); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid PID: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	name := cliKey(args[1])
+	restart := parseVars(args[2:])["restart"] == "true"
+
+	inst, err := AdoptProcess(state, pid, name, restart, cliActor())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adopting process: %v\n", err)
+		os.Exit(1)
+	}
+
+	printObject(inst, displayName(inst), func(bool) {
+		if restart {
+			fmt.Printf("Adopted and restarted %s (PID %d)\n", inst.Name, inst.PID)
+		} else {
+			fmt.Printf("Adopted %s (PID %d)\n", inst.Name, inst.PID)
+		}
+		fmt.Printf("  Command: %s\n", inst.Command)
+	})
 }
 
 func handleDiscoverPortCLI(args []string) {
@@ -423,17 +802,19 @@ func handleDiscoverPortCLI(args []string) {
 		os.Exit(1)
 	}
 
-	name := args[1]
+	name := cliKey(args[1])
 
-	inst, err := DiscoverAndImportProcessOnPort(state, port, name)
+	inst, err := DiscoverAndImportProcessOnPort(state, port, name, cliActor())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error discovering process: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Discovered and imported process on port %d: %s\n", port, inst.Name)
-	fmt.Printf("  PID:     %d\n", inst.PID)
-	fmt.Printf("  Command: %s\n", inst.Command)
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Discovered and imported process on port %d: %s\n", port, inst.Name)
+		fmt.Printf("  PID:     %d\n", inst.PID)
+		fmt.Printf("  Command: %s\n", inst.Command)
+	})
 }
 
 func handleInspect(args []string) {
@@ -448,34 +829,89 @@ func handleInspect(args []string) {
 		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
 	}
 
-	name := args[0]
+	name := cliKey(args[0])
 	inst := state.Instances[name]
 	if inst == nil {
 		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
 		os.Exit(1)
 	}
 
-	// Pretty print the instance details
-	data, err := json.MarshalIndent(inst, "", "  ")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error formatting instance: %v\n", err)
+	// The full instance is available with -o json or -o yaml
+	printObject(inst, displayName(inst), func(wide bool) {
+		fmt.Printf("Name:     %s\n", inst.Name)
+		fmt.Printf("Status:   %s\n", inst.Status)
+		fmt.Printf("PID:      %d\n", inst.PID)
+		fmt.Printf("Template: %s\n", inst.Template)
+		fmt.Printf("Command:  %s\n", inst.Command)
+		fmt.Printf("Cwd:      %s\n", inst.Cwd)
+		fmt.Printf("Managed:  %v\n", inst.Managed)
+		if wide {
+			fmt.Printf("Started:  %s\n", time.Unix(inst.Started, 0).Format("2006-01-02 15:04:05"))
+			fmt.Printf("Restarts: %d\n", inst.Restarts)
+			fmt.Printf("CPU time: %s\n", formatCPUTime(inst.CPUTime))
+			if t := inst.Totals; t != nil {
+				fmt.Printf("Usage:    %d processes, cpu %.1f%%, rss %s, threads %d, ports %s\n",
+					t.Processes, t.CPUPercent, formatBytes(t.RSS), t.Threads, topPorts(inst))
+			}
+		}
+
+		if len(inst.Resources) > 0 {
+			fmt.Printf("\n--- Resources ---\n")
+			for _, k := range sortedKeys(inst.Resources) {
+				fmt.Printf("  %s = %s\n", k, inst.Resources[k])
+			}
+		}
+	})
+}
+
+func handleProject(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp project <list|add>\n")
 		os.Exit(1)
 	}
-	fmt.Println(string(data))
 
-	// Additional formatted output for better readability
-	fmt.Printf("\n--- Summary ---\n")
-	fmt.Printf("Name:     %s\n", inst.Name)
-	fmt.Printf("Status:   %s\n", inst.Status)
-	fmt.Printf("PID:      %d\n", inst.PID)
-	fmt.Printf("Template: %s\n", inst.Template)
-	fmt.Printf("Command:  %s\n", inst.Command)
-	fmt.Printf("Managed:  %v\n", inst.Managed)
+	switch args[0] {
+	case "list":
+		type projectRow struct {
+			Name      string `json:"name"`
+			Instances int    `json:"instances"`
+			Isolated  bool   `json:"isolated"`
+		}
+		var rows []projectRow
+		for _, name := range state.ProjectNames() {
+			rows = append(rows, projectRow{name, len(state.ProjectInstances(name)), state.isolated(name)})
+		}
 
-	if len(inst.Resources) > 0 {
-		fmt.Printf("\n--- Resources ---\n")
-		for k, v := range inst.Resources {
-			fmt.Printf("  %s = %s\n", k, v)
+		printList(rows, func(p projectRow) string { return p.Name }, func(rows []projectRow, wide bool) {
+			for _, p := range rows {
+				label := p.Name
+				if label == "" {
+					label = "(default)"
+				}
+				fmt.Printf("%-20s instances=%-4d isolated=%v\n", label, p.Instances, p.Isolated)
+			}
+		})
+	case "add":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp project add <name> [--isolated]\n")
+			os.Exit(1)
 		}
+		name := args[1]
+		if strings.Contains(name, "/") {
+			fmt.Fprintf(os.Stderr, "Project name must not contain '/': %s\n", name)
+			os.Exit(1)
+		}
+		project := &Project{
+			Name:     name,
+			Isolated: parseVars(args[2:])["isolated"] == "true",
+		}
+		state.Projects[name] = project
+		state.Save()
+		printObject(project, name, func(bool) {
+			fmt.Printf("Added project: %s\n", name)
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown project command: %s\n", args[0])
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How MatchRules.Command compares a process's command with an instance's
+const (
+	MatchName = "name" // argv[0] has the same basename
+	MatchExe  = "exe"  // Runs the same executable file
+	MatchArgv = "argv" // Has exactly the same arguments
+)
+
+// MatchRules say how vp recognises a running process as a stopped
+// instance's, such as after vp itself restarted. A process must pass every
+// rule that is set; all but Command and Ports may refer to ${var}.
+type MatchRules struct {
+	Command  string            `json:"command,omitempty"`  // name (default), exe or argv
+	Exe      string            `json:"exe,omitempty"`      // Path of the executable it runs
+	Argv     string            `json:"argv,omitempty"`     // Regexp its arguments, joined with spaces, must match
+	Cwd      string            `json:"cwd,omitempty"`      // Its working directory
+	Env      map[string]string `json:"env,omitempty"`      // Environment variables it has ("" = any value)
+	Ports    []string          `json:"ports,omitempty"`    // Resources whose ports it listens on (default tcpport and port)
+	Pidfile  string            `json:"pidfile,omitempty"`  // File its PID is written to
+	Unmarked bool              `json:"unmarked,omitempty"` // Also take processes without the VP_INSTANCE marker when vp launched the instance
+}
+
+// defaultMatchPorts are the port resources a process must listen on when a
+// template's match rules don't list them
+var defaultMatchPorts = []string{"tcpport", "port"}
+
+// validateMatch checks the match rules of a template
+func validateMatch(tmpl *Template) error {
+	rules := tmpl.Match
+	if rules == nil {
+		return nil
+	}
+	switch rules.Command {
+	case "", MatchName, MatchExe, MatchArgv:
+	default:
+		return fmt.Errorf("unknown match command %q, use name, exe or argv", rules.Command)
+	}
+	if _, err := regexp.Compile(rules.Argv); err != nil {
+		return fmt.Errorf("invalid match argv: %w", err)
+	}
+	return nil
+}
+
+// commandArgv returns the arguments an instance runs: its exact argv when
+// known, otherwise its command split on spaces
+func (inst *Instance) commandArgv() []string {
+	if len(inst.Argv) > 0 {
+		return inst.Argv
+	}
+	return strings.Fields(inst.Command)
+}
+
+// instanceMatcher recognises an instance's process by its template's match
+// rules, interpolated with the instance's vars
+type instanceMatcher struct {
+	inst    *Instance
+	rules   *MatchRules
+	exe     string
+	argv    *regexp.Regexp
+	cwd     string
+	env     map[string]string
+	ports   []int
+	pidfile bool
+	pid     int  // From the pidfile
+	never   bool // A rule can't be met, such as an invalid argv pattern
+}
+
+// newInstanceMatcher prepares the rules of an instance's template for
+// comparing processes with
+func newInstanceMatcher(state *State, inst *Instance) *instanceMatcher {
+	m := &instanceMatcher{inst: inst, rules: &MatchRules{}}
+	if tmpl := state.Templates[inst.Template]; tmpl != nil && tmpl.Match != nil {
+		m.rules = tmpl.Match
+	}
+	vars := ExecVars(state, inst)
+
+	if m.rules.Exe != "" {
+		m.exe = resolveExecutable(interpolate(m.rules.Exe, vars), inst.Resources["workdir"])
+		if m.exe == "" {
+			m.exe = filepath.Clean(interpolate(m.rules.Exe, vars)) // Compared as is
+		}
+	}
+	if m.rules.Argv != "" {
+		// Vars can make a valid pattern invalid; it then matches nothing
+		re, err := regexp.Compile(interpolate(m.rules.Argv, vars))
+		m.argv, m.never = re, err != nil
+	}
+	if m.rules.Cwd != "" {
+		m.cwd = filepath.Clean(interpolate(m.rules.Cwd, vars))
+	}
+	if len(m.rules.Env) > 0 {
+		m.env = make(map[string]string)
+		for k, v := range m.rules.Env {
+			m.env[k] = interpolate(v, vars)
+		}
+	}
+
+	ports := m.rules.Ports
+	if ports == nil {
+		ports = defaultMatchPorts
+	}
+	for _, rtype := range ports {
+		if port, _ := strconv.Atoi(inst.Resources[rtype]); port > 0 {
+			m.ports = append(m.ports, port)
+		}
+	}
+
+	if m.rules.Pidfile != "" {
+		m.pidfile = true
+		data, err := os.ReadFile(interpolate(m.rules.Pidfile, vars))
+		if err == nil {
+			m.pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	return m
+}
+
+// matches reports whether a process is the instance's. Processes vp started
+// for other instances, or ran with vp exec, never are; for an instance vp
+// launched, only a process with its marker is, unless the rules say
+// unmarked ones may be.
+func (m *instanceMatcher) matches(proc *ProcessInfo) bool {
+	if m.never {
+		return false
+	}
+	marker, ok := proc.Environ[instanceEnv]
+	if ok && marker != m.inst.Name {
+		return false
+	}
+	if !ok && m.inst.Marked && !m.rules.Unmarked {
+		return false
+	}
+	if _, ok := proc.Environ[execEnv]; ok {
+		return false
+	}
+	if m.pidfile && proc.PID != m.pid {
+		return false
+	}
+	if !matchesCommand(m.inst, m.rules, proc) {
+		return false
+	}
+	if m.exe != "" && proc.Exe != m.exe {
+		return false
+	}
+	if m.argv != nil && !m.argv.MatchString(strings.Join(proc.Argv, " ")) {
+		return false
+	}
+	if m.cwd != "" && proc.Cwd != m.cwd {
+		return false
+	}
+	for k, v := range m.env {
+		if value, ok := proc.Environ[k]; !ok || v != "" && value != v {
+			return false
+		}
+	}
+	for _, port := range m.ports {
+		found := false
+		for _, p := range proc.Ports {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// best picks the process to take among those that match: one vp marked as
+// the instance's over unmarked ones, and a parent over the children it
+// passed the marker on to
+func (m *instanceMatcher) best(candidates []*ProcessInfo) *ProcessInfo {
+	var best *ProcessInfo
+	pids := make(map[int]bool)
+	for _, proc := range candidates {
+		pids[proc.PID] = true
+	}
+	rank := func(proc *ProcessInfo) int {
+		r := 0
+		if proc.Environ[instanceEnv] == m.inst.Name {
+			r += 2
+		}
+		if !pids[proc.PPID] {
+			r++
+		}
+		return r
+	}
+	for _, proc := range candidates {
+		if best == nil || rank(proc) > rank(best) {
+			best = proc
+		}
+	}
+	return best
+}
+
+// matchesCommand reports whether a process runs an instance's command,
+// compared the way rules say
+func matchesCommand(inst *Instance, rules *MatchRules, proc *ProcessInfo) bool {
+	want := inst.commandArgv()
+	if len(want) == 0 {
+		return false
+	}
+	mode := MatchName
+	if rules != nil && rules.Command != "" {
+		mode = rules.Command
+	}
+
+	switch mode {
+	case MatchExe:
+		exe := resolveExecutable(want[0], inst.Resources["workdir"])
+		return exe != "" && exe == proc.Exe
+	case MatchArgv:
+		if len(want) != len(proc.Argv) {
+			return false
+		}
+		for i := range want {
+			if want[i] != proc.Argv[i] {
+				return false
+			}
+		}
+		return true
+	}
+	name := filepath.Base(want[0])
+	if len(proc.Argv) > 0 && filepath.Base(proc.Argv[0]) == name {
+		return true
+	}
+	return proc.Name == name // Processes that rewrite their arguments keep their name
+}
+
+// resolveExecutable returns the file a command name runs, with symlinks
+// resolved like in /proc/<pid>/exe, or "" if there is none
+func resolveExecutable(name, dir string) string {
+	if !strings.Contains(name, "/") {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return ""
+		}
+		name = path
+	} else if !filepath.IsAbs(name) && dir != "" {
+		name = filepath.Join(dir, name)
+	}
+	path, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	return abs
+}
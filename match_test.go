@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMatchesCommand tests the ways of comparing a process's command with an
+// instance's
+func TestMatchesCommand(t *testing.T) {
+	inst := &Instance{Name: "app", Argv: []string{"/usr/bin/python3", "app.py", "--title", "a b"}}
+	same := &ProcessInfo{Name: "python3", Argv: []string{"/usr/bin/python3", "app.py", "--title", "a b"}}
+	other := &ProcessInfo{Name: "python3", Argv: []string{"python3", "other.py"}}
+
+	if !matchesCommand(inst, nil, same) || !matchesCommand(inst, nil, other) {
+		t.Errorf("Expected processes of the same program to match by name")
+	}
+	argv := &MatchRules{Command: MatchArgv}
+	if !matchesCommand(inst, argv, same) || matchesCommand(inst, argv, other) {
+		t.Errorf("Expected only the process with the same arguments to match by argv")
+	}
+
+	// Without argv the command is split on spaces
+	nginx := &Instance{Name: "web", Command: "nginx -g daemon"}
+	if !matchesCommand(nginx, nil, &ProcessInfo{Name: "nginx", Argv: []string{"nginx: master process"}}) {
+		t.Errorf("Expected a process that rewrote its arguments to match by its name")
+	}
+
+	sh := resolveExecutable("sh", "")
+	if sh == "" {
+		t.Skip("sh not found")
+	}
+	exe := &MatchRules{Command: MatchExe}
+	shell := &Instance{Name: "shell", Command: "sh -c true"}
+	if !matchesCommand(shell, exe, &ProcessInfo{Exe: sh, Argv: []string{"-sh"}}) {
+		t.Errorf("Expected a process running %s to match by exe", sh)
+	}
+	if matchesCommand(shell, exe, &ProcessInfo{Exe: "/nonexistent/sh", Argv: []string{"sh"}}) {
+		t.Errorf("Expected a process running another sh not to match by exe")
+	}
+
+	if err := validateMatch(&Template{Match: &MatchRules{Command: "path"}}); err == nil {
+		t.Errorf("Expected an unknown match command to be rejected")
+	}
+}
+
+// TestInstanceMatcher tests a template's match rules, the VP_INSTANCE marker
+// and which of several matching processes is taken
+func TestInstanceMatcher(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "worker.pid")
+	os.WriteFile(pidfile, []byte("42\n"), 0644)
+	s := &State{Templates: map[string]*Template{"worker": {ID: "worker", Match: &MatchRules{
+		Argv:    `--queue ${queue}$`,
+		Cwd:     "${workdir}",
+		Env:     map[string]string{"APP_ROLE": "worker"},
+		Ports:   []string{"adminport"},
+		Pidfile: pidfile,
+	}}}}
+	inst := &Instance{Name: "w1", Template: "worker", Command: "python3 worker.py --queue mail",
+		Vars: map[string]string{"queue": "mail"}, Resources: map[string]string{"workdir": "/srv/app", "adminport": "9100"}}
+	m := newInstanceMatcher(s, inst)
+
+	proc := func(change func(p *ProcessInfo)) *ProcessInfo {
+		p := &ProcessInfo{PID: 42, PPID: 1, Name: "python3", Argv: []string{"python3", "worker.py", "--queue", "mail"},
+			Cwd: "/srv/app", Environ: map[string]string{"APP_ROLE": "worker"}, Ports: []int{9100}}
+		if change != nil {
+			change(p)
+		}
+		return p
+	}
+	if !m.matches(proc(nil)) {
+		t.Fatalf("Expected the process to match")
+	}
+	if !m.matches(proc(func(p *ProcessInfo) { p.Environ[instanceEnv] = "w1" })) {
+		t.Errorf("Expected a process marked as the instance's to match")
+	}
+
+	mismatches := map[string]func(p *ProcessInfo){
+		"another instance's": func(p *ProcessInfo) { p.Environ[instanceEnv] = "w2" },
+		"run by vp exec":     func(p *ProcessInfo) { p.Environ[execEnv] = "1" },
+		"not in the pidfile": func(p *ProcessInfo) { p.PID = 43 },
+		"another program":    func(p *ProcessInfo) { p.Name, p.Argv[0] = "ruby", "ruby" },
+		"another queue":      func(p *ProcessInfo) { p.Argv[3] = "mailer" },
+		"another directory":  func(p *ProcessInfo) { p.Cwd = "/srv" },
+		"without the env":    func(p *ProcessInfo) { delete(p.Environ, "APP_ROLE") },
+		"not listening":      func(p *ProcessInfo) { p.Ports = []int{9101} },
+	}
+	for name, change := range mismatches {
+		if m.matches(proc(change)) {
+			t.Errorf("Expected a process %s not to match", name)
+		}
+	}
+
+	// Once vp launched the instance, only processes with its marker are its,
+	// unless the rules take unmarked ones as well
+	inst.Marked = true
+	if m.matches(proc(nil)) {
+		t.Errorf("Expected an unmarked process not to match an instance vp launched")
+	}
+	if !m.matches(proc(func(p *ProcessInfo) { p.Environ[instanceEnv] = "w1" })) {
+		t.Errorf("Expected the marked process to match an instance vp launched")
+	}
+	s.Templates["worker"].Match.Unmarked = true
+	if !newInstanceMatcher(s, inst).matches(proc(nil)) {
+		t.Errorf("Expected an unmarked process to match with unmarked set")
+	}
+	inst.Marked = false
+
+	// The marked parent wins over the children it passed the marker to and
+	// over unmarked processes
+	parent := &ProcessInfo{PID: 10, PPID: 1, Environ: map[string]string{instanceEnv: "w1"}}
+	child := &ProcessInfo{PID: 11, PPID: 10, Environ: map[string]string{instanceEnv: "w1"}}
+	unmarked := &ProcessInfo{PID: 5, PPID: 1, Environ: map[string]string{}}
+	if best := m.best([]*ProcessInfo{child, unmarked, parent}); best != parent {
+		t.Errorf("Expected PID 10, got %d", best.PID)
+	}
+}
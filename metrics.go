@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanStats records how long process discovery scans take
+type scanStats struct {
+	mu    sync.Mutex
+	last  time.Duration // Duration of the most recent scan
+	total time.Duration // Sum of all scan durations
+	count int64         // Number of scans
+}
+
+var discoveryStats = &scanStats{}
+
+// Observe records a scan that began at start
+func (s *scanStats) Observe(start time.Time) {
+	d := time.Since(start)
+	s.mu.Lock()
+	s.last = d
+	s.total += d
+	s.count++
+	s.mu.Unlock()
+}
+
+// instanceStatuses are the values vp_instance_status is exported for
+var instanceStatuses = []string{"running", "starting", "stopping", "stopped", "error"}
+
+// metricWriter writes the Prometheus text exposition format
+type metricWriter struct {
+	w io.Writer
+}
+
+// header writes the HELP and TYPE lines of a metric family
+func (m metricWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels alternate name, value
+func (m metricWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %g\n", b.String(), value)
+}
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// boolValue converts a condition into a 0/1 sample value
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Built in memory so a slow scraper doesn't hold up the state
+	var buf bytes.Buffer
+	m := metricWriter{w: &buf}
+
+	instances := visibleInstances(r, state.Instances)
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Resource usage as last sampled by the reconciler
+	stats := make(map[string]*ProcessStats)
+	for _, name := range names {
+		if inst := instances[name]; inst.Status == "running" && inst.Stats != nil {
+			stats[name] = inst.Stats
+		}
+	}
+
+	labels := func(inst *Instance, name string) []string {
+		return []string{"instance", name, "project", inst.Project, "template", inst.Template}
+	}
+
+	m.header("vp_instance_up", "gauge", "Whether the instance's process is running.")
+	for _, name := range names {
+		inst := instances[name]
+		m.sample("vp_instance_up", boolValue(inst.Status == "running"), labels(inst, name)...)
+	}
+
+	m.header("vp_instance_status", "gauge", "Current status of the instance (1 for the active status).")
+	for _, name := range names {
+		inst := instances[name]
+		for _, status := range instanceStatuses {
+			m.sample("vp_instance_status", boolValue(inst.Status == status), append(labels(inst, name), "status", status)...)
+		}
+	}
+
+	m.header("vp_instance_restarts_total", "counter", "Number of times the instance was restarted.")
+	for _, name := range names {
+		inst := instances[name]
+		m.sample("vp_instance_restarts_total", float64(inst.Restarts), labels(inst, name)...)
+	}
+
+	m.header("vp_instance_cpu_seconds_total", "counter", "CPU time used by the instance's process.")
+	for _, name := range names {
+		inst := instances[name]
+		m.sample("vp_instance_cpu_seconds_total", inst.CPUTime, labels(inst, name)...)
+	}
+
+	m.header("vp_instance_tree_processes", "gauge", "Processes in the instance's process tree.")
+	for _, name := range names {
+		if t := instances[name].Totals; t != nil && instances[name].Status == "running" {
+			m.sample("vp_instance_tree_processes", float64(t.Processes), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_tree_cpu_seconds_total", "counter", "CPU time used by the instance's process and its descendants.")
+	for _, name := range names {
+		if t := instances[name].Totals; t != nil && instances[name].Status == "running" {
+			m.sample("vp_instance_tree_cpu_seconds_total", t.CPUTime, labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_tree_resident_memory_bytes", "gauge", "Resident set size of the instance's process and its descendants.")
+	for _, name := range names {
+		if t := instances[name].Totals; t != nil && instances[name].Status == "running" {
+			m.sample("vp_instance_tree_resident_memory_bytes", float64(t.RSS), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_resident_memory_bytes", "gauge", "Resident set size of the instance's process.")
+	for _, name := range names {
+		if s := stats[name]; s != nil {
+			m.sample("vp_instance_resident_memory_bytes", float64(s.RSS), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_proportional_memory_bytes", "gauge", "Proportional set size of the instance's process.")
+	for _, name := range names {
+		if s := stats[name]; s != nil && s.PSS > 0 {
+			m.sample("vp_instance_proportional_memory_bytes", float64(s.PSS), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_read_bytes_total", "counter", "Bytes the instance's process read from storage.")
+	for _, name := range names {
+		if s := stats[name]; s != nil {
+			m.sample("vp_instance_read_bytes_total", float64(s.ReadBytes), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_write_bytes_total", "counter", "Bytes the instance's process wrote to storage.")
+	for _, name := range names {
+		if s := stats[name]; s != nil {
+			m.sample("vp_instance_write_bytes_total", float64(s.WriteBytes), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_open_fds", "gauge", "Open file descriptors of the instance's process.")
+	for _, name := range names {
+		if s := stats[name]; s != nil && s.FDs >= 0 {
+			m.sample("vp_instance_open_fds", float64(s.FDs), labels(instances[name], name)...)
+		}
+	}
+
+	m.header("vp_instance_threads", "gauge", "Threads of the instance's process.")
+	for _, name := range names {
+		if s := stats[name]; s != nil {
+			m.sample("vp_instance_threads", float64(s.Threads), labels(instances[name], name)...)
+		}
+	}
+
+	// Resource pools
+	claimed := make(map[string]int)
+	for _, res := range state.Resources {
+		claimed[res.Type]++
+	}
+	types := make([]string, 0, len(state.Types))
+	for name := range state.Types {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+
+	m.header("vp_resource_claimed", "gauge", "Resources of this type currently claimed.")
+	for _, name := range types {
+		m.sample("vp_resource_claimed", float64(claimed[name]), "type", name)
+	}
+
+	m.header("vp_resource_pool_size", "gauge", "Size of the counter range of this resource type.")
+	for _, name := range types {
+		if rt := state.Types[name]; rt.Counter && rt.End >= rt.Start {
+			m.sample("vp_resource_pool_size", float64(rt.End-rt.Start+1), "type", name)
+		}
+	}
+
+	m.header("vp_resource_utilization_ratio", "gauge", "Claimed resources divided by the pool size.")
+	for _, name := range types {
+		if rt := state.Types[name]; rt.Counter && rt.End >= rt.Start {
+			m.sample("vp_resource_utilization_ratio", float64(claimed[name])/float64(rt.End-rt.Start+1), "type", name)
+		}
+	}
+
+	// Discovery
+	discoveryStats.mu.Lock()
+	last, total, count := discoveryStats.last, discoveryStats.total, discoveryStats.count
+	discoveryStats.mu.Unlock()
+
+	m.header("vp_discovery_last_duration_seconds", "gauge", "Duration of the most recent process discovery scan.")
+	m.sample("vp_discovery_last_duration_seconds", last.Seconds())
+	m.header("vp_discovery_duration_seconds", "summary", "Duration of process discovery scans.")
+	m.sample("vp_discovery_duration_seconds_sum", total.Seconds())
+	m.sample("vp_discovery_duration_seconds_count", float64(count))
+
+	releaseState(r)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
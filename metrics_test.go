@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHandleMetrics tests instance and resource pool series in the
+// Prometheus text output
+func TestHandleMetrics(t *testing.T) {
+	state = &State{
+		Instances: map[string]*Instance{
+			"alpha/web": {Name: "alpha/web", Template: "web", Project: "alpha", Status: "stopped", Restarts: 3, CPUTime: 1.5},
+		},
+		Resources: map[string]*Resource{
+			"tcpport:3000": {Type: "tcpport", Value: "3000", Owner: "alpha/web"},
+		},
+		Types: map[string]*ResourceType{
+			"tcpport": {Name: "tcpport", Counter: true, Start: 3000, End: 3099},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`vp_instance_up{instance="alpha/web",project="alpha",template="web"} 0`,
+		`vp_instance_status{instance="alpha/web",project="alpha",template="web",status="stopped"} 1`,
+		`vp_instance_restarts_total{instance="alpha/web",project="alpha",template="web"} 3`,
+		`vp_instance_cpu_seconds_total{instance="alpha/web",project="alpha",template="web"} 1.5`,
+		`vp_resource_claimed{type="tcpport"} 1`,
+		`vp_resource_pool_size{type="tcpport"} 100`,
+		`vp_resource_utilization_ratio{type="tcpport"} 0.01`,
+		"# TYPE vp_discovery_duration_seconds summary",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics output:\n%s", want, body)
+		}
+	}
+
+	// The state is free again by the time the output is written
+	lock := &lockProbe{ResponseRecorder: httptest.NewRecorder()}
+	stateMiddleware(http.HandlerFunc(handleMetrics)).ServeHTTP(lock, httptest.NewRequest("GET", "/metrics", nil))
+	if lock.writes == 0 || lock.held {
+		t.Errorf("Expected the output written after releasing the state (%d writes)", lock.writes)
+	}
+
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %q", got)
+	}
+}
+
+// lockProbe records whether the state was locked during any write
+type lockProbe struct {
+	*httptest.ResponseRecorder
+	writes int
+	held   bool
+}
+
+func (p *lockProbe) Write(b []byte) (int, error) {
+	p.writes++
+	if state.mu.TryLock() {
+		state.mu.Unlock()
+	} else {
+		p.held = true
+	}
+	return p.ResponseRecorder.Write(b)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Origin scopes, from least to most privileged. An approved origin may do
+// everything its scope and the scopes below it allow.
+const (
+	ScopeRead    = "read"    // GET requests
+	ScopeControl = "control" // Start/stop/restart/delete instances, run actions
+	ScopeAdmin   = "admin"   // Templates, resource types, projects, config, remotes
+	ScopeBlocked = "blocked" // Explicitly refused (never listed as pending)
+)
+
+var scopeRank = map[string]int{ScopeRead: 1, ScopeControl: 2, ScopeAdmin: 3}
+
+// csrfToken protects the embedded UI's mutating requests. It is generated
+// per daemon run and handed to the page in a meta tag.
+var csrfToken = newCSRFToken()
+
+func newCSRFToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// RemoteOrigin is an entry of the origin allowlist as shown by /api/remotes
+type RemoteOrigin struct {
+	Origin string `json:"origin"`
+	Scope  string `json:"scope"` // read|control|admin|blocked|pending
+}
+
+// maxPendingOrigins caps how many unapproved origins are listed as pending
+const maxPendingOrigins = 50
+
+// pendingOrigins are the origins seen but never approved or blocked, oldest
+// first. They are kept in memory only: any page can send an Origin header,
+// so recording them in state would let unauthenticated requests grow it.
+var pendingOrigins struct {
+	sync.Mutex
+	list []string
+}
+
+// notePendingOrigin lists an origin as pending, dropping the oldest once
+// there are too many
+func notePendingOrigin(origin string) {
+	pendingOrigins.Lock()
+	defer pendingOrigins.Unlock()
+	if slices.Contains(pendingOrigins.list, origin) {
+		return
+	}
+	pendingOrigins.list = append(pendingOrigins.list, origin)
+	if len(pendingOrigins.list) > maxPendingOrigins {
+		pendingOrigins.list = pendingOrigins.list[1:]
+	}
+}
+
+// forgetPendingOrigin removes an origin from the pending list and reports
+// whether it was there
+func forgetPendingOrigin(origin string) bool {
+	pendingOrigins.Lock()
+	defer pendingOrigins.Unlock()
+	i := slices.Index(pendingOrigins.list, origin)
+	if i < 0 {
+		return false
+	}
+	pendingOrigins.list = slices.Delete(pendingOrigins.list, i, i+1)
+	return true
+}
+
+// OriginScope returns the scope granted to a cross-origin caller, or "" if it
+// isn't approved. Origins seen for the first time are listed as pending.
+func (s *State) OriginScope(origin string) string {
+	allowed, exists := s.RemotesAllowed[origin]
+	scope := s.RemoteScopes[origin]
+
+	if !exists {
+		notePendingOrigin(origin)
+		return ""
+	}
+	if !allowed {
+		return ""
+	}
+	// Origins approved before scopes existed could execute actions
+	if scopeRank[scope] > 0 {
+		return scope
+	}
+	return ScopeControl
+}
+
+// SetOriginScope approves or blocks an origin
+func (s *State) SetOriginScope(origin, scope string) {
+	forgetPendingOrigin(origin)
+	s.RemotesAllowed[origin] = scope != ScopeBlocked
+	s.RemoteScopes[origin] = scope
+	s.Save()
+}
+
+// RemoteOrigins lists the allowlist, pending origins included
+func (s *State) RemoteOrigins() []RemoteOrigin {
+	result := make([]RemoteOrigin, 0, len(s.RemotesAllowed))
+	for origin, allowed := range s.RemotesAllowed {
+		scope := s.RemoteScopes[origin]
+		switch {
+		case allowed && scopeRank[scope] == 0:
+			scope = ScopeControl
+		case !allowed && scope != ScopeBlocked:
+			scope = "pending"
+		}
+		result = append(result, RemoteOrigin{Origin: origin, Scope: scope})
+	}
+
+	pendingOrigins.Lock()
+	for _, origin := range pendingOrigins.list {
+		if _, exists := s.RemotesAllowed[origin]; !exists {
+			result = append(result, RemoteOrigin{Origin: origin, Scope: "pending"})
+		}
+	}
+	pendingOrigins.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Origin < result[j].Origin })
+	return result
+}
+
+// requiredScope returns the scope a request needs
+func requiredScope(r *http.Request) string {
+	// A WebSocket onto an instance's terminal can type commands into it
+	if isWebSocket(r) {
+		return ScopeControl
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		// The config dump includes token hashes and the allowlist itself
+		if r.URL.Path == "/api/config" || r.URL.Path == "/api/remotes" {
+			return ScopeAdmin
+		}
+		return ScopeRead
+	}
+
+	for _, prefix := range []string{"/api/config", "/api/templates", "/api/resource-types", "/api/projects", "/api/remotes"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return ScopeAdmin
+		}
+	}
+	return ScopeControl
+}
+
+// sameOrigin reports whether an Origin header names this server. It relies
+// on hostMiddleware having checked the Host header.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// hostMiddleware refuses TCP requests whose Host header isn't a name this
+// server answers to. A DNS rebinding page reaches the server under its own
+// domain, so without this check it would count as same origin and could read
+// the CSRF token from the web UI. IP addresses can't be rebound and are
+// always accepted; unix socket peers are identified by uid instead.
+func hostMiddleware(names []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(peerUIDKey{}).(int); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+		if net.ParseIP(host) == nil && !slices.ContainsFunc(names, func(name string) bool {
+			return strings.EqualFold(name, host)
+		}) {
+			writeError(w, http.StatusMisdirectedRequest, "host %s is not served here; add it with vp serve --hosts", r.Host)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isMutating reports whether a request can change state. WebSockets count:
+// browsers open them cross-site without CORS.
+func isMutating(r *http.Request) bool {
+	return (r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS") || isWebSocket(r)
+}
+
+// fromBrowser reports whether a request looks like it came from a browser,
+// which could be driven by another site's page
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Cookie") != ""
+}
+
+// validCSRF checks the embedded UI's CSRF header. WebSockets can't carry
+// headers, so they pass the token as ?csrf= instead.
+func validCSRF(r *http.Request) bool {
+	token := r.Header.Get("X-VP-CSRF")
+	if isWebSocket(r) && token == "" {
+		token = r.URL.Query().Get("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken)) == 1
+}
+
+func handleRemotes(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, VerbEditConfig, "", "") {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, state.RemoteOrigins())
+
+	case "POST":
+		var req RemoteOrigin
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		if req.Origin == "" {
+			writeError(w, http.StatusBadRequest, "origin is required")
+			return
+		}
+		if scopeRank[req.Scope] == 0 && req.Scope != ScopeBlocked {
+			writeError(w, http.StatusBadRequest, "scope must be read, control, admin or blocked")
+			return
+		}
+
+		state.SetOriginScope(req.Origin, req.Scope)
+		state.RecordEvent(httpActor(r), "remote", "", req.Origin+" -> "+req.Scope)
+		writeJSON(w, http.StatusOK, req)
+
+	case "DELETE":
+		origin := r.URL.Query().Get("origin")
+		_, exists := state.RemotesAllowed[origin]
+		delete(state.RemotesAllowed, origin)
+		delete(state.RemoteScopes, origin)
+		state.Save()
+
+		if !forgetPendingOrigin(origin) && !exists {
+			writeError(w, http.StatusNotFound, "origin %s not found", origin)
+			return
+		}
+		state.RecordEvent(httpActor(r), "remote", "", "forgot "+origin)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET, POST, DELETE")
+	}
+}
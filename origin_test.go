@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOriginPolicy tests origin approval, scopes and the CSRF check
+func TestOriginPolicy(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	state = &State{
+		Instances:      make(map[string]*Instance),
+		Templates:      make(map[string]*Template),
+		Resources:      make(map[string]*Resource),
+		Counters:       make(map[string]int),
+		Types:          DefaultResourceTypes(),
+		RemotesAllowed: make(map[string]bool),
+		RemoteScopes:   make(map[string]string),
+	}
+	pendingOrigins.list = nil
+
+	handler := corsMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	do := func(method, path string, headers map[string]string) int {
+		req := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	remote := map[string]string{"Origin": "http://dash.example"}
+
+	if code := do("GET", "/api/instances", remote); code != http.StatusForbidden {
+		t.Errorf("Expected unknown origin to be refused, got %d", code)
+	}
+	if got := state.RemoteOrigins(); len(got) != 1 || got[0].Scope != "pending" {
+		t.Errorf("Expected the origin to be listed as pending, got %+v", got)
+	}
+	if len(state.RemotesAllowed) != 0 {
+		t.Errorf("Expected a pending origin not to be saved, got %v", state.RemotesAllowed)
+	}
+	for i := 0; i < maxPendingOrigins+10; i++ {
+		do("GET", "/api/instances", map[string]string{"Origin": fmt.Sprintf("http://spam%d.example", i)})
+	}
+	if got := state.RemoteOrigins(); len(got) != maxPendingOrigins {
+		t.Errorf("Expected at most %d pending origins, got %d", maxPendingOrigins, len(got))
+	}
+
+	state.SetOriginScope("http://dash.example", ScopeRead)
+	if code := do("GET", "/api/instances", remote); code != http.StatusOK {
+		t.Errorf("Expected read scope to allow GET, got %d", code)
+	}
+	if code := do("POST", "/api/instances/web:stop", remote); code != http.StatusForbidden {
+		t.Errorf("Expected read scope to refuse control, got %d", code)
+	}
+
+	state.SetOriginScope("http://dash.example", ScopeControl)
+	if code := do("POST", "/api/instances/web:stop", remote); code != http.StatusOK {
+		t.Errorf("Expected control scope to allow stop, got %d", code)
+	}
+	if code := do("POST", "/api/config", remote); code != http.StatusForbidden {
+		t.Errorf("Expected control scope to refuse config, got %d", code)
+	}
+
+	// Legacy allowlist entries keep the ability to execute actions
+	state.RemotesAllowed["http://old.example"] = true
+	if code := do("POST", "/api/execute-action", map[string]string{"Origin": "http://old.example"}); code != http.StatusOK {
+		t.Errorf("Expected legacy approved origin to execute actions, got %d", code)
+	}
+
+	ui := map[string]string{"Origin": "http://localhost:8080"}
+	if code := do("POST", "/api/config", ui); code != http.StatusForbidden {
+		t.Errorf("Expected same-origin POST without CSRF token to be refused, got %d", code)
+	}
+	ui["X-VP-CSRF"] = csrfToken
+	if code := do("POST", "/api/config", ui); code != http.StatusOK {
+		t.Errorf("Expected same-origin POST with CSRF token to pass, got %d", code)
+	}
+	if code := do("POST", "/api/config", nil); code != http.StatusOK {
+		t.Errorf("Expected non-browser client to pass, got %d", code)
+	}
+}
+
+// TestHostMiddleware tests that only names the server answers to, and IP
+// addresses, are accepted as the Host header
+func TestHostMiddleware(t *testing.T) {
+	handler := hostMiddleware(serverNames("127.0.0.1:8080", []string{"vp.internal"}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for host, want := range map[string]int{
+		"localhost:8080":      http.StatusOK,
+		"127.0.0.1:8080":      http.StatusOK,
+		"[::1]:8080":          http.StatusOK,
+		"10.0.0.5:8080":       http.StatusOK,
+		"VP.internal":         http.StatusOK,
+		"rebind.example:8080": http.StatusMisdirectedRequest,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("Host %s: expected %d, got %d", host, want, rec.Code)
+		}
+	}
+
+	// Unix socket peers are identified by uid, whatever Host they send
+	req := httptest.NewRequest("GET", "http://unix/api/instances", nil)
+	req = req.WithContext(context.WithValue(req.Context(), peerUIDKey{}, 1000))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a socket peer to pass, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// OutputOptions are the global flags that choose how commands print their
+// results, so scripts can use vp without scraping tables
+type OutputOptions struct {
+	Format string             // --output/-o: "" (table), json, yaml, wide or name
+	Filter []filterTerm       // --filter: key=value,key!=value on the JSON fields
+	Tmpl   *template.Template // --format: Go template over the JSON fields
+}
+
+// filterTerm is one key=value or key!=value condition of --filter
+type filterTerm struct {
+	Key    string // JSON field, dots for nested fields (resources.tcpport)
+	Value  string
+	Negate bool
+}
+
+// output holds the global output flags of the current command
+var output OutputOptions
+
+// parseOutputFlags extracts -o/--output, --filter and --format from the
+// arguments before "--" and returns the remaining ones. After the
+// subcommand's first positional argument only -o is taken: --output,
+// --filter and --format there are the subcommand's own, such as template vars.
+func parseOutputFlags(args []string) (OutputOptions, []string, error) {
+	var opts OutputOptions
+	var rest []string
+	command, positional := false, false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// The rest belongs to another command (vp exec)
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !command && (arg == "-p" || arg == "--project") && i+1 < len(args) {
+			// Its value isn't the subcommand; parseProjectFlag takes both
+			rest = append(rest, arg, args[i+1])
+			i++
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") {
+			positional = positional || command
+			command = true
+		}
+		if !strings.HasPrefix(arg, "-") || (name != "o" && (positional || name != "output" && name != "filter" && name != "format")) {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return opts, nil, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "o", "output":
+			switch value {
+			case "json", "yaml", "wide", "name":
+				opts.Format = value
+			default:
+				return opts, nil, fmt.Errorf("unknown output format %q (use json, yaml, wide or name)", value)
+			}
+		case "filter":
+			for _, cond := range strings.Split(value, ",") {
+				term := filterTerm{}
+				key, val, ok := strings.Cut(cond, "!=")
+				if ok {
+					term.Negate = true
+				} else if key, val, ok = strings.Cut(cond, "="); !ok {
+					return opts, nil, fmt.Errorf("invalid filter %q, use key=value", cond)
+				}
+				term.Key, term.Value = strings.TrimSpace(key), strings.TrimSpace(val)
+				opts.Filter = append(opts.Filter, term)
+			}
+		case "format":
+			tmpl, err := template.New("format").Funcs(template.FuncMap{
+				"json": func(v interface{}) (string, error) {
+					data, err := json.Marshal(v)
+					return string(data), err
+				},
+				"join": func(v []interface{}, sep string) string {
+					parts := make([]string, len(v))
+					for i, p := range v {
+						parts[i] = fmt.Sprint(p)
+					}
+					return strings.Join(parts, sep)
+				},
+			}).Parse(value)
+			if err != nil {
+				return opts, nil, fmt.Errorf("invalid --format: %w", err)
+			}
+			opts.Tmpl = tmpl
+		}
+	}
+	return opts, rest, nil
+}
+
+// generic converts v into the maps, slices and json.Numbers its JSON form
+// decodes to, which is what --filter, --format and yaml work on
+func generic(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out interface{}
+	dec.Decode(&out)
+	return out
+}
+
+// lookupField follows a dotted key through nested objects
+func lookupField(v interface{}, key string) (interface{}, bool) {
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// matches reports whether an object satisfies every filter term. Missing
+// fields compare as empty.
+func (o OutputOptions) matches(v interface{}) bool {
+	for _, term := range o.Filter {
+		field, ok := lookupField(v, term.Key)
+		value := ""
+		if ok && field != nil {
+			value = fmt.Sprint(field)
+		}
+		if (value == term.Value) == term.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// printList prints items according to the output flags. name gives an
+// item's name for -o name; table prints the human form of the items that
+// pass --filter, with wide set for -o wide.
+func printList[T any](items []T, name func(T) string, table func(items []T, wide bool)) {
+	if err := writeList(os.Stdout, output, items, name, table); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func writeList[T any](w io.Writer, opts OutputOptions, items []T, name func(T) string, table func(items []T, wide bool)) error {
+	var kept []T
+	var values []interface{}
+	for _, item := range items {
+		v := generic(item)
+		if opts.matches(v) {
+			kept = append(kept, item)
+			values = append(values, v)
+		}
+	}
+	if values == nil {
+		values = []interface{}{}
+	}
+
+	if opts.Tmpl != nil {
+		for _, v := range values {
+			if err := opts.Tmpl.Execute(w, v); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+
+	switch opts.Format {
+	case "json":
+		data, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+	case "yaml":
+		io.WriteString(w, toYAML(values))
+	case "name":
+		for _, item := range kept {
+			fmt.Fprintln(w, name(item))
+		}
+	default:
+		table(kept, opts.Format == "wide")
+	}
+	return nil
+}
+
+// printObject prints a single result according to the output flags; text
+// prints its human form. --filter does not apply.
+func printObject(item interface{}, name string, text func(wide bool)) {
+	if err := writeObject(os.Stdout, output, item, name, text); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func writeObject(w io.Writer, opts OutputOptions, item interface{}, name string, text func(wide bool)) error {
+	if opts.Tmpl != nil {
+		if err := opts.Tmpl.Execute(w, generic(item)); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+		return nil
+	}
+
+	switch opts.Format {
+	case "json":
+		data, err := json.MarshalIndent(item, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+	case "yaml":
+		io.WriteString(w, toYAML(generic(item)))
+	case "name":
+		fmt.Fprintln(w, name)
+	default:
+		text(opts.Format == "wide")
+	}
+	return nil
+}
+
+// plainYAML matches strings that need no quoting in YAML. They start with a
+// letter, _ or / so that none reads as a number (.5, .inf, .nan).
+var plainYAML = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./@+-]*( [A-Za-z0-9_./@+-]+)*$`)
+
+// yamlScalar formats a scalar; strings that YAML would read differently
+// (numbers, booleans, special characters) are double-quoted
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		switch strings.ToLower(v) {
+		case "true", "false", "yes", "no", "on", "off", "null", "y", "n":
+		default:
+			if plainYAML.MatchString(v) {
+				return v
+			}
+		}
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toYAML encodes a generic value (see generic) as a YAML document
+func toYAML(v interface{}) string {
+	var b strings.Builder
+	writeYAML(&b, v, 0)
+	return b.String()
+}
+
+// writeYAML writes v as a block at the given indent. Scalars and empty
+// collections are written inline and end the line.
+func writeYAML(b *strings.Builder, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(pad + yamlScalar(k) + ":")
+			writeYAMLValue(b, v[k], indent+2)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			// The first line of a nested block goes after the dash
+			var sub strings.Builder
+			writeYAML(&sub, item, indent+2)
+			b.WriteString(pad + "- " + strings.TrimPrefix(sub.String(), pad+"  "))
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLValue writes the value of a mapping key: inline for scalars and
+// empty collections, else as a block on the following lines
+func writeYAMLValue(b *strings.Builder, v interface{}, indent int) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if len(c) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+	case []interface{}:
+		if len(c) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		// Sequences may sit at the same indent as their key
+		b.WriteString("\n")
+		writeYAML(b, v, indent-2)
+		return
+	default:
+		b.WriteString(" " + yamlScalar(v) + "\n")
+		return
+	}
+	b.WriteString("\n")
+	writeYAML(b, v, indent)
+}
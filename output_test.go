@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseOutputFlags tests which arguments output flags are taken from
+func TestParseOutputFlags(t *testing.T) {
+	opts, rest, err := parseOutputFlags([]string{"-o", "json", "ps", "--filter=status=running,template!=db", "--all"})
+	if err != nil {
+		t.Fatalf("parseOutputFlags failed: %v", err)
+	}
+	if opts.Format != "json" || !reflect.DeepEqual(rest, []string{"ps", "--all"}) {
+		t.Errorf("Unexpected result: %+v %v", opts, rest)
+	}
+	want := []filterTerm{{Key: "status", Value: "running"}, {Key: "template", Value: "db", Negate: true}}
+	if !reflect.DeepEqual(opts.Filter, want) {
+		t.Errorf("Expected filter %v, got %v", want, opts.Filter)
+	}
+
+	// The value of -p in front is not the subcommand
+	opts, rest, _ = parseOutputFlags([]string{"-p", "myproj", "ps", "--filter=status=running", "--output=json"})
+	if opts.Format != "json" || len(opts.Filter) != 1 || !reflect.DeepEqual(rest, []string{"-p", "myproj", "ps"}) {
+		t.Errorf("Expected the flags after ps taken, got %+v %v", opts, rest)
+	}
+
+	// Arguments after -- belong to the command vp exec runs
+	_, rest, _ = parseOutputFlags([]string{"exec", "db", "--", "psql", "-o", "out.txt"})
+	if !reflect.DeepEqual(rest, []string{"exec", "db", "--", "psql", "-o", "out.txt"}) {
+		t.Errorf("Expected arguments after -- untouched, got %v", rest)
+	}
+
+	// After a positional argument only -o is taken; the long flags are the
+	// subcommand's, such as template vars
+	opts, rest, _ = parseOutputFlags([]string{"start", "web", "--format=csv", "--output=out", "-o", "json"})
+	if opts.Format != "json" || opts.Tmpl != nil || !reflect.DeepEqual(rest, []string{"start", "web", "--format=csv", "--output=out"}) {
+		t.Errorf("Expected vars after the template kept, got %+v %v", opts, rest)
+	}
+
+	for _, args := range [][]string{{"--output=xml"}, {"--filter=status"}, {"--format={{.name"}, {"-o"}} {
+		if _, _, err := parseOutputFlags(args); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
+
+// TestWriteList tests filtering and each output format on a list of instances
+func TestWriteList(t *testing.T) {
+	items := []*Instance{
+		{Name: "api", Status: "running", PID: 1792335643, Resources: map[string]string{"tcpport": "3000"}},
+		{Name: "db", Status: "stopped", Template: "postgres"},
+	}
+	name := func(i *Instance) string { return i.Name }
+	var tabled []*Instance
+	table := func(items []*Instance, wide bool) { tabled = items }
+
+	run := func(args ...string) string {
+		opts, _, err := parseOutputFlags(args)
+		if err != nil {
+			t.Fatalf("parseOutputFlags(%v) failed: %v", args, err)
+		}
+		var buf bytes.Buffer
+		if err := writeList(&buf, opts, items, name, table); err != nil {
+			t.Fatalf("writeList(%v) failed: %v", args, err)
+		}
+		return buf.String()
+	}
+
+	if got := run("-o", "name"); got != "api\ndb\n" {
+		t.Errorf("-o name = %q", got)
+	}
+	if got := run("--filter=resources.tcpport=3000", "-o", "name"); got != "api\n" {
+		t.Errorf("nested filter = %q", got)
+	}
+	if got := run("--format={{.name}}:{{.pid}}"); got != "api:1792335643\ndb:0\n" {
+		t.Errorf("--format = %q", got)
+	}
+	if got := run("--filter=status=nope", "-o", "json"); strings.TrimSpace(got) != "[]" {
+		t.Errorf("Expected empty JSON array, got %q", got)
+	}
+	if got := run("-o", "yaml", "--filter=template=postgres"); !strings.HasPrefix(got, "- command: \"\"\n") || !strings.Contains(got, "\n  name: db\n") || strings.Contains(got, "api") {
+		t.Errorf("Unexpected yaml:\n%s", got)
+	}
+
+	run("--filter=status!=running")
+	if len(tabled) != 1 || tabled[0].Name != "db" {
+		t.Errorf("Expected table of db only, got %v", tabled)
+	}
+}
+
+// TestToYAML tests quoting and nesting of the YAML encoder
+func TestToYAML(t *testing.T) {
+	got := toYAML(generic(map[string]interface{}{
+		"name":  "web",
+		"port":  "3000",
+		"cmd":   "node server.js --port ${tcpport}",
+		"flag":  "true",
+		"list":  []string{"a", "b"},
+		"empty": map[string]string{},
+		"count": 42,
+		"half":  ".5",
+		"inf":   ".inf",
+	}))
+	want := `cmd: "node server.js --port ${tcpport}"
+count: 42
+empty: {}
+flag: "true"
+half: ".5"
+inf: ".inf"
+list:
+- a
+- b
+name: web
+port: "3000"
+`
+	if got != want {
+		t.Errorf("toYAML =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -11,6 +11,13 @@ import (
 	"time"
 )
 
+// Template names of instances made from processes vp didn't start, which
+// roles can grant start on like any other template
+const (
+	templateDiscovered = "discovered" // Monitored or imported by port
+	templateAdopted    = "adopted"    // Taken over with vp adopt
+)
+
 // Instance represents a running or stopped process instance
 type Instance struct {
 	Name      string            `json:"name"`      // User-provided name
@@ -25,6 +32,20 @@ type Instance struct {
 	CPUTime   float64           `json:"cputime,omitempty"`   // CPU time in seconds
 	Error     string            `json:"error,omitempty"`
 	Action    string            `json:"action,omitempty"`    // Action to execute (URL or command)
+	Project   string            `json:"project,omitempty"`   // Project namespace ("" = default)
+	Restarts  int               `json:"restarts,omitempty"`  // Number of restarts
+	Stats     *ProcessStats     `json:"stats,omitempty"`     // Resource usage of PID while running
+	Totals    *TreeTotals       `json:"totals,omitempty"`    // Resource usage of PID and its descendants
+	TTY       bool              `json:"tty,omitempty"`       // Runs on a PTY held by a tty host
+	Vars      map[string]string `json:"vars,omitempty"`      // Vars the command was interpolated with
+	Group     string            `json:"group,omitempty"`     // Replica group this instance belongs to (vp scale)
+	Replica   int               `json:"replica,omitempty"`   // Index within the group
+	Env       map[string]string `json:"env,omitempty"`       // Environment variables set for the command
+	Argv      []string          `json:"argv,omitempty"`      // Exact arguments to run, when Command can't be split on spaces
+	UID       int               `json:"uid,omitempty"`       // User to run as when vp runs as root (adopted processes)
+	GID       int               `json:"gid,omitempty"`       // Group to run as along with UID
+	Groups    []int             `json:"groups,omitempty"`    // Supplementary groups to run with along with UID
+	Marked    bool              `json:"marked,omitempty"`    // Launched by vp, with the VP_INSTANCE marker in its environment
 }
 
 // Template defines how to start a process
@@ -35,20 +56,96 @@ type Template struct {
 	Resources []string          `json:"resources"` // Resource types this needs
 	Vars      map[string]string `json:"vars"`      // Default variables
 	Action    string            `json:"action,omitempty"`    // Action to execute (URL or command)
+	Project   string            `json:"project,omitempty"`   // Project namespace ("" = shared)
+	TTY       bool              `json:"tty,omitempty"`       // Run on a pseudo-terminal that `vp attach` can connect to
+	Reload    string            `json:"reload,omitempty"`    // Signal (SIGHUP) or command that makes the process reload
+	Ready     string            `json:"ready,omitempty"`     // Command that exits 0 once a new process is ready
+	Kind      string            `json:"kind,omitempty"`      // service (default) or job
+	Schedule  string            `json:"schedule,omitempty"`  // Cron expression a job runs on
+	Overlap   string            `json:"overlap,omitempty"`   // skip|queue|replace when a job is due while still running
+	Watch     *WatchSettings    `json:"watch,omitempty"`     // Restart or reload when files under ${workdir} change
+	Env       map[string]string `json:"env,omitempty"`       // Environment variables for the command, with ${var}
+	Match     *MatchRules       `json:"match,omitempty"`     // How to recognise its processes when instances are stopped
+}
+
+// validateTemplate checks the settings of a template that vp acts on later
+func validateTemplate(tmpl *Template) error {
+	if strings.Contains(tmpl.ID, "/") {
+		return fmt.Errorf("template id %q must not contain '/', set its project instead", tmpl.ID)
+	}
+	if err := validateJob(tmpl); err != nil {
+		return err
+	}
+	if err := validateMatch(tmpl); err != nil {
+		return err
+	}
+	return validateWatch(tmpl)
+}
+
+// counterRef matches %counter references in template commands
+var counterRef = regexp.MustCompile(`%(\w+)`)
+
+// resolveCommand allocates the resources a template command needs and
+// interpolates it. Each type in rtypes gets a value, the one vars asks for
+// if any; ${var} is then replaced from vars, and each %counter with the
+// value allocated for it here or else a newly allocated one. Values are
+// allocated as owner, claimed for claimant and added to vars. It returns the
+// command and the values allocated by type, all released again on error.
+func resolveCommand(state *State, command string, rtypes []string, vars map[string]string, owner, claimant, actor string) (string, map[string]string, error) {
+	allocated := make(map[string]string)
+	allocate := func(rtype, requested string) error {
+		value, err := AllocateResource(state, rtype, requested, owner)
+		if err != nil {
+			for rtype, value := range allocated {
+				state.ReleaseResource(rtype, value, claimant, actor)
+			}
+			return err
+		}
+		state.ClaimResource(rtype, value, claimant, actor)
+		allocated[rtype] = value
+		vars[rtype] = value
+		return nil
+	}
+
+	for _, rtype := range rtypes {
+		if err := allocate(rtype, vars[rtype]); err != nil {
+			return "", nil, fmt.Errorf("resource allocation failed: %w", err)
+		}
+	}
+	command = interpolate(command, vars)
+	for {
+		match := counterRef.FindStringSubmatch(command)
+		if match == nil {
+			break
+		}
+		if _, ok := allocated[match[1]]; !ok {
+			if err := allocate(match[1], ""); err != nil {
+				return "", nil, fmt.Errorf("counter allocation failed: %w", err)
+			}
+		}
+		command = strings.ReplaceAll(command, match[0], allocated[match[1]])
+	}
+	return command, allocated, nil
 }
 
 // StartProcess creates and starts a process instance from a template
-func StartProcess(state *State, template *Template, name string, vars map[string]string) (*Instance, error) {
+func StartProcess(state *State, template *Template, name string, vars map[string]string, actor string) (*Instance, error) {
+	if template.Kind == KindJob {
+		return nil, fmt.Errorf("template %s is a job, run it with vp job run", template.ID)
+	}
+
 	// Check if instance already exists
 	if state.Instances[name] != nil {
 		return nil, fmt.Errorf("instance %s already exists", name)
 	}
 
+	project, _ := splitProjectKey(name)
 	inst := &Instance{
 		Name:      name,
-		Template:  template.ID,
+		Template:  projectKey(template.Project, template.ID),
 		Status:    "starting",
 		Resources: make(map[string]string),
+		Project:   project,
 	}
 
 	// Merge template defaults with provided vars
@@ -60,53 +157,17 @@ func StartProcess(state *State, template *Template, name string, vars map[string
 		finalVars[k] = v
 	}
 
-	// Phase 1: Allocate resources declared in template
-	for _, rtype := range template.Resources {
-		value, err := AllocateResource(state, rtype, finalVars[rtype])
-		if err != nil {
-			// Rollback all allocated resources
-			state.ReleaseResources(name)
-			inst.Status = "error"
-			inst.Error = fmt.Sprintf("resource allocation failed: %v", err)
-			return inst, err
-		}
-		inst.Resources[rtype] = value
-		state.ClaimResource(rtype, value, name)
-		finalVars[rtype] = value // Make available for interpolation
-	}
-
-	// Phase 2: Interpolate command
-	cmd := template.Command
-
-	// Replace ${var} syntax
-	for key, val := range finalVars {
-		cmd = strings.ReplaceAll(cmd, "${"+key+"}", val)
-	}
-
-	// Handle %counter syntax (auto-allocate if not already allocated)
-	re := regexp.MustCompile(`%(\w+)`)
-	for {
-		match := re.FindStringSubmatch(cmd)
-		if match == nil {
-			break
-		}
-		counter := match[1]
-
-		// Allocate counter resource
-		value, err := AllocateResource(state, counter, "")
-		if err != nil {
-			state.ReleaseResources(name)
-			inst.Status = "error"
-			inst.Error = fmt.Sprintf("counter allocation failed: %v", err)
-			return inst, err
-		}
-
-		cmd = strings.ReplaceAll(cmd, "%"+counter, value)
-		inst.Resources[counter] = value
-		state.ClaimResource(counter, value, name)
+	// Phase 1 and 2: Allocate resources and interpolate the command
+	cmd, allocated, err := resolveCommand(state, template.Command, template.Resources, finalVars, name, name, actor)
+	if err != nil {
+		inst.Status = "error"
+		inst.Error = err.Error()
+		return inst, err
 	}
-
+	inst.Resources = allocated
 	inst.Command = cmd
+	inst.Vars = finalVars
+	inst.Env = templateEnv(template, finalVars)
 
 	// Interpolate action if present
 	if template.Action != "" {
@@ -124,12 +185,41 @@ func StartProcess(state *State, template *Template, name string, vars map[string
 	// Phase 3: Start process
 	parts := strings.Fields(cmd)
 	if len(parts) == 0 {
-		state.ReleaseResources(name)
+		state.ReleaseResources(name, actor)
 		inst.Status = "error"
 		inst.Error = "empty command"
 		return inst, fmt.Errorf("empty command")
 	}
 
+	inst.TTY = template.TTY
+	err = launch(state, inst, parts, func(pid int) {
+		startedProcess(state, inst, pid, actor)
+	})
+	if err != nil {
+		state.ReleaseResources(name, actor)
+		inst.Status = "error"
+		inst.Error = fmt.Sprintf("failed to start: %v", err)
+		return inst, err
+	}
+
+	return inst, nil
+}
+
+// launch starts an instance's command in its own process group, with output
+// going to the instance log, and calls started with its PID. The instance is
+// marked stopped when that process exits. Commands that need a terminal run
+// on a PTY held by a tty host, which also reaps them.
+func launch(state *State, inst *Instance, parts []string, started func(pid int)) error {
+	inst.Marked = true // Both ways below run it with inst.environ()
+	if inst.TTY {
+		pid, err := StartTTY(inst.Name, parts, inst.Resources["workdir"], inst.environ())
+		if err != nil {
+			return err
+		}
+		started(pid)
+		return nil
+	}
+
 	proc := exec.Command(parts[0], parts[1:]...)
 	proc.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true, // Create new process group
@@ -139,95 +229,167 @@ func StartProcess(state *State, template *Template, name string, vars map[string
 	if workdir, ok := inst.Resources["workdir"]; ok && workdir != "" {
 		proc.Dir = workdir
 	}
-
-	if err := proc.Start(); err != nil {
-		state.ReleaseResources(name)
-		inst.Status = "error"
-		inst.Error = fmt.Sprintf("failed to start: %v", err)
-		return inst, err
+	proc.Env = inst.environ()
+	if os.Getuid() == 0 && inst.UID != 0 {
+		cred := &syscall.Credential{Uid: uint32(inst.UID), Gid: uint32(inst.GID)}
+		for _, g := range inst.Groups {
+			cred.Groups = append(cred.Groups, uint32(g))
+		}
+		proc.SysProcAttr.Credential = cred
 	}
 
-	inst.PID = proc.Process.Pid
-	inst.Status = "running"
-	inst.Started = time.Now().Unix()
-	inst.Managed = true // Processes started by us are managed
-
-	// Capture working directory
-	if cwd, err := os.Getwd(); err == nil {
-		inst.Cwd = cwd
+	// Capture stdout and stderr in the instance log
+	if logFile, err := openInstanceLog(inst.Name); err == nil {
+		proc.Stdout = logFile
+		proc.Stderr = logFile
+		defer logFile.Close() // The child keeps its own descriptor
 	}
 
-	state.Instances[name] = inst
-	state.Save()
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	started(proc.Process.Pid)
 
 	// Start a goroutine to wait for the process and reap it
+	name := inst.Name
 	go func() {
 		proc.Wait() // This reaps the zombie when process exits
 		// Process has exited, update status if instance still exists
+		state.mu.Lock()
+		defer state.mu.Unlock()
 		if inst, exists := state.Instances[name]; exists && inst.PID == proc.Process.Pid {
 			inst.Status = "stopped"
 			inst.PID = 0
-			state.Save()
+			state.SaveInstances(inst)
+			state.RecordEvent(actorReconciler, "exit", name, proc.ProcessState.String())
 		}
 	}()
 
-	return inst, nil
+	return nil
+}
+
+// instanceEnv marks the processes vp starts with the name of their instance,
+// so they can be told apart from others running the same command
+const instanceEnv = "VP_INSTANCE"
+
+// templateEnv returns a template's env settings interpolated with vars
+func templateEnv(tmpl *Template, vars map[string]string) map[string]string {
+	if len(tmpl.Env) == 0 {
+		return nil
+	}
+	env := make(map[string]string)
+	for k, v := range tmpl.Env {
+		env[k] = interpolate(v, vars)
+	}
+	return env
+}
+
+// environ returns the environment an instance's command runs with: vp's own
+// plus the instance's env settings and the VP_INSTANCE marker
+func (inst *Instance) environ() []string {
+	env := os.Environ()
+	for k, v := range inst.Env {
+		env = append(env, k+"="+v)
+	}
+	return append(env, instanceEnv+"="+inst.Name)
+}
+
+// interpolate replaces ${var} in s with the values of vars
+func interpolate(s string, vars map[string]string) string {
+	for key, val := range vars {
+		s = strings.ReplaceAll(s, "${"+key+"}", val)
+	}
+	return s
+}
+
+// startedProcess records a freshly started instance process
+func startedProcess(state *State, inst *Instance, pid int, actor string) {
+	inst.PID = pid
+	inst.Status = "running"
+	inst.Started = time.Now().Unix()
+	inst.Managed = true // Processes started by us are managed
+
+	// Capture working directory
+	if cwd, err := os.Getwd(); err == nil {
+		inst.Cwd = cwd
+	}
+
+	state.Instances[inst.Name] = inst
+	state.Save()
+	state.RecordEvent(actor, "start", inst.Name, fmt.Sprintf("PID %d: %s", inst.PID, inst.Command))
 }
 
 // StopProcess stops a running process instance
-func StopProcess(state *State, inst *Instance) error {
+func StopProcess(state *State, inst *Instance, actor string) error {
 	if inst.PID == 0 {
 		return fmt.Errorf("instance not running")
 	}
 
 	inst.Status = "stopping"
+	state.RecordEvent(actor, "stop", inst.Name, fmt.Sprintf("PID %d", inst.PID))
+
+	terminate(inst.PID)
 
+	inst.Status = "stopped"
+	inst.PID = 0
+	state.Save()
+
+	return nil
+}
+
+// terminate sends SIGTERM to a process and its group, and SIGKILL if it is
+// still running after 2 seconds
+func terminate(pid int) {
 	// Kill the entire process group (negative PID)
 	// Since we started with Setpgid:true, we need to kill the group
-	pgid := inst.PID
+	pgid := pid
 	err := syscall.Kill(-pgid, syscall.SIGTERM)
 	if err != nil {
 		// If process group kill fails, try individual process
-		process, err := os.FindProcess(inst.PID)
-		if err != nil {
-			inst.Status = "stopped"
-			inst.PID = 0
-			state.Save()
-			return nil
-		}
-		process.Signal(syscall.SIGTERM)
+		syscall.Kill(pid, syscall.SIGTERM)
 	}
 
 	// Wait up to 2 seconds for graceful shutdown
 	for i := 0; i < 20; i++ {
-		if !IsProcessRunning(inst.PID) {
+		if !IsProcessRunning(pid) {
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
 
 	// Force kill if still running
-	if IsProcessRunning(inst.PID) {
+	if IsProcessRunning(pid) {
 		syscall.Kill(-pgid, syscall.SIGKILL)
 		time.Sleep(100 * time.Millisecond)
 	}
 
 	// Reap any zombie processes by trying to wait
 	// This is best-effort since we may not be the parent
-	process, _ := os.FindProcess(inst.PID)
+	process, _ := os.FindProcess(pid)
 	if process != nil {
 		process.Wait()
 	}
+}
 
-	inst.Status = "stopped"
-	inst.PID = 0
-	state.Save()
+// DeleteInstance stops an instance if it's running, releases its resources
+// and removes it from state
+func DeleteInstance(state *State, inst *Instance, actor string) error {
+	if inst.Status == "running" {
+		if err := StopProcess(state, inst, actor); err != nil {
+			return err
+		}
+	}
+
+	state.ReleaseResources(inst.Name, actor)
+	state.DeleteInstance(inst.Name)
+	state.Save() // The released resources
+	state.RecordEvent(actor, "delete", inst.Name, "")
 
 	return nil
 }
 
 // RestartProcess restarts a stopped instance with the same resources and command
-func RestartProcess(state *State, inst *Instance) error {
+func RestartProcess(state *State, inst *Instance, actor string) error {
 	// Instance must be stopped
 	if inst.Status != "stopped" {
 		return fmt.Errorf("instance %s is not stopped (status: %s)", inst.Name, inst.Status)
@@ -247,50 +409,43 @@ func RestartProcess(state *State, inst *Instance) error {
 		}
 
 		// Claim it
-		state.ClaimResource(rtype, value, inst.Name)
+		state.ClaimResource(rtype, value, inst.Name, actor)
 	}
 
 	// Start the process with the stored command
-	parts := strings.Fields(inst.Command)
+	parts := inst.commandArgv()
 	if len(parts) == 0 {
-		state.ReleaseResources(inst.Name)
+		state.ReleaseResources(inst.Name, actor)
 		return fmt.Errorf("empty command")
 	}
 
-	proc := exec.Command(parts[0], parts[1:]...)
-	proc.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true, // Create new process group
-	}
-
-	if err := proc.Start(); err != nil {
-		state.ReleaseResources(inst.Name)
+	err := launch(state, inst, parts, func(pid int) {
+		restartedProcess(state, inst, pid, actor)
+	})
+	if err != nil {
+		state.ReleaseResources(inst.Name, actor)
 		inst.Status = "error"
 		inst.Error = fmt.Sprintf("failed to restart: %v", err)
 		state.Save()
 		return err
 	}
 
-	inst.PID = proc.Process.Pid
+	return nil
+}
+
+// restartedProcess records the new process of a restarted instance
+func restartedProcess(state *State, inst *Instance, pid int, actor string) {
+	inst.PID = pid
 	inst.Status = "running"
 	inst.Started = time.Now().Unix()
 	inst.Error = ""
+	inst.Restarts++
 	state.Save()
-
-	// Reap zombie when process exits
-	go func() {
-		proc.Wait()
-		if inst, exists := state.Instances[inst.Name]; exists && inst.PID == proc.Process.Pid {
-			inst.Status = "stopped"
-			inst.PID = 0
-			state.Save()
-		}
-	}()
-
-	return nil
+	state.RecordEvent(actor, "restart", inst.Name, fmt.Sprintf("PID %d", inst.PID))
 }
 
 // MonitorProcess adds an existing process to vp as monitored (not managed)
-func MonitorProcess(state *State, pid int, name string) (*Instance, error) {
+func MonitorProcess(state *State, pid int, name string, actor string) (*Instance, error) {
 	// Check if instance name already exists
 	if state.Instances[name] != nil {
 		return nil, fmt.Errorf("instance %s already exists", name)
@@ -337,6 +492,7 @@ func MonitorProcess(state *State, pid int, name string) (*Instance, error) {
 	inst := &Instance{
 		Name:      name,
 		Command:   cmdline,
+		Argv:      procInfo.Argv,
 		PID:       pid,
 		Status:    "running",
 		Resources: resources,
@@ -344,33 +500,42 @@ func MonitorProcess(state *State, pid int, name string) (*Instance, error) {
 		Managed:   managed, // true if we can send signals, false if different user
 		Started:   time.Now().Unix(),
 	}
+	inst.Project, _ = splitProjectKey(name)
 
 	// Claim resources (monitored processes DO use resources!)
 	for rtype, value := range resources {
-		state.ClaimResource(rtype, value, name)
+		state.ClaimResource(rtype, value, name, actor)
 	}
 
 	state.Instances[name] = inst
 	state.Save()
+	state.RecordEvent(actor, "monitor", name, fmt.Sprintf("PID %d: %s", pid, cmdline))
 
 	// Start monitoring goroutine to detect when process exits
-	go func() {
-		for {
-			time.Sleep(2 * time.Second)
-			if !IsProcessRunning(pid) {
-				if inst, exists := state.Instances[name]; exists && inst.PID == pid {
-					inst.Status = "stopped"
-					inst.PID = 0
-					state.Save()
-				}
-				break
-			}
-		}
-	}()
+	go awaitExit(state, name, pid)
 
 	return inst, nil
 }
 
+// awaitExit marks an instance stopped once a process vp didn't start, and so
+// can't wait for, exits
+func awaitExit(state *State, name string, pid int) {
+	for {
+		time.Sleep(2 * time.Second)
+		if !IsProcessRunning(pid) {
+			state.mu.Lock()
+			if inst, exists := state.Instances[name]; exists && inst.PID == pid {
+				inst.Status = "stopped"
+				inst.PID = 0
+				state.SaveInstances(inst)
+				state.RecordEvent(actorReconciler, "exit", name, fmt.Sprintf("PID %d", pid))
+			}
+			state.mu.Unlock()
+			return
+		}
+	}
+}
+
 // canManageProcess checks if we have permission to send signals to a process
 func canManageProcess(pid int) bool {
 	process, err := os.FindProcess(pid)
@@ -401,7 +566,7 @@ func IsProcessRunning(pid int) bool {
 }
 
 // DiscoverAndImportProcess discovers a process by PID and imports it as an instance
-func DiscoverAndImportProcess(state *State, pid int, name string) (*Instance, error) {
+func DiscoverAndImportProcess(state *State, pid int, name string, actor string) (*Instance, error) {
 	// Check if instance name already exists
 	if state.Instances[name] != nil {
 		return nil, fmt.Errorf("instance %s already exists", name)
@@ -416,23 +581,26 @@ func DiscoverAndImportProcess(state *State, pid int, name string) (*Instance, er
 	// Create instance
 	inst := &Instance{
 		Name:      name,
-		Template:  "discovered",
+		Template:  templateDiscovered,
 		Command:   procInfo.Cmdline,
+		Argv:      procInfo.Argv,
 		PID:       pid,
 		Status:    "running",
 		Resources: make(map[string]string),
 		Started:   time.Now().Unix(),
 		Managed:   false, // Discovered processes are not managed by default
 	}
+	inst.Project, _ = splitProjectKey(name)
 
 	state.Instances[name] = inst
 	state.Save()
+	state.RecordEvent(actor, "import", name, fmt.Sprintf("PID %d: %s", pid, inst.Command))
 
 	return inst, nil
 }
 
 // DiscoverAndImportProcessOnPort discovers a process listening on a port and imports it
-func DiscoverAndImportProcessOnPort(state *State, port int, name string) (*Instance, error) {
+func DiscoverAndImportProcessOnPort(state *State, port int, name string, actor string) (*Instance, error) {
 	// Check if instance name already exists
 	if state.Instances[name] != nil {
 		return nil, fmt.Errorf("instance %s already exists", name)
@@ -447,20 +615,23 @@ func DiscoverAndImportProcessOnPort(state *State, port int, name string) (*Insta
 	// Create instance
 	inst := &Instance{
 		Name:      name,
-		Template:  "discovered",
+		Template:  templateDiscovered,
 		Command:   procInfo.Cmdline,
+		Argv:      procInfo.Argv,
 		PID:       procInfo.PID,
 		Status:    "running",
 		Resources: make(map[string]string),
 		Started:   time.Now().Unix(),
 		Managed:   false, // Discovered processes are not managed by default
 	}
+	inst.Project, _ = splitProjectKey(name)
 
 	// Record the port as a resource
 	inst.Resources["tcpport"] = fmt.Sprintf("%d", port)
 
 	state.Instances[name] = inst
 	state.Save()
+	state.RecordEvent(actor, "import", name, fmt.Sprintf("PID %d on port %d: %s", inst.PID, port, inst.Command))
 
 	return inst, nil
 }
@@ -468,6 +639,8 @@ func DiscoverAndImportProcessOnPort(state *State, port int, name string) (*Insta
 // DiscoverProcesses discovers running processes on the system
 // If portsOnly is true, only returns processes listening on ports
 func DiscoverProcesses(state *State, portsOnly bool) ([]map[string]interface{}, error) {
+	defer discoveryStats.Observe(time.Now())
+
 	var result []map[string]interface{}
 
 	// Read all PIDs from /proc
@@ -570,7 +743,11 @@ func DiscoverProcesses(state *State, portsOnly bool) ([]map[string]interface{},
 // 3. If so, check if it uses the same port
 // 4. If ports match, update the state to running and the PID
 func MatchAndUpdateInstances(state *State) error {
+	// Instances whose status changed; only these are persisted at the end
+	var changed []*Instance
+
 	// Step 1: Check if existing PIDs are still running and update CPU time
+	var children map[int][]int
 	for _, inst := range state.Instances {
 		if inst.Status == "running" {
 			if IsProcessRunning(inst.PID) {
@@ -578,16 +755,33 @@ func MatchAndUpdateInstances(state *State) error {
 				if procInfo, err := ReadProcessInfo(inst.PID); err == nil {
 					inst.CPUTime = procInfo.CPUTime
 				}
+
+				// Resource usage of the process and everything it spawned
+				if children == nil {
+					children, _ = GetChildrenMap()
+				}
+				if tree, err := BuildProcessTree(children, inst.PID); err == nil {
+					inst.Stats = &tree.ProcessStats
+					inst.Totals = tree.Totals()
+				}
 			} else {
 				// Process stopped
 				inst.Status = "stopped"
 				inst.PID = 0
 				inst.CPUTime = 0
+				inst.Stats = nil
+				inst.Totals = nil
+				changed = append(changed, inst)
+				state.RecordEvent(actorReconciler, "status", inst.Name, "stopped")
 			}
 		}
 	}
 
 	// Step 2: For stopped instances, try to find matching processes
+	// Ports are compared below, so a process that just started listening
+	// must not be missed because of a cached port map
+	invalidatePortCache()
+
 	// Discover all processes (not just those with ports)
 	processes, err := DiscoverProcesses(state, false)
 	if err != nil {
@@ -596,6 +790,11 @@ func MatchAndUpdateInstances(state *State) error {
 
 	// Track which PIDs have been matched to prevent multiple instances claiming the same PID
 	matchedPIDs := make(map[int]bool)
+	for _, inst := range state.Instances {
+		if inst.Status == "running" && inst.PID > 0 {
+			matchedPIDs[inst.PID] = true
+		}
+	}
 
 	// For each stopped instance, try to find a matching process
 	for _, inst := range state.Instances {
@@ -603,13 +802,12 @@ func MatchAndUpdateInstances(state *State) error {
 			continue
 		}
 
-		// Extract expected process name from instance command
-		expectedName := extractProcessName(inst.Command)
-		if expectedName == "" {
+		if len(inst.commandArgv()) == 0 {
 			continue
 		}
+		m := newInstanceMatcher(state, inst)
 
-		// Try to find a matching process
+		var candidates []*ProcessInfo
 		for _, proc := range processes {
 			pid, ok := proc["pid"].(int)
 			if !ok {
@@ -626,50 +824,27 @@ func MatchAndUpdateInstances(state *State) error {
 			if err != nil {
 				continue
 			}
-
-			// Check if process name matches
-			if procInfo.Name != expectedName {
-				continue
-			}
-
-			// If instance has ports, verify they match
-			portsMatch := true
-			if len(inst.Resources) > 0 {
-				for resType, resValue := range inst.Resources {
-					if resType == "tcpport" || resType == "port" {
-						expectedPort, _ := strconv.Atoi(resValue)
-						if expectedPort > 0 {
-							hasPort := false
-							for _, port := range procInfo.Ports {
-								if port == expectedPort {
-									hasPort = true
-									break
-								}
-							}
-							if !hasPort {
-								portsMatch = false
-								break
-							}
-						}
-					}
-				}
+			if m.matches(procInfo) {
+				candidates = append(candidates, procInfo)
 			}
+		}
 
-			if portsMatch {
-				// Match found! Update instance and mark PID as matched
-				inst.PID = pid
-				inst.Status = "running"
-				inst.Started = time.Now().Unix()
-				inst.CPUTime = procInfo.CPUTime
-				matchedPIDs[pid] = true
-				state.Save()
-				break // Move to next instance
-			}
+		if procInfo := m.best(candidates); procInfo != nil {
+			// Match found! Update instance and mark PID as matched
+			inst.PID = procInfo.PID
+			inst.Status = "running"
+			inst.Started = time.Now().Unix()
+			inst.CPUTime = procInfo.CPUTime
+			matchedPIDs[procInfo.PID] = true
+			changed = append(changed, inst)
+			state.RecordEvent(actorReconciler, "status", inst.Name, fmt.Sprintf("running (matched PID %d)", procInfo.PID))
 		}
 	}
 
-	state.Save()
-	return nil
+	if len(changed) == 0 {
+		return nil
+	}
+	return state.SaveInstances(changed...)
 }
 
 // extractProcessName extracts the process name from a command string
@@ -580,3 +580,35 @@ func BenchmarkMatchAndUpdateInstances(b *testing.B) {
 		MatchAndUpdateInstances(state)
 	}
 }
+
+// TestResolveCommand tests resource allocation and interpolation of a
+// template command, and that a failed allocation releases what was claimed
+func TestResolveCommand(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	s := &State{
+		Instances: make(map[string]*Instance),
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types: map[string]*ResourceType{
+			"slot": {Name: "slot", Counter: true, Start: 1, End: 2},
+			"gpu":  {Name: "gpu", Counter: true, Start: 0, End: 0},
+		},
+	}
+
+	vars := map[string]string{"name": "w"}
+	cmd, allocated, err := resolveCommand(s, "run ${name} --slot ${slot} --also %slot --gpu %gpu", []string{"slot"}, vars, "a", "a", "test")
+	if err != nil {
+		t.Fatalf("resolveCommand failed: %v", err)
+	}
+	if cmd != "run w --slot 1 --also 1 --gpu 0" || len(allocated) != 2 || vars["gpu"] != "0" {
+		t.Errorf("Unexpected command %q with %v", cmd, allocated)
+	}
+
+	// The only gpu is taken now, so b's allocation fails and frees its slot
+	if _, _, err := resolveCommand(s, "run %gpu", []string{"slot"}, map[string]string{}, "b", "b", "test"); err == nil {
+		t.Fatalf("Expected the gpu allocation to fail")
+	}
+	if len(s.Resources) != 2 {
+		t.Errorf("Expected only a's claims, got %v", s.Resources)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -44,11 +45,28 @@ type ProcessInfo struct {
 	PPID    int               `json:"ppid"`   // Parent process ID
 	Name    string            `json:"name"`   // Process name
 	Cmdline string            `json:"cmdline"` // Full command line
+	Argv    []string          `json:"argv"`   // Exact arguments, which Cmdline joins with spaces
 	Exe     string            `json:"exe"`    // Executable path
 	Cwd     string            `json:"cwd"`    // Working directory
 	Environ map[string]string `json:"environ"` // Environment variables
 	Ports   []int             `json:"ports"`  // TCP ports this process listens on
 	CPUTime float64           `json:"cputime"` // CPU time in seconds
+	ProcessStats
+}
+
+// ProcessStats contains the state and resource usage of a process. State,
+// StartTime, Threads and RSS come from /proc/[pid]/stat with every
+// ReadProcessInfo; the rest costs extra reads and is filled by ReadProcessStats.
+type ProcessStats struct {
+	State      string  `json:"state,omitempty"`       // R (running), S (sleeping), D, Z, T...
+	StartTime  int64   `json:"start_time,omitempty"`  // Unix timestamp
+	Threads    int     `json:"threads,omitempty"`     // Number of threads
+	RSS        int64   `json:"rss,omitempty"`         // Resident set size in bytes
+	PSS        int64   `json:"pss,omitempty"`         // Proportional set size in bytes (0 if unreadable)
+	ReadBytes  int64   `json:"read_bytes,omitempty"`  // Bytes read from storage
+	WriteBytes int64   `json:"write_bytes,omitempty"` // Bytes written to storage
+	FDs        int     `json:"fds,omitempty"`         // Open file descriptors (-1 if unreadable)
+	CPUPercent float64 `json:"cpu_percent"`           // CPU usage since the previous sample
 }
 
 // ShellNames contains common shell executable names
@@ -63,6 +81,13 @@ var ShellNames = map[string]bool{
 	"csh":     true,
 }
 
+// invalidatePortCache makes the next port lookup read /proc afresh
+func invalidatePortCache() {
+	globalPortCache.Lock()
+	globalPortCache.timestamp = time.Time{}
+	globalPortCache.Unlock()
+}
+
 // buildPortToProcessMap builds a map of all listening ports to PIDs (optimized version)
 func buildPortToProcessMap() (map[int][]int, error) {
 	// Check cache first
@@ -264,22 +289,24 @@ func ReadProcessInfo(pid int) (*ProcessInfo, error) {
 		info.PPID, _ = strconv.Atoi(fields[1]) // Third field is PPID
 	}
 
-	// Extract CPU time (utime + stime)
-	// Fields 14 and 15 are utime and stime (in clock ticks)
-	// After the name, they are at indices 11 and 12
-	if len(fields) >= 13 {
-		utime, _ := strconv.ParseInt(fields[11], 10, 64)
-		stime, _ := strconv.ParseInt(fields[12], 10, 64)
-		// Convert from clock ticks to seconds (typically 100 ticks/second on Linux)
-		info.CPUTime = float64(utime+stime) / 100.0
+	info.CPUTime = statCPUTime(fields)
+
+	// State (field 3), num_threads (20), starttime (22) and rss (24, in pages)
+	if len(fields) >= 1 {
+		info.State = fields[0]
+	}
+	if len(fields) >= 22 {
+		info.Threads, _ = strconv.Atoi(fields[17])
+		startTicks, _ := strconv.ParseInt(fields[19], 10, 64)
+		info.StartTime = bootTime() + startTicks/clockTicks()
+		rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+		info.RSS = rssPages * int64(os.Getpagesize())
 	}
 
 	// Read command line
-	cmdlineData, err := os.ReadFile(filepath.Join(procDir, "cmdline"))
-	if err == nil {
-		// cmdline is null-separated, convert to space-separated
-		cmdline := strings.ReplaceAll(string(cmdlineData), "\x00", " ")
-		info.Cmdline = strings.TrimSpace(cmdline)
+	if argv, err := ReadArgv(pid); err == nil {
+		info.Argv = argv
+		info.Cmdline = strings.TrimSpace(strings.Join(argv, " "))
 	}
 
 	// Read executable path (skip for kernel threads to save I/O)
@@ -326,6 +353,20 @@ func ReadProcessInfo(pid int) (*ProcessInfo, error) {
 	return info, nil
 }
 
+// ReadArgv reads the exact arguments of a process from /proc/<pid>/cmdline,
+// keeping arguments that contain spaces intact
+func ReadArgv(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	cmdline := strings.TrimSuffix(string(data), "\x00")
+	if cmdline == "" {
+		return nil, nil // Kernel thread or zombie
+	}
+	return strings.Split(cmdline, "\x00"), nil
+}
+
 // GetParentChain traverses the parent process chain up to init (PID 1)
 func GetParentChain(pid int) ([]ProcessInfo, error) {
 	var chain []ProcessInfo
@@ -358,6 +399,37 @@ func GetParentChain(pid int) ([]ProcessInfo, error) {
 	return chain, nil
 }
 
+// GetChildrenMap maps every PID to its direct children by reading the
+// parent of each process in /proc
+func GetChildrenMap() (map[int][]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		statData, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		statStr := string(statData)
+		lastParen := strings.LastIndex(statStr, ")")
+		if lastParen == -1 {
+			continue
+		}
+		if fields := strings.Fields(statStr[lastParen+1:]); len(fields) >= 2 {
+			ppid, _ := strconv.Atoi(fields[1])
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+	return children, nil
+}
+
 // FindLaunchScript finds the "launch script" in the parent chain
 // This is typically the first child of a shell (e.g., "bun dev" launched from bash)
 func FindLaunchScript(chain []ProcessInfo) *ProcessInfo {
@@ -465,3 +537,179 @@ func DiscoverProcessOnPort(port int) (*ProcessInfo, error) {
 
 	return procInfo, nil
 }
+
+
+// clockTicks returns the kernel's clock ticks per second (sysconf(_SC_CLK_TCK)),
+// read from the AT_CLKTCK entry of the auxiliary vector like libc does
+var clockTicks = sync.OnceValue(func() int64 {
+	const atClkTck = 17
+
+	data, err := os.ReadFile("/proc/self/auxv")
+	if err == nil {
+		// Pairs of native words (key, value)
+		word := strconv.IntSize / 8
+		read := func(b []byte) uint64 {
+			if word == 4 {
+				return uint64(binary.NativeEndian.Uint32(b))
+			}
+			return binary.NativeEndian.Uint64(b)
+		}
+		for i := 0; i+2*word <= len(data); i += 2 * word {
+			if read(data[i:]) == atClkTck {
+				if v := int64(read(data[i+word:])); v > 0 {
+					return v
+				}
+			}
+		}
+	}
+	return 100 // The value on virtually every Linux system
+})
+
+// bootTime returns the system boot time as a Unix timestamp (btime in /proc/stat)
+var bootTime = sync.OnceValue(func() int64 {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "btime" {
+			btime, _ := strconv.ParseInt(fields[1], 10, 64)
+			return btime
+		}
+	}
+	return 0
+})
+
+// statCPUTime returns the CPU seconds (utime + stime) from the fields of
+// /proc/<pid>/stat after the name, where they are at indices 11 and 12
+func statCPUTime(fields []string) float64 {
+	if len(fields) < 13 {
+		return 0
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	return float64(utime+stime) / float64(clockTicks())
+}
+
+// readCPUTime reads the CPU seconds of a process from /proc, bypassing
+// globalProcessCache
+func readCPUTime(pid int) (float64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	stat := string(data)
+	lastParen := strings.LastIndex(stat, ")")
+	if lastParen == -1 {
+		return 0, fmt.Errorf("invalid stat format")
+	}
+	return statCPUTime(strings.Fields(stat[lastParen+1:])), nil
+}
+
+// cpuSample is a previous CPU time reading of a process
+type cpuSample struct {
+	startTime int64   // Distinguishes reused PIDs
+	cpuTime   float64 // CPU seconds at the sample
+	at        time.Time
+	percent   float64 // Usage computed at the sample
+}
+
+// minCPUWindow is the shortest time a CPU percentage is measured over.
+// Callers reading sooner after the previous sample, such as top right after
+// the reconciler, get that sample's percentage.
+const minCPUWindow = time.Second
+
+// cpuSampler computes CPU percentages by diffing CPU time between samples
+type cpuSampler struct {
+	sync.Mutex
+	samples map[int]cpuSample // pid -> last sample
+	pruned  time.Time         // Last time stale samples were dropped
+}
+
+var globalCPUSampler = &cpuSampler{samples: make(map[int]cpuSample)}
+
+// Percent returns the CPU usage of a process since its previous sample, or
+// its average since start on the first sample, given its CPU time read at
+// now. 100 means one full core.
+func (c *cpuSampler) Percent(pid int, startTime int64, cpuTime float64, now time.Time) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	if now.Sub(c.pruned) > time.Minute {
+		// Forget exited processes
+		for pid, sample := range c.samples {
+			if now.Sub(sample.at) > time.Minute {
+				delete(c.samples, pid)
+			}
+		}
+		c.pruned = now
+	}
+
+	sample := cpuSample{startTime: startTime, cpuTime: cpuTime, at: now}
+	prev, ok := c.samples[pid]
+	switch {
+	case ok && prev.startTime == startTime && now.Sub(prev.at) < minCPUWindow:
+		return prev.percent
+	case ok && prev.startTime == startTime:
+		sample.percent = (cpuTime - prev.cpuTime) / now.Sub(prev.at).Seconds() * 100
+	case startTime > 0 && now.Unix() > startTime:
+		sample.percent = cpuTime / float64(now.Unix()-startTime) * 100
+	}
+	c.samples[pid] = sample
+	return sample.percent
+}
+
+// ReadProcessStats returns the full resource usage of a process: what
+// ReadProcessInfo reads plus PSS, IO, open fds and CPU percentage. Fields
+// that belong to other users' processes and can't be read are left empty.
+func ReadProcessStats(pid int) (*ProcessStats, error) {
+	info, err := ReadProcessInfo(pid)
+	if err != nil {
+		return nil, err
+	}
+	stats := info.ProcessStats
+	procDir := fmt.Sprintf("/proc/%d", pid)
+
+	// PSS from smaps_rollup (kB)
+	if data, err := os.ReadFile(filepath.Join(procDir, "smaps_rollup")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "Pss:" {
+				kb, _ := strconv.ParseInt(fields[1], 10, 64)
+				stats.PSS = kb * 1024
+				break
+			}
+		}
+	}
+
+	// Storage IO
+	if data, err := os.ReadFile(filepath.Join(procDir, "io")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			switch fields[0] {
+			case "read_bytes:":
+				stats.ReadBytes, _ = strconv.ParseInt(fields[1], 10, 64)
+			case "write_bytes:":
+				stats.WriteBytes, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		}
+	}
+
+	stats.FDs = -1
+	if fds, err := os.ReadDir(filepath.Join(procDir, "fd")); err == nil {
+		stats.FDs = len(fds)
+	}
+
+	// The cached info may be up to a second old, too old to time a sample by
+	cpu, err := readCPUTime(pid)
+	if err != nil {
+		cpu = info.CPUTime
+	}
+	stats.CPUPercent = globalCPUSampler.Percent(pid, info.StartTime, cpu, time.Now())
+	return &stats, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestReadProcessStats tests resource usage of the test process itself
+func TestReadProcessStats(t *testing.T) {
+	if clockTicks() <= 0 {
+		t.Fatalf("Expected positive clock ticks, got %d", clockTicks())
+	}
+
+	// Burn a little CPU so the percentage has something to measure
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+	}
+
+	stats, err := ReadProcessStats(os.Getpid())
+	if err != nil {
+		t.Fatalf("ReadProcessStats failed: %v", err)
+	}
+
+	if stats.State == "" {
+		t.Errorf("Expected a state letter")
+	}
+	if stats.RSS <= 0 {
+		t.Errorf("Expected positive RSS, got %d", stats.RSS)
+	}
+	if stats.Threads < 1 {
+		t.Errorf("Expected at least one thread, got %d", stats.Threads)
+	}
+	if stats.FDs < 3 {
+		t.Errorf("Expected at least stdin/stdout/stderr, got %d fds", stats.FDs)
+	}
+	if age := time.Now().Unix() - stats.StartTime; age < 0 || age > 3600 {
+		t.Errorf("Expected a recent start time, got %d (%ds ago)", stats.StartTime, age)
+	}
+	if stats.CPUPercent < 0 {
+		t.Errorf("Expected non-negative CPU percentage, got %f", stats.CPUPercent)
+	}
+}
+
+// TestCPUSampler tests percentages between samples, and that a sample
+// sooner than minCPUWindow after the previous one gets its percentage
+func TestCPUSampler(t *testing.T) {
+	c := &cpuSampler{samples: make(map[int]cpuSample)}
+	t0 := time.Unix(1000, 0)
+
+	steps := []struct {
+		after time.Duration
+		cpu   float64
+		want  float64
+	}{
+		{0, 10, 10},                         // Average over the 100s since start
+		{2 * time.Second, 10.5, 25},         // Half a core-second in 2s
+		{2300 * time.Millisecond, 10.6, 25}, // Too soon for a new window
+		{4 * time.Second, 11.5, 50},         // Measured from the last window
+	}
+	for _, s := range steps {
+		if got := c.Percent(42, 900, s.cpu, t0.Add(s.after)); got != s.want {
+			t.Errorf("Percent at +%s with %.1fs = %.1f, want %.1f", s.after, s.cpu, got, s.want)
+		}
+	}
+
+	// A reused PID starts over
+	if got := c.Percent(42, 1000, 1, t0.Add(5*time.Second)); got != 20 {
+		t.Errorf("Expected the new process's average of 20%%, got %.1f", got)
+	}
+
+	if cpu, err := readCPUTime(os.Getpid()); err != nil || cpu <= 0 {
+		t.Errorf("Expected CPU time of the test process, got %f (%v)", cpu, err)
+	}
+}
+
+// TestProcessTree tests that a shell's children are found and summed
+func TestProcessTree(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30 & wait")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	defer func() {
+		// Kill the sleeps first so wait returns
+		children, _ := GetChildrenMap()
+		for _, pid := range children[cmd.Process.Pid] {
+			if p, err := os.FindProcess(pid); err == nil {
+				p.Kill()
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Wait for both sleeps to be forked
+	var tree *ProcessTree
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		children, err := GetChildrenMap()
+		if err != nil {
+			t.Fatalf("GetChildrenMap failed: %v", err)
+		}
+		if len(children[cmd.Process.Pid]) == 2 {
+			tree, err = BuildProcessTree(children, cmd.Process.Pid)
+			if err != nil {
+				t.Fatalf("BuildProcessTree failed: %v", err)
+			}
+			break
+		}
+	}
+	if tree == nil {
+		t.Fatalf("Expected the shell to have 2 children")
+	}
+
+	totals := tree.Totals()
+	if totals.Processes != 3 || len(tree.Children) != 2 {
+		t.Errorf("Expected 3 processes with 2 children, got %d and %d", totals.Processes, len(tree.Children))
+	}
+	if totals.RSS <= tree.RSS {
+		t.Errorf("Expected tree RSS %d to exceed the shell's %d", totals.RSS, tree.RSS)
+	}
+}
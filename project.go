@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Project is a namespace with its own instances, templates and counters.
+// Resource types and the resource claim table are shared across projects
+// unless the project is isolated.
+type Project struct {
+	Name     string `json:"name"`
+	Isolated bool   `json:"isolated,omitempty"` // Ignore other projects' resource claims when allocating
+}
+
+// currentProject is the project selected with -p/--project or VP_PROJECT.
+// The empty string is the default project.
+var currentProject = os.Getenv("VP_PROJECT")
+
+// projectKey returns the state map key for a name within a project.
+// Names that already contain a project prefix are returned unchanged.
+func projectKey(project, name string) string {
+	if project == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return project + "/" + name
+}
+
+// qualifiedKey returns the state key for a name a user gave within a
+// project. A name with a project prefix of its own is only accepted without
+// one, as it would otherwise silently name an instance of another project.
+func qualifiedKey(project, name string) (string, error) {
+	if project != "" && strings.Contains(name, "/") {
+		return "", fmt.Errorf("name %q contains '/', which is only allowed without a project", name)
+	}
+	return projectKey(project, name), nil
+}
+
+// splitProjectKey splits a state map key into project and name
+func splitProjectKey(key string) (project, name string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// parseProjectFlag strips -p/--project from the front of args and returns the
+// selected project with the remaining arguments
+func parseProjectFlag(args []string) (string, []string) {
+	project := currentProject
+	for len(args) > 0 {
+		switch {
+		case (args[0] == "-p" || args[0] == "--project") && len(args) > 1:
+			project = args[1]
+			args = args[2:]
+		case strings.HasPrefix(args[0], "--project="):
+			project = strings.TrimPrefix(args[0], "--project=")
+			args = args[1:]
+		default:
+			return project, args
+		}
+	}
+	return project, args
+}
+
+// cliKey returns the state key for a name given on the command line in the
+// current project, exiting if it can't be one
+func cliKey(name string) string {
+	key, err := qualifiedKey(currentProject, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return key
+}
+
+// LookupTemplate finds a template visible in a project: the project's own
+// template first, then the shared one
+func (s *State) LookupTemplate(project, id string) *Template {
+	if tmpl := s.Templates[projectKey(project, id)]; tmpl != nil {
+		return tmpl
+	}
+	return s.Templates[id]
+}
+
+// ProjectTemplates returns the templates visible in a project keyed by state key
+func (s *State) ProjectTemplates(project string) map[string]*Template {
+	result := make(map[string]*Template)
+	for key, tmpl := range s.Templates {
+		if tmpl.Project == "" || tmpl.Project == project {
+			result[key] = tmpl
+		}
+	}
+	return result
+}
+
+// ProjectInstances returns the instances belonging to a project keyed by state key
+func (s *State) ProjectInstances(project string) map[string]*Instance {
+	result := make(map[string]*Instance)
+	for key, inst := range s.Instances {
+		if inst.Project == project {
+			result[key] = inst
+		}
+	}
+	return result
+}
+
+// ProjectNames returns all known project names, including the default ("")
+func (s *State) ProjectNames() []string {
+	seen := map[string]bool{"": true}
+	for name := range s.Projects {
+		seen[name] = true
+	}
+	for _, inst := range s.Instances {
+		seen[inst.Project] = true
+	}
+	for _, tmpl := range s.Templates {
+		seen[tmpl.Project] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// claimKey returns the claim table key for a resource value claimed by
+// owner. Isolated projects keep their claims under their own prefix, so they
+// neither see nor overwrite other projects' claims of the same value.
+func (s *State) claimKey(rtype, value, owner string) string {
+	key := rtype + ":" + value
+	if project, _ := splitProjectKey(owner); s.isolated(project) {
+		return project + "/" + key
+	}
+	return key
+}
+
+// claimedElsewhere reports whether a resource value is already claimed by an
+// instance other than owner. Isolated projects only see their own claims.
+func (s *State) claimedElsewhere(rtype, value, owner string) (string, bool) {
+	res := s.Resources[s.claimKey(rtype, value, owner)]
+	if res == nil || res.Owner == owner {
+		return "", false
+	}
+	return res.Owner, true
+}
+
+// isolated reports whether a project opted out of the shared claim table
+func (s *State) isolated(project string) bool {
+	p := s.Projects[project]
+	return p != nil && p.Isolated
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+// TestProjectResourceClaims tests that counters are per project while the
+// claim table is shared, unless a project is isolated
+func TestProjectResourceClaims(t *testing.T) {
+	state := &State{
+		Instances: make(map[string]*Instance),
+		Templates: make(map[string]*Template),
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types: map[string]*ResourceType{
+			"slot": {Name: "slot", Counter: true, Start: 1, End: 3},
+		},
+		Projects: make(map[string]*Project),
+	}
+
+	first, err := AllocateResource(state, "slot", "", "alpha/web")
+	if err != nil {
+		t.Fatalf("AllocateResource failed: %v", err)
+	}
+	state.ClaimResource("slot", first, "alpha/web", actorReconciler)
+
+	// A different project has its own counter but must skip the shared claim
+	second, err := AllocateResource(state, "slot", "", "beta/web")
+	if err != nil {
+		t.Fatalf("AllocateResource failed: %v", err)
+	}
+	if second == first {
+		t.Errorf("Expected beta to skip slot %s claimed by alpha", first)
+	}
+	if state.Counters["alpha/slot"] == 0 || state.Counters["beta/slot"] == 0 {
+		t.Errorf("Expected per-project counters, got %v", state.Counters)
+	}
+
+	if _, err := AllocateResource(state, "slot", first, "beta/api"); err == nil {
+		t.Errorf("Expected explicit request for claimed slot %s to fail", first)
+	}
+
+	// Isolated projects ignore other projects' claims, without taking them over
+	state.Projects["gamma"] = &Project{Name: "gamma", Isolated: true}
+	if _, err := AllocateResource(state, "slot", first, "gamma/web"); err != nil {
+		t.Errorf("Expected isolated project to allocate slot %s, got: %v", first, err)
+	}
+	state.ClaimResource("slot", first, "gamma/web", actorReconciler)
+	if _, err := AllocateResource(state, "slot", first, "gamma/api"); err == nil {
+		t.Errorf("Expected gamma's own claim of slot %s to count", first)
+	}
+	state.ReleaseResources("gamma/web", actorReconciler)
+	if res := state.Resources["slot:"+first]; res == nil || res.Owner != "alpha/web" {
+		t.Errorf("Expected alpha to keep slot %s, got %+v", first, res)
+	}
+}
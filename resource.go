@@ -70,8 +70,9 @@ func DefaultResourceTypes() map[string]*ResourceType {
 	}
 }
 
-// AllocateResource allocates a resource of the given type
-func AllocateResource(state *State, rtype string, requestedValue string) (string, error) {
+// AllocateResource allocates a resource of the given type for owner.
+// Counters are kept per project; values claimed by other instances are skipped.
+func AllocateResource(state *State, rtype string, requestedValue string, owner string) (string, error) {
 	rt := state.Types[rtype]
 	if rt == nil {
 		return "", fmt.Errorf("unknown resource type: %s", rtype)
@@ -81,7 +82,9 @@ func AllocateResource(state *State, rtype string, requestedValue string) (string
 
 	if rt.Counter && requestedValue == "" {
 		// Auto-increment counter
-		current := state.Counters[rtype]
+		project, _ := splitProjectKey(owner)
+		counterKey := projectKey(project, rtype)
+		current := state.Counters[counterKey]
 		if current == 0 {
 			current = rt.Start
 		}
@@ -89,8 +92,11 @@ func AllocateResource(state *State, rtype string, requestedValue string) (string
 		found := false
 		for v := current; v <= rt.End; v++ {
 			value = strconv.Itoa(v)
+			if _, claimed := state.claimedElsewhere(rtype, value, owner); claimed {
+				continue
+			}
 			if CheckResource(rt, value) {
-				state.Counters[rtype] = v + 1
+				state.Counters[counterKey] = v + 1
 				found = true
 				break
 			}
@@ -107,6 +113,9 @@ func AllocateResource(state *State, rtype string, requestedValue string) (string
 			return "", fmt.Errorf("resource type %s requires explicit value", rtype)
 		}
 
+		if claimer, claimed := state.claimedElsewhere(rtype, value, owner); claimed {
+			return "", fmt.Errorf("%s %s already claimed by %s", rtype, value, claimer)
+		}
 		if !CheckResource(rt, value) {
 			return "", fmt.Errorf("%s %s not available", rtype, value)
 		}
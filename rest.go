@@ -0,0 +1,455 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// APIError is the JSON body returned by the resource-oriented routes on failure
+type APIError struct {
+	Code    string `json:"code"`    // not_found|conflict|bad_request|method_not_allowed|internal
+	Message string `json:"message"` // Human-readable detail
+}
+
+// writeJSON writes v as JSON with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a structured JSON error
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	code := map[int]string{
+		http.StatusBadRequest:          "bad_request",
+		http.StatusNotFound:            "not_found",
+		http.StatusConflict:            "conflict",
+		http.StatusMethodNotAllowed:    "method_not_allowed",
+		http.StatusInternalServerError: "internal",
+	}[status]
+	if code == "" {
+		code = strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+	writeJSON(w, status, map[string]APIError{
+		"error": {Code: code, Message: fmt.Sprintf(format, args...)},
+	})
+}
+
+// methodNotAllowed writes a 405 with the Allow header set
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed, use %s", allowed)
+}
+
+// instanceVerbs are the custom methods accepted as POST /api/instances/{name}:verb
+var instanceVerbs = map[string]bool{"start": true, "stop": true, "restart": true, "exec": true, "signal": true, "reload": true, "adopt": true}
+
+// parseResourcePath splits the path after prefix into a state key and an
+// optional ":verb" suffix. Keys may contain '/' (project prefix), unless
+// ?project= qualifies the name the same way -p does on the CLI.
+func parseResourcePath(r *http.Request, prefix string) (key, verb string, err error) {
+	key = strings.TrimPrefix(r.URL.Path, prefix)
+	if i := strings.LastIndex(key, ":"); i >= 0 && instanceVerbs[key[i+1:]] {
+		key, verb = key[:i], key[i+1:]
+	}
+	key, err = qualifiedKey(r.URL.Query().Get("project"), key)
+	return key, verb, err
+}
+
+// handleInstanceResource serves /api/instances/{name}, /api/instances/{name}:{verb}
+// /api/instances/{name}/metrics and /api/instances/{name}/tty
+func handleInstanceResource(w http.ResponseWriter, r *http.Request) {
+	// /api/instances/{name}/metrics is the instance's usage history,
+	// /api/instances/{name}/tty its terminal
+	path := strings.TrimPrefix(r.URL.Path, "/api/instances/")
+	if key, ok := strings.CutSuffix(path, "/metrics"); ok && key != "" {
+		if key, err := qualifiedKey(r.URL.Query().Get("project"), key); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+		} else {
+			handleInstanceHistory(w, r, key)
+		}
+		return
+	}
+	if key, ok := strings.CutSuffix(path, "/tty"); ok && key != "" {
+		if key, err := qualifiedKey(r.URL.Query().Get("project"), key); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+		} else {
+			handleInstanceTTY(w, r, key)
+		}
+		return
+	}
+
+	name, verb, err := parseResourcePath(r, "/api/instances/")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if name == "" {
+		writeError(w, http.StatusNotFound, "instance name required")
+		return
+	}
+	actor := httpActor(r)
+
+	if verb != "" {
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		// adopt creates the instance, so there is none to look up yet
+		if verb == "adopt" {
+			var req adoptRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+				return
+			}
+			adoptInstance(w, r, name, req)
+			return
+		}
+		if !authorize(w, r, verb, "instance", name) {
+			return
+		}
+
+		inst := state.Instances[name]
+		if inst == nil {
+			writeError(w, http.StatusNotFound, "instance %s not found", name)
+			return
+		}
+		if verb == "exec" {
+			handleInstanceExec(w, r, inst, actor)
+			return
+		}
+
+		switch verb {
+		case "signal":
+			var req struct {
+				Signal string `json:"signal"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+				return
+			}
+			sig, err := parseSignal(req.Signal)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			if err := SignalProcess(state, inst, sig, actor); err != nil {
+				writeError(w, http.StatusConflict, "%v", err)
+				return
+			}
+		case "reload":
+			if err := ReloadProcess(state, inst, actor); err != nil {
+				writeError(w, http.StatusConflict, "%v", err)
+				return
+			}
+		case "stop":
+			if err := StopProcess(state, inst, actor); err != nil {
+				writeError(w, http.StatusConflict, "%v", err)
+				return
+			}
+			state.ReleaseResources(name, actor)
+			state.Save()
+		case "start", "restart":
+			var flags restartFlags
+			if verb == "restart" && r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&flags); err != nil && err != io.EOF {
+					writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+					return
+				}
+			}
+			timeout, err := flags.timeout()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			if flags.ZeroDowntime {
+				if err := RollingRestart(state, inst, timeout, actor); err != nil {
+					writeError(w, http.StatusConflict, "%v", err)
+					return
+				}
+				break
+			}
+
+			// restart on a running instance stops it first
+			if verb == "restart" && inst.Status == "running" {
+				if err := StopProcess(state, inst, actor); err != nil {
+					writeError(w, http.StatusConflict, "%v", err)
+					return
+				}
+				state.ReleaseResources(name, actor)
+			}
+			if err := RestartProcess(state, inst, actor); err != nil {
+				writeError(w, http.StatusConflict, "%v", err)
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, inst)
+		return
+	}
+
+	verb = map[string]string{"GET": VerbView, "PUT": VerbStart, "DELETE": VerbDelete}[r.Method]
+	if verb != "" && !authorize(w, r, verb, "instance", name) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		inst := state.Instances[name]
+		if inst == nil {
+			writeError(w, http.StatusNotFound, "instance %s not found", name)
+			return
+		}
+
+		// ?tree=true adds the live process tree
+		if r.URL.Query().Get("tree") == "true" && inst.Status == "running" && inst.PID > 0 {
+			children, err := GetChildrenMap()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "%v", err)
+				return
+			}
+			tree, err := BuildProcessTree(children, inst.PID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "%v", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, struct {
+				*Instance
+				Tree *ProcessTree `json:"tree"`
+			}{inst, tree})
+			return
+		}
+		writeJSON(w, http.StatusOK, inst)
+
+	case "PUT":
+		// Create and start an instance from a template
+		if state.Instances[name] != nil {
+			writeError(w, http.StatusConflict, "instance %s already exists", name)
+			return
+		}
+
+		var req struct {
+			Template string            `json:"template"`
+			Vars     map[string]string `json:"vars"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+
+		project, _ := splitProjectKey(name)
+		tmpl := state.LookupTemplate(project, req.Template)
+		if tmpl == nil {
+			writeError(w, http.StatusNotFound, "template %s not found", req.Template)
+			return
+		}
+		if !authorize(w, r, VerbStart, "template", projectKey(tmpl.Project, tmpl.ID)) {
+			return
+		}
+
+		inst, err := StartProcess(state, tmpl, name, req.Vars, actor)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, inst)
+
+	case "DELETE":
+		inst := state.Instances[name]
+		if inst == nil {
+			writeError(w, http.StatusNotFound, "instance %s not found", name)
+			return
+		}
+		if err := DeleteInstance(state, inst, actor); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to stop process: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// handleTemplateResource serves /api/templates/{id}
+func handleTemplateResource(w http.ResponseWriter, r *http.Request) {
+	key, _, err := parseResourcePath(r, "/api/templates/")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if key == "" {
+		writeError(w, http.StatusNotFound, "template id required")
+		return
+	}
+
+	verb := VerbEditTemplate
+	if r.Method == "GET" {
+		verb = VerbView
+	}
+	if !authorize(w, r, verb, "template", key) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		tmpl := state.Templates[key]
+		if tmpl == nil {
+			writeError(w, http.StatusNotFound, "template %s not found", key)
+			return
+		}
+		writeJSON(w, http.StatusOK, tmpl)
+
+	case "PUT":
+		var tmpl Template
+		if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+
+		// The path is authoritative for id and project
+		tmpl.Project, tmpl.ID = splitProjectKey(key)
+		if tmpl.Command == "" {
+			writeError(w, http.StatusBadRequest, "command is required")
+			return
+		}
+		if err := validateTemplate(&tmpl); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		status := http.StatusOK
+		if state.Templates[key] == nil {
+			status = http.StatusCreated
+		}
+		state.Templates[key] = &tmpl
+		state.Save()
+		state.RecordEvent(httpActor(r), "template", "", "saved "+key)
+
+		writeJSON(w, status, tmpl)
+
+	case "DELETE":
+		if state.Templates[key] == nil {
+			writeError(w, http.StatusNotFound, "template %s not found", key)
+			return
+		}
+		delete(state.Templates, key)
+		state.Save()
+		state.RecordEvent(httpActor(r), "template", "", "deleted "+key)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// handleResourceTypeResource serves /api/resource-types/{name}
+func handleResourceTypeResource(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/resource-types/"))
+	if name == "" {
+		writeError(w, http.StatusNotFound, "resource type name required")
+		return
+	}
+
+	verb := VerbEditConfig
+	if r.Method == "GET" {
+		verb = VerbView
+	}
+	if !authorize(w, r, verb, "", "") {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rt := state.Types[name]
+		if rt == nil {
+			writeError(w, http.StatusNotFound, "resource type %s not found", name)
+			return
+		}
+		writeJSON(w, http.StatusOK, rt)
+
+	case "PUT":
+		var rt ResourceType
+		if err := json.NewDecoder(r.Body).Decode(&rt); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		rt.Name = name
+
+		status := http.StatusOK
+		if state.Types[name] == nil {
+			status = http.StatusCreated
+		}
+		state.Types[name] = &rt
+		state.Save()
+		state.RecordEvent(httpActor(r), "resource-type", "", "saved "+name)
+
+		writeJSON(w, status, rt)
+
+	case "DELETE":
+		if state.Types[name] == nil {
+			writeError(w, http.StatusNotFound, "resource type %s not found", name)
+			return
+		}
+
+		// Built-in types are merged back in on every load
+		if DefaultResourceTypes()[name] != nil {
+			writeError(w, http.StatusConflict, "resource type %s is built in", name)
+			return
+		}
+
+		// Refuse while resources of this type are claimed
+		for _, res := range state.Resources {
+			if res.Type == name {
+				writeError(w, http.StatusConflict, "resource type %s is in use by %s", name, res.Owner)
+				return
+			}
+		}
+
+		delete(state.Types, name)
+		state.Save()
+		state.RecordEvent(httpActor(r), "resource-type", "", "deleted "+name)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// adoptRequest is the body of POST /api/instances/{name}:adopt
+type adoptRequest struct {
+	PID     int  `json:"pid"`
+	Restart bool `json:"restart"` // Relaunch the process under vp right away
+}
+
+// adoptInstance takes over a running process as the named instance
+func adoptInstance(w http.ResponseWriter, r *http.Request, name string, req adoptRequest) {
+	if !authorize(w, r, VerbStart, "instance", name) || !authorize(w, r, VerbStart, "template", templateAdopted) {
+		return
+	}
+	if state.Instances[name] != nil {
+		writeError(w, http.StatusConflict, "instance %s already exists", name)
+		return
+	}
+
+	inst, err := AdoptProcess(state, req.PID, name, req.Restart, httpActor(r))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inst)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTemplateResourceRoutes tests the PUT/GET/DELETE lifecycle and the
+// structured error body of /api/templates/{id}
+func TestTemplateResourceRoutes(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	state = &State{
+		Instances: make(map[string]*Instance),
+		Templates: make(map[string]*Template),
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types:     DefaultResourceTypes(),
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handleTemplateResource(rec, req)
+		return rec
+	}
+
+	if rec := do("PUT", "/api/templates/web?project=alpha", `{"command":"sleep 300"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on create, got %d: %s", rec.Code, rec.Body)
+	}
+	tmpl := state.Templates["alpha/web"]
+	if tmpl == nil || tmpl.ID != "web" || tmpl.Project != "alpha" {
+		t.Fatalf("Expected template alpha/web with id and project from the path, got %+v", tmpl)
+	}
+
+	if rec := do("PUT", "/api/templates/alpha/web", `{"command":"sleep 600"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on replace, got %d", rec.Code)
+	}
+	if rec := do("GET", "/api/templates/alpha/web", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "sleep 600") {
+		t.Errorf("Expected replaced template, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("DELETE", "/api/templates/alpha/web", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rec.Code)
+	}
+
+	rec := do("GET", "/api/templates/alpha/web", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after delete, got %d", rec.Code)
+	}
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != "not_found" {
+		t.Errorf("Expected structured not_found error, got %s", rec.Body)
+	}
+}
+
+// TestParseResourcePath tests splitting instance paths into key and verb
+func TestParseResourcePath(t *testing.T) {
+	tests := []struct {
+		path, key, verb string
+	}{
+		{"/api/instances/web", "web", ""},
+		{"/api/instances/web:stop", "web", "stop"},
+		{"/api/instances/alpha/web:restart", "alpha/web", "restart"},
+		{"/api/instances/api:adopt", "api", "adopt"},
+		{"/api/instances/web?project=alpha", "alpha/web", ""},
+		{"/api/instances/host:8080", "host:8080", ""}, // Unknown suffixes stay part of the name
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, nil)
+		key, verb, err := parseResourcePath(req, "/api/instances/")
+		if err != nil || key != tt.key || verb != tt.verb {
+			t.Errorf("%s: expected (%q, %q), got (%q, %q, %v)", tt.path, tt.key, tt.verb, key, verb, err)
+		}
+	}
+
+	// ?project= must not be overridden by a prefix in the name
+	req := httptest.NewRequest("POST", "/api/instances/beta/web:start?project=alpha", nil)
+	if key, _, err := parseResourcePath(req, "/api/instances/"); err == nil {
+		t.Errorf("Expected a prefixed name with ?project= to be rejected, got %q", key)
+	}
+}
+
+// TestReconcilerWithRequests tests that the reconciler and requests that
+// start and delete instances take turns with the state. Run with -race.
+func TestReconcilerWithRequests(t *testing.T) {
+	state = jobTestState(t)
+	state.Templates = map[string]*Template{"sleep": {ID: "sleep", Command: "sleep 30"}}
+	handler := stateMiddleware(http.HandlerFunc(handleInstanceResource))
+
+	stop, stopped := make(chan bool), make(chan bool)
+	go func() {
+		defer close(stopped)
+		var last []byte
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				last = reconcile(last)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		path := fmt.Sprintf("/api/instances/w%d", i)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("PUT", path, strings.NewReader(`{"template":"sleep"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 on create, got %d: %s", rec.Code, rec.Body)
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("DELETE", path, nil))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204 on delete, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	close(stop)
+	<-stopped
+}
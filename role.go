@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Verbs a role can grant
+const (
+	VerbView         = "view"
+	VerbStart        = "start"
+	VerbStop         = "stop"
+	VerbRestart      = "restart"
+	VerbDelete       = "delete"
+	VerbExecAction   = "exec-action"
+	VerbAttach       = "attach"
+	VerbExec         = "exec"
+	VerbSignal       = "signal"
+	VerbReload       = "reload"
+	VerbEditTemplate = "edit-template"
+	VerbEditConfig   = "edit-config"
+)
+
+var allVerbs = []string{VerbView, VerbStart, VerbStop, VerbRestart, VerbDelete, VerbExecAction, VerbAttach, VerbExec, VerbSignal, VerbReload, VerbEditTemplate, VerbEditConfig}
+
+// Role grants verbs on instances and templates whose names match its
+// patterns. Subjects bound to at least one role can do nothing else;
+// subjects without roles keep full access.
+type Role struct {
+	Name      string   `json:"name"`
+	Verbs     []string `json:"verbs"`               // Granted verbs, "*" for all
+	Instances []string `json:"instances,omitempty"` // Instance name patterns (project/name, "*" = all)
+	Templates []string `json:"templates,omitempty"` // Template id patterns (project/id, "*" = all)
+	Subjects  []string `json:"subjects,omitempty"`  // token:<name>, unix:<user> or cert:<common name>
+}
+
+// matchPattern matches a name against a glob. "*" matches every name,
+// including project-qualified ones.
+func matchPattern(pattern, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// Permits reports whether the role grants verb on a named instance or
+// template. kind is "instance", "template" or "" for global verbs.
+func (role *Role) Permits(verb, kind, name string) bool {
+	granted := false
+	for _, v := range role.Verbs {
+		if v == verb || v == "*" {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		return false
+	}
+
+	var patterns []string
+	switch kind {
+	case "instance":
+		patterns = role.Instances
+	case "template":
+		patterns = role.Templates
+	default:
+		return true
+	}
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesFor returns the roles bound to a subject
+func (s *State) RolesFor(subject string) []*Role {
+	var roles []*Role
+	for _, role := range s.Roles {
+		for _, sub := range role.Subjects {
+			if sub == subject {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// Permits reports whether a subject may perform verb on a named instance or
+// template. Subjects without roles (including "" for unauthenticated
+// requests, which only exist while no tokens are configured) are unrestricted.
+func (s *State) Permits(subject, verb, kind, name string) bool {
+	roles := s.RolesFor(subject)
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if role.Permits(verb, kind, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize writes a 403 and returns false unless the request's principal
+// may perform verb on the named instance or template
+func authorize(w http.ResponseWriter, r *http.Request, verb, kind, name string) bool {
+	if state.Permits(principal(r), verb, kind, name) {
+		return true
+	}
+	if name != "" {
+		writeError(w, http.StatusForbidden, "%s may not %s %s %s", principal(r), verb, kind, name)
+	} else {
+		writeError(w, http.StatusForbidden, "%s may not %s", principal(r), verb)
+	}
+	return false
+}
+
+// visibleInstances filters instances down to those the request may view
+func visibleInstances(r *http.Request, instances map[string]*Instance) map[string]*Instance {
+	subject := principal(r)
+	if len(state.RolesFor(subject)) == 0 {
+		return instances
+	}
+	result := make(map[string]*Instance)
+	for name, inst := range instances {
+		if state.Permits(subject, VerbView, "instance", name) {
+			result[name] = inst
+		}
+	}
+	return result
+}
+
+// visibleTemplates filters templates down to those the request may view
+func visibleTemplates(r *http.Request, templates map[string]*Template) map[string]*Template {
+	subject := principal(r)
+	if len(state.RolesFor(subject)) == 0 {
+		return templates
+	}
+	result := make(map[string]*Template)
+	for key, tmpl := range templates {
+		if state.Permits(subject, VerbView, "template", key) {
+			result[key] = tmpl
+		}
+	}
+	return result
+}
+
+// visibleResources filters resource claims down to those whose owner the
+// request may view. Claims of a zero-downtime restart ("db#next") belong to
+// the instance, claims of a job run ("backup#3") to the job's template.
+func visibleResources(r *http.Request, resources map[string]*Resource) map[string]*Resource {
+	subject := principal(r)
+	if len(state.RolesFor(subject)) == 0 {
+		return resources
+	}
+	result := make(map[string]*Resource)
+	for key, res := range resources {
+		owner, _, _ := strings.Cut(res.Owner, "#")
+		kind := "instance"
+		if state.Instances[owner] == nil && state.Templates[owner] != nil {
+			kind = "template"
+		}
+		if state.Permits(subject, VerbView, kind, owner) {
+			result[key] = res
+		}
+	}
+	return result
+}
+
+// visibleProjects returns the projects of the instances and templates the
+// request may view, or every project for unrestricted subjects
+func visibleProjects(r *http.Request) []string {
+	if len(state.RolesFor(principal(r))) == 0 {
+		return state.ProjectNames()
+	}
+	seen := map[string]bool{"": true}
+	for _, inst := range visibleInstances(r, state.Instances) {
+		seen[inst.Project] = true
+	}
+	for _, tmpl := range visibleTemplates(r, state.Templates) {
+		seen[tmpl.Project] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitList splits a comma-separated flag value
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func handleRole(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp role <list|add|remove|bind|unbind>\n")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		names := make([]string, 0, len(state.Roles))
+		for name := range state.Roles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		roles := make([]*Role, len(names))
+		for i, name := range names {
+			roles[i] = state.Roles[name]
+		}
+
+		printList(roles, func(r *Role) string { return r.Name }, func(roles []*Role, wide bool) {
+			for _, role := range roles {
+				fmt.Printf("%s\n", role.Name)
+				fmt.Printf("  verbs:     %s\n", strings.Join(role.Verbs, ","))
+				fmt.Printf("  instances: %s\n", strings.Join(role.Instances, ","))
+				fmt.Printf("  templates: %s\n", strings.Join(role.Templates, ","))
+				fmt.Printf("  subjects:  %s\n", strings.Join(role.Subjects, ","))
+			}
+		})
+
+	case "add":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp role add <name> --verbs=start,stop --instances=web-* [--templates=...]\n")
+			fmt.Fprintf(os.Stderr, "Verbs: %s, *\n", strings.Join(allVerbs, ", "))
+			os.Exit(1)
+		}
+		vars := parseVars(args[2:])
+
+		role := &Role{
+			Name:      args[1],
+			Verbs:     splitList(vars["verbs"]),
+			Instances: splitList(vars["instances"]),
+			Templates: splitList(vars["templates"]),
+		}
+		for _, v := range role.Verbs {
+			if v != "*" && !contains(allVerbs, v) {
+				fmt.Fprintf(os.Stderr, "Unknown verb: %s\n", v)
+				os.Exit(1)
+			}
+		}
+		// Re-adding a role redefines it but keeps its bindings
+		if old := state.Roles[role.Name]; old != nil {
+			role.Subjects = old.Subjects
+		}
+
+		state.Roles[role.Name] = role
+		state.Save()
+		state.RecordEvent(cliActor(), "role", "", "saved "+role.Name)
+		fmt.Printf("Saved role %s\n", role.Name)
+
+	case "remove":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: vp role remove <name>\n")
+			os.Exit(1)
+		}
+		if state.Roles[args[1]] == nil {
+			fmt.Fprintf(os.Stderr, "Role not found: %s\n", args[1])
+			os.Exit(1)
+		}
+		delete(state.Roles, args[1])
+		state.Save()
+		state.RecordEvent(cliActor(), "role", "", "removed "+args[1])
+		fmt.Printf("Removed role %s\n", args[1])
+
+	case "bind", "unbind":
+		if len(args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: vp role %s <name> <token:name|unix:user|cert:cn>\n", args[0])
+			os.Exit(1)
+		}
+		role := state.Roles[args[1]]
+		if role == nil {
+			fmt.Fprintf(os.Stderr, "Role not found: %s\n", args[1])
+			os.Exit(1)
+		}
+		subject := args[2]
+		if !strings.HasPrefix(subject, "token:") && !strings.HasPrefix(subject, "unix:") && !strings.HasPrefix(subject, "cert:") {
+			fmt.Fprintf(os.Stderr, "Subject must be token:<name>, unix:<user> or cert:<common name>\n")
+			os.Exit(1)
+		}
+
+		subjects := make([]string, 0, len(role.Subjects)+1)
+		for _, s := range role.Subjects {
+			if s != subject {
+				subjects = append(subjects, s)
+			}
+		}
+		if args[0] == "bind" {
+			subjects = append(subjects, subject)
+		}
+		role.Subjects = subjects
+
+		state.Save()
+		state.RecordEvent(cliActor(), "role", "", args[0]+" "+role.Name+" "+subject)
+		if args[0] == "bind" {
+			fmt.Printf("Bound %s to %s\n", subject, role.Name)
+		} else {
+			fmt.Printf("Unbound %s from %s\n", subject, role.Name)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown role command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// contains reports whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
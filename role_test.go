@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRolePermits tests verb and name pattern matching of roles
+func TestRolePermits(t *testing.T) {
+	s := &State{Roles: map[string]*Role{
+		"frontend": {
+			Name:      "frontend",
+			Verbs:     []string{VerbView, VerbRestart},
+			Instances: []string{"frontend*", "alpha/*"},
+			Subjects:  []string{"token:ci", "unix:alice"},
+		},
+	}}
+
+	tests := []struct {
+		subject, verb, kind, name string
+		want                      bool
+	}{
+		{"token:ci", VerbRestart, "instance", "frontend-1", true},
+		{"token:ci", VerbRestart, "instance", "alpha/web", true},
+		{"token:ci", VerbDelete, "instance", "frontend-1", false},
+		{"token:ci", VerbRestart, "instance", "db", false},
+		{"unix:alice", VerbView, "instance", "frontend", true},
+		{"token:ci", VerbEditTemplate, "template", "frontend", false},
+		{"token:ci", VerbEditConfig, "", "", false},
+		{"token:admin", VerbDelete, "instance", "db", true}, // unbound: unrestricted
+		{"", VerbEditConfig, "", "", true},
+	}
+	for _, tt := range tests {
+		if got := s.Permits(tt.subject, tt.verb, tt.kind, tt.name); got != tt.want {
+			t.Errorf("Permits(%q, %q, %q, %q) = %v, want %v", tt.subject, tt.verb, tt.kind, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRoleEnforcement tests that handlers refuse verbs outside a role and
+// hide instances the caller can't view
+func TestRoleEnforcement(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	state = &State{
+		Instances: map[string]*Instance{
+			"frontend": {Name: "frontend", Status: "stopped"},
+			"db":       {Name: "db", Status: "stopped"},
+		},
+		Templates: make(map[string]*Template),
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types:     DefaultResourceTypes(),
+		Roles: map[string]*Role{
+			"frontend": {Name: "frontend", Verbs: []string{VerbView, VerbRestart}, Instances: []string{"frontend"}, Subjects: []string{"token:ci"}},
+		},
+	}
+
+	do := func(handler http.HandlerFunc, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req = req.WithContext(context.WithValue(req.Context(), principalKey{}, "token:ci"))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := do(handleInstanceResource, "DELETE", "/api/instances/db"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting db, got %d", rec.Code)
+	}
+	if rec := do(handleInstanceResource, "GET", "/api/instances/db"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 viewing db, got %d", rec.Code)
+	}
+	if rec := do(handleInstanceResource, "GET", "/api/instances/frontend"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 viewing frontend, got %d", rec.Code)
+	}
+	if rec := do(handleTemplateResource, "PUT", "/api/templates/web"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 editing a template, got %d", rec.Code)
+	}
+	if rec := do(handleConfig, "GET", "/api/config"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 reading config, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/instances", nil)
+	req = req.WithContext(context.WithValue(req.Context(), principalKey{}, "token:ci"))
+	if got := visibleInstances(req, state.Instances); len(got) != 1 || got["frontend"] == nil {
+		t.Errorf("Expected only frontend to be visible, got %v", got)
+	}
+
+	// Starting an instance needs start on its template too
+	state.Templates["pg"] = &Template{ID: "pg", Command: "sleep 30"}
+	state.Roles["frontend"].Verbs = append(state.Roles["frontend"].Verbs, VerbStart)
+	state.Roles["frontend"].Instances = []string{"frontend*"}
+	req = httptest.NewRequest("PUT", "/api/instances/frontend-2", strings.NewReader(`{"template":"pg"}`))
+	req = req.WithContext(context.WithValue(req.Context(), principalKey{}, "token:ci"))
+	rec := httptest.NewRecorder()
+	handleInstanceResource(rec, req)
+	if rec.Code != http.StatusForbidden || state.Instances["frontend-2"] != nil {
+		t.Errorf("Expected 403 starting from a template outside the role, got %d", rec.Code)
+	}
+}
+
+// TestRoleListings tests that discovery, resource types, resources and
+// projects are refused or filtered for subjects with roles
+func TestRoleListings(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	state = &State{
+		Instances: map[string]*Instance{
+			"web/frontend": {Name: "web/frontend", Project: "web", Status: "stopped"},
+			"data/db":      {Name: "data/db", Project: "data", Status: "stopped"},
+		},
+		Templates: map[string]*Template{"data/backup": {ID: "backup", Project: "data"}},
+		Resources: map[string]*Resource{
+			"tcpport:3000": {Type: "tcpport", Value: "3000", Owner: "web/frontend"},
+			"tcpport:3001": {Type: "tcpport", Value: "3001", Owner: "web/frontend#next"},
+			"tcpport:5432": {Type: "tcpport", Value: "5432", Owner: "data/db"},
+			"tcpport:9000": {Type: "tcpport", Value: "9000", Owner: "data/backup#3"},
+		},
+		Counters: make(map[string]int),
+		Types:    DefaultResourceTypes(),
+		Roles: map[string]*Role{
+			"frontend": {Name: "frontend", Verbs: []string{VerbView}, Instances: []string{"web/*"}, Subjects: []string{"token:ci"}},
+			"none":     {Name: "none", Verbs: []string{VerbStop}, Instances: []string{"*"}, Subjects: []string{"token:stop"}},
+		},
+	}
+
+	do := func(handler http.HandlerFunc, subject, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), principalKey{}, subject))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := do(handleDiscover, "token:ci", "/api/discover"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 discovering processes, got %d", rec.Code)
+	}
+	if rec := do(handleResourceTypes, "token:stop", "/api/resource-types"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 listing resource types without view, got %d", rec.Code)
+	}
+	if rec := do(handleResourceTypeResource, "token:stop", "/api/resource-types/tcpport"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 reading a resource type without view, got %d", rec.Code)
+	}
+	if rec := do(handleResourceTypes, "token:ci", "/api/resource-types"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 listing resource types, got %d", rec.Code)
+	}
+
+	var grouped map[string][]Resource
+	rec := do(handleResources, "token:ci", "/api/resources")
+	if err := json.Unmarshal(rec.Body.Bytes(), &grouped); err != nil {
+		t.Fatalf("Invalid resources: %v", err)
+	}
+	if got := grouped["tcpport"]; len(got) != 2 || !strings.HasPrefix(got[0].Owner, "web/frontend") || !strings.HasPrefix(got[1].Owner, "web/frontend") {
+		t.Errorf("Expected only the claims of web/frontend, got %v", grouped)
+	}
+	rec = do(handleResources, "", "/api/resources")
+	if err := json.Unmarshal(rec.Body.Bytes(), &grouped); err != nil || len(grouped["tcpport"]) != 4 {
+		t.Errorf("Expected every claim without roles, got %v", grouped)
+	}
+
+	var projects []string
+	rec = do(handleProjects, "token:ci", "/api/projects")
+	if err := json.Unmarshal(rec.Body.Bytes(), &projects); err != nil || strings.Join(projects, ",") != ",web" {
+		t.Errorf("Expected projects [\"\" web], got %q", projects)
+	}
+	rec = do(handleProjects, "", "/api/projects")
+	if err := json.Unmarshal(rec.Body.Bytes(), &projects); err != nil || strings.Join(projects, ",") != ",data,web" {
+		t.Errorf("Expected every project without roles, got %q", projects)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signalNames are the signals `vp signal` and template reloads accept by name
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+	"ALRM":  syscall.SIGALRM,
+}
+
+// parseSignal parses a signal given as SIGHUP, HUP, hup or 1
+func parseSignal(s string) (syscall.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// signalName returns the SIG name of a signal
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// SignalProcess sends a signal to an instance's main process
+func SignalProcess(state *State, inst *Instance, sig syscall.Signal, actor string) error {
+	if inst.PID == 0 || inst.Status != "running" {
+		return fmt.Errorf("instance %s is not running", inst.Name)
+	}
+	if err := syscall.Kill(inst.PID, sig); err != nil {
+		return fmt.Errorf("failed to signal PID %d: %w", inst.PID, err)
+	}
+	state.RecordEvent(actor, "signal", inst.Name, fmt.Sprintf("%s to PID %d", signalName(sig), inst.PID))
+	return nil
+}
+
+// ReloadProcess runs the reload of an instance's template: a signal such as
+// SIGHUP is sent to the process, anything else runs as a command like
+// `vp exec <name> -- sh -c <reload>`
+func ReloadProcess(state *State, inst *Instance, actor string) error {
+	tmpl := state.Templates[inst.Template]
+	if tmpl == nil || tmpl.Reload == "" {
+		return fmt.Errorf("no reload defined for instance %s", inst.Name)
+	}
+	if inst.PID == 0 || inst.Status != "running" {
+		return fmt.Errorf("instance %s is not running", inst.Name)
+	}
+
+	if sig, err := parseSignal(tmpl.Reload); err == nil {
+		if err := syscall.Kill(inst.PID, sig); err != nil {
+			return fmt.Errorf("failed to signal PID %d: %w", inst.PID, err)
+		}
+		state.RecordEvent(actor, "reload", inst.Name, fmt.Sprintf("%s to PID %d", signalName(sig), inst.PID))
+		return nil
+	}
+
+	var out bytes.Buffer
+	code, err := RunExec(context.Background(), state, inst, []string{"sh", "-c", tmpl.Reload}, nil, &out, &out)
+	if err != nil {
+		return fmt.Errorf("reload failed: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("reload exited with status %d: %s", code, strings.TrimSpace(out.String()))
+	}
+	state.RecordEvent(actor, "reload", inst.Name, tmpl.Reload)
+	return nil
+}
+
+// RollingRestart replaces a running instance without downtime: a second
+// process is started with freshly allocated counter resources (ports), and
+// the old one is stopped once the new one is ready. Ready means the
+// template's ready command exits 0, or else that the new tcpport accepts
+// connections. If it doesn't get ready within timeout, the new process is
+// stopped and the old one keeps running. The caller holds state.mu, which is
+// let go while waiting for the new process.
+func RollingRestart(state *State, inst *Instance, timeout time.Duration, actor string) error {
+	if inst.PID == 0 || inst.Status != "running" {
+		return fmt.Errorf("instance %s is not running", inst.Name)
+	}
+	if rollingRestarts[inst.Name] {
+		return fmt.Errorf("instance %s is being restarted already", inst.Name)
+	}
+	if inst.TTY {
+		return fmt.Errorf("zero-downtime restart is not supported for tty instances")
+	}
+	tmpl := state.Templates[inst.Template]
+	if tmpl == nil {
+		return fmt.Errorf("template %s no longer exists", inst.Template)
+	}
+
+	// Counters such as ports can't be shared by both processes, so they get
+	// new values. Allocating under another owner skips the values this
+	// instance holds.
+	vars := ExecVars(state, inst)
+	var counters []string
+	for rtype := range inst.Resources {
+		if rt := state.Types[rtype]; rt != nil && rt.Counter {
+			counters = append(counters, rtype)
+			delete(vars, rtype)
+		}
+	}
+	sort.Strings(counters)
+	command, fresh, err := resolveCommand(state, tmpl.Command, counters, vars, inst.Name+"#next", inst.Name, actor)
+	if err != nil {
+		return err
+	}
+	release := func(values map[string]string) {
+		for rtype, value := range values {
+			state.ReleaseResource(rtype, value, inst.Name, actor)
+		}
+	}
+	if tmpl.Ready == "" && fresh["tcpport"] == "" {
+		release(fresh)
+		return fmt.Errorf("zero-downtime restart needs a tcpport resource or a ready command in template %s", tmpl.ID)
+	}
+
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		release(fresh)
+		return fmt.Errorf("empty command")
+	}
+
+	next := *inst
+	next.Resources = make(map[string]string)
+	for k, v := range inst.Resources {
+		next.Resources[k] = v
+	}
+	for k, v := range fresh {
+		next.Resources[k] = v
+	}
+	next.Vars = vars
+	if tmpl.Env != nil {
+		next.Env = templateEnv(tmpl, vars)
+	}
+
+	if err := launch(state, &next, parts, func(pid int) { next.PID = pid }); err != nil {
+		release(fresh)
+		return fmt.Errorf("failed to start: %w", err)
+	}
+
+	// Other requests and the reconciler go on meanwhile; the instance may
+	// be stopped or deleted before the new process is ready
+	oldPID := inst.PID
+	rollingRestarts[inst.Name] = true
+	state.mu.Unlock()
+	err = waitReady(state, &next, tmpl.Ready, timeout)
+	state.mu.Lock()
+	delete(rollingRestarts, inst.Name)
+	if cur := state.Instances[inst.Name]; err == nil && (cur == nil || cur.PID != oldPID) {
+		err = fmt.Errorf("instance %s was stopped or deleted while the new process got ready", inst.Name)
+	}
+	if err != nil {
+		terminate(next.PID)
+		release(fresh)
+		return err
+	}
+	state.Instances[inst.Name] = inst // A config reload meanwhile replaces it with a copy
+
+	// Switch over, then stop the old process and free what it held
+	old := make(map[string]string)
+	for rtype := range fresh {
+		old[rtype] = inst.Resources[rtype]
+	}
+	inst.PID = next.PID
+	inst.Command = command
+	inst.Resources = next.Resources
+	inst.Vars = vars
+	inst.Env = next.Env
+	if tmpl.Action != "" {
+		inst.Action = interpolate(tmpl.Action, vars)
+	}
+	inst.Started = time.Now().Unix()
+	inst.Error = ""
+	inst.Restarts++
+	state.Save()
+	state.RecordEvent(actor, "restart", inst.Name, fmt.Sprintf("PID %d -> %d without downtime", oldPID, inst.PID))
+
+	terminate(oldPID)
+	release(old)
+	state.Save()
+	return nil
+}
+
+// rollingRestarts are the instances RollingRestart is waiting for a new
+// process of, guarded by state.mu
+var rollingRestarts = make(map[string]bool)
+
+// waitReady waits until a freshly started process is ready (see
+// RollingRestart)
+func waitReady(state *State, inst *Instance, ready string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !IsProcessRunning(inst.PID) {
+			return fmt.Errorf("new process exited before it was ready")
+		}
+
+		if ready != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Until(deadline))
+			code, err := RunExec(ctx, state, inst, []string{"sh", "-c", ready}, nil, io.Discard, io.Discard)
+			cancel()
+			if err == nil && code == 0 {
+				return nil
+			}
+		} else if conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", inst.Resources["tcpport"]), time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("new process not ready after %s", timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// restartFlags are the options of `vp restart` and POST :restart
+type restartFlags struct {
+	ZeroDowntime bool   `json:"zero_downtime,omitempty"`
+	Timeout      string `json:"timeout,omitempty"` // Duration to wait for readiness (default 30s)
+}
+
+// timeout returns the readiness timeout
+func (f restartFlags) timeout() (time.Duration, error) {
+	if f.Timeout == "" {
+		return 30 * time.Second, nil
+	}
+	d, err := time.ParseDuration(f.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", f.Timeout)
+	}
+	return d, nil
+}
+
+// parseRestartFlags reads --zero-downtime and --timeout
+func parseRestartFlags(args []string) restartFlags {
+	vars := parseVars(args)
+	return restartFlags{ZeroDowntime: vars["zero-downtime"] == "true", Timeout: vars["timeout"]}
+}
+
+func handleSignal(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: vp signal <name> <SIGNAL>\n")
+		os.Exit(1)
+	}
+	sig, err := parseSignal(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := MatchAndUpdateInstances(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
+	}
+	name := cliKey(args[0])
+	inst := state.Instances[name]
+	if inst == nil {
+		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
+		os.Exit(1)
+	}
+
+	if err := SignalProcess(state, inst, sig, cliActor()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Sent %s to %s (PID %d)\n", signalName(sig), name, inst.PID)
+	})
+}
+
+func handleReload(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp reload <name>\n")
+		os.Exit(1)
+	}
+
+	if err := MatchAndUpdateInstances(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", err)
+	}
+	name := cliKey(args[0])
+	inst := state.Instances[name]
+	if inst == nil {
+		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
+		os.Exit(1)
+	}
+
+	if err := ReloadProcess(state, inst, cliActor()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	printObject(inst, displayName(inst), func(bool) {
+		fmt.Printf("Reloaded %s\n", name)
+	})
+}
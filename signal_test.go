@@ -0,0 +1,84 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestParseSignal tests the accepted spellings of signals
+func TestParseSignal(t *testing.T) {
+	for _, s := range []string{"HUP", "SIGHUP", "hup", "1"} {
+		if sig, err := parseSignal(s); err != nil || sig != syscall.SIGHUP {
+			t.Errorf("parseSignal(%q) = %v, %v", s, sig, err)
+		}
+	}
+	for _, s := range []string{"", "SIGNOPE", "99"} {
+		if _, err := parseSignal(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+	if name := signalName(syscall.SIGUSR2); name != "SIGUSR2" {
+		t.Errorf("signalName = %q", name)
+	}
+}
+
+// TestRollingRestart tests that a zero-downtime restart moves the instance
+// to a new process and counter value, and that a new process that never
+// gets ready leaves the old one in place
+func TestRollingRestart(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	tmpl := &Template{ID: "slow", Command: "sleep 30", Resources: []string{"slot"}, Ready: "test ${slot} != 1",
+		Env: map[string]string{"SLOT": "${slot}"}}
+	s := &State{
+		Instances: make(map[string]*Instance),
+		Templates: map[string]*Template{"slow": tmpl},
+		Resources: make(map[string]*Resource),
+		Counters:  make(map[string]int),
+		Types:     map[string]*ResourceType{"slot": {Name: "slot", Counter: true, Start: 1, End: 9}},
+	}
+
+	inst, err := StartProcess(s, tmpl, "a", nil, "test")
+	if err != nil {
+		t.Fatalf("StartProcess failed: %v", err)
+	}
+	defer func() {
+		// Dropped first so its reaper doesn't write to HOME after the test
+		s.mu.Lock()
+		delete(s.Instances, "a")
+		s.mu.Unlock()
+		terminate(inst.PID)
+	}()
+	oldPID := inst.PID
+
+	// RollingRestart lets go of the lock while it waits
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := RollingRestart(s, inst, 5*time.Second, "test"); err != nil {
+		t.Fatalf("RollingRestart failed: %v", err)
+	}
+	if inst.PID == oldPID || inst.Resources["slot"] != "2" || inst.Restarts != 1 {
+		t.Errorf("Expected new PID and slot 2, got PID %d (was %d), %v", inst.PID, oldPID, inst.Resources)
+	}
+	if inst.Env["SLOT"] != "2" {
+		t.Errorf("Expected the env of the new process, got %v", inst.Env)
+	}
+	if IsProcessRunning(oldPID) {
+		t.Errorf("Expected old process %d to be stopped", oldPID)
+	}
+	if s.Resources["slot:1"] != nil || s.Resources["slot:2"] == nil {
+		t.Errorf("Expected only slot 2 claimed, got %v", s.Resources)
+	}
+
+	tmpl.Ready = "false"
+	pid := inst.PID
+	if err := RollingRestart(s, inst, 500*time.Millisecond, "test"); err == nil {
+		t.Fatal("Expected error when the new process never gets ready")
+	}
+	if inst.PID != pid || !IsProcessRunning(pid) || inst.Resources["slot"] != "2" {
+		t.Errorf("Expected the old process to keep running, got PID %d (was %d), %v", inst.PID, pid, inst.Resources)
+	}
+	if len(s.Resources) != 1 {
+		t.Errorf("Expected the new claim to be released, got %v", s.Resources)
+	}
+}
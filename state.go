@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,42 +10,40 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
-// State holds all application state
+// State holds all application state. In vp serve, requests and background
+// loops hold mu for as long as they use the state (see stateMiddleware); the
+// methods below don't take it themselves.
 type State struct {
-	mu             sync.RWMutex               // Protects concurrent access to state
+	mu             sync.RWMutex               // Serializes access to state between goroutines
 	Instances      map[string]*Instance       `json:"instances"`       // name -> Instance
 	Templates      map[string]*Template       `json:"templates"`       // id -> Template
 	Resources      map[string]*Resource       `json:"resources"`       // type:value -> Resource
 	Counters       map[string]int             `json:"counters"`        // counter_name -> current
 	Types          map[string]*ResourceType   `json:"types"`           // Resource type definitions
-	RemotesAllowed map[string]bool            `json:"remotes_allowed"` // origin -> allowed (true=can execute, false=blocked)
+	RemotesAllowed map[string]bool            `json:"remotes_allowed"` // origin -> allowed (true=approved, false=pending or blocked)
+	RemoteScopes   map[string]string          `json:"remote_scopes,omitempty"` // origin -> read|control|admin|blocked
+	Projects       map[string]*Project        `json:"projects,omitempty"` // name -> Project settings
+	Tokens         map[string]*APIToken       `json:"tokens,omitempty"`   // name -> hashed API token
+	Roles          map[string]*Role           `json:"roles,omitempty"`    // name -> Role
+	store          Store                      // Persistence backend (JSON file by default)
 }
 
-// LoadState loads state from ~/.config/vp/state.json
-func LoadState() *State {
-	homeDir, err := os.UserHomeDir()
+// LoadState loads state from the configured Store (~/.vibeprocess by default).
+// Defaults are used only when nothing is stored yet: state that can't be
+// read, such as a corrupt file or a database locked by another vp, is an
+// error, since saving defaults over it would wipe it.
+func LoadState() (*State, error) {
+	store, err := NewStore()
 	if err != nil {
-		// Fallback to /tmp if home directory cannot be determined
-		homeDir = "/tmp"
+		fmt.Fprintf(os.Stderr, "Warning: %v, using JSON state\n", err)
+		store = &jsonStore{dir: stateDir()}
 	}
-	stateFile := filepath.Join(homeDir, ".config/vp/", "state.json")
 
-	data, err := os.ReadFile(stateFile)
+	s, err := store.Load()
 	if err != nil {
-		// Initialize with defaults
-		return &State{
-			Instances:      make(map[string]*Instance),
-			Templates:      loadDefaultTemplates(),
-			Resources:      make(map[string]*Resource),
-			Counters:       make(map[string]int),
-			Types:          DefaultResourceTypes(),
-			RemotesAllowed: make(map[string]bool),
-		}
+		return nil, fmt.Errorf("cannot load state: %w", err)
 	}
-
-	var s State
-	if err := json.Unmarshal(data, &s); err != nil {
-		// Return defaults on parse error
+	if s == nil {
 		return &State{
 			Instances:      make(map[string]*Instance),
 			Templates:      loadDefaultTemplates(),
@@ -54,8 +51,14 @@ func LoadState() *State {
 			Counters:       make(map[string]int),
 			Types:          DefaultResourceTypes(),
 			RemotesAllowed: make(map[string]bool),
-		}
+			RemoteScopes:   make(map[string]string),
+			Projects:       make(map[string]*Project),
+			Tokens:         make(map[string]*APIToken),
+			Roles:          make(map[string]*Role),
+			store:          store,
+		}, nil
 	}
+	s.store = store
 
 	// Merge with default types (in case new defaults were added)
 	if s.Types == nil {
@@ -83,59 +86,111 @@ func LoadState() *State {
 	if s.RemotesAllowed == nil {
 		s.RemotesAllowed = make(map[string]bool)
 	}
+	if s.RemoteScopes == nil {
+		s.RemoteScopes = make(map[string]string)
+	}
+	if s.Projects == nil {
+		s.Projects = make(map[string]*Project)
+	}
+	if s.Tokens == nil {
+		s.Tokens = make(map[string]*APIToken)
+	}
+	if s.Roles == nil {
+		s.Roles = make(map[string]*Role)
+	}
+
+	return s, nil
+}
 
-	return &s
+// backend returns the state's Store, defaulting to the JSON file
+func (s *State) backend() Store {
+	if s.store == nil {
+		s.store = &jsonStore{dir: stateDir()}
+	}
+	return s.store
 }
 
-// Save persists state to ~/.vibeprocess/state.json
+// Save persists the full state to the backend
 func (s *State) Save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.backend().Save(s)
+}
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		// Fallback to /tmp if home directory cannot be determined
-		homeDir = "/tmp"
+// SaveInstances persists the given instances. Backends with row-level storage
+// update just those rows; the JSON backend falls back to a single full Save.
+func (s *State) SaveInstances(insts ...*Instance) error {
+	if _, ok := s.backend().(*jsonStore); ok {
+		return s.Save()
 	}
-	stateDir := filepath.Join(homeDir, ".vibeprocess")
 
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(stateDir, 0755); err != nil {
-		return err
+	for _, inst := range insts {
+		if err := s.store.SaveInstance(inst); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	stateFile := filepath.Join(stateDir, "state.json")
-	data, err := json.MarshalIndent(s, "", "  ")
-	if err != nil {
-		return err
+// DeleteInstance removes an instance from state and deletes its row on
+// backends with row-level storage. The JSON backend needs a Save after it.
+func (s *State) DeleteInstance(name string) error {
+	delete(s.Instances, name)
+	return s.backend().DeleteInstance(name)
+}
+
+// RecordEvent appends an event to the backend's event table
+func (s *State) RecordEvent(actor, typ, instance, detail string) {
+	ev := &Event{
+		Time:     time.Now().Unix(),
+		Type:     typ,
+		Actor:    actor,
+		Instance: instance,
+		Detail:   detail,
+	}
+	if err := s.backend().AppendEvent(ev); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record event: %v\n", err)
 	}
 
-	return os.WriteFile(stateFile, data, 0600)
+	streamBroker.Publish(&StreamMessage{Kind: "event", Instance: instance, Data: ev})
+	if instance != "" {
+		// Subscribers re-snapshot the instance table on this message
+		streamBroker.Publish(&StreamMessage{Kind: "instances"})
+	}
 }
 
 // ClaimResource claims a resource for an instance
-func (s *State) ClaimResource(rtype, value, owner string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	key := rtype + ":" + value
+func (s *State) ClaimResource(rtype, value, owner, actor string) {
+	key := s.claimKey(rtype, value, owner)
 	s.Resources[key] = &Resource{
 		Type:  rtype,
 		Value: value,
 		Owner: owner,
 	}
+	s.RecordEvent(actor, "claim", owner, key)
 }
 
 // ReleaseResources releases all resources owned by an instance
-func (s *State) ReleaseResources(owner string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+func (s *State) ReleaseResources(owner, actor string) {
+	var released []string
 	for key, res := range s.Resources {
 		if res.Owner == owner {
 			delete(s.Resources, key)
+			released = append(released, key)
 		}
 	}
+	for _, key := range released {
+		s.RecordEvent(actor, "release", owner, key)
+	}
+}
+
+// ReleaseResource releases one resource if it is owned by owner
+func (s *State) ReleaseResource(rtype, value, owner, actor string) {
+	key := s.claimKey(rtype, value, owner)
+	res := s.Resources[key]
+	if res == nil || res.Owner != owner {
+		return
+	}
+	delete(s.Resources, key)
+	s.RecordEvent(actor, "release", owner, key)
 }
 
 // loadDefaultTemplates returns default templates
@@ -169,13 +224,39 @@ func loadDefaultTemplates() map[string]*Template {
 	}
 }
 
+// Reload replaces the state in place with what is currently persisted,
+// picking up changes made by other vp processes. It keeps the current state
+// if the persisted one can't be read.
+func (s *State) Reload() error {
+	newState, err := LoadState()
+	if err != nil {
+		return err
+	}
+
+	// Reloads come from the config watcher's goroutine
+	s.mu.Lock()
+	s.Instances = newState.Instances
+	s.Templates = newState.Templates
+	s.Resources = newState.Resources
+	s.Counters = newState.Counters
+	s.Types = newState.Types
+	s.RemotesAllowed = newState.RemotesAllowed
+	s.RemoteScopes = newState.RemoteScopes
+	s.Projects = newState.Projects
+	s.Tokens = newState.Tokens
+	s.Roles = newState.Roles
+	s.store = newState.store
+	s.mu.Unlock()
+	return nil
+}
+
 // WatchConfig watches the state file for changes and reloads it automatically
 func (s *State) WatchConfig() error {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "/tmp"
+	stateDir := stateDir()
+	stateFile := filepath.Join(stateDir, "state.json")
+	if _, ok := s.backend().(*boltStore); ok {
+		stateFile = filepath.Join(stateDir, "state.db")
 	}
-	stateFile := filepath.Join(homeDir, ".vibeprocess", "state.json")
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -186,7 +267,6 @@ func (s *State) WatchConfig() error {
 	err = watcher.Add(stateFile)
 	if err != nil {
 		// If file doesn't exist yet, watch the directory instead
-		stateDir := filepath.Join(homeDir, ".vibeprocess")
 		if err := os.MkdirAll(stateDir, 0755); err != nil {
 			return fmt.Errorf("failed to create state directory: %w", err)
 		}
@@ -213,7 +293,7 @@ func (s *State) WatchConfig() error {
 
 				// Only reload on Write or Create events for the state file
 				if (event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create) &&
-					filepath.Base(event.Name) == "state.json" {
+					filepath.Base(event.Name) == filepath.Base(stateFile) {
 
 					// Debounce: wait 100ms before reloading to group rapid changes
 					if debounceTimer != nil {
@@ -223,17 +303,10 @@ func (s *State) WatchConfig() error {
 					debounceTimer = time.AfterFunc(100*time.Millisecond, func() {
 						fmt.Println("Config file changed, reloading...")
 
-						// Load the new state
-						newState := LoadState()
-
-						// Update the global state with proper locking
-						s.mu.Lock()
-						s.Instances = newState.Instances
-						s.Templates = newState.Templates
-						s.Resources = newState.Resources
-						s.Counters = newState.Counters
-						s.Types = newState.Types
-						s.mu.Unlock()
+						if err := s.Reload(); err != nil {
+							fmt.Printf("Config not reloaded: %v\n", err)
+							return
+						}
 
 						fmt.Println("Config reloaded successfully")
 					})
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a pluggable persistence backend for State
+type Store interface {
+	Load() (*State, error)             // Read the full state (nil, nil if nothing stored yet)
+	Save(s *State) error               // Persist the full state
+	SaveInstance(inst *Instance) error // Persist a single instance row
+	DeleteInstance(name string) error  // Remove a single instance row
+	AppendEvent(ev *Event) error       // Append to the event table
+	ReadEvents() ([]*Event, error)     // Read the event table in order
+	// Read the events appended after cursor, which is 0 or the cursor
+	// returned by an earlier call, and return the cursor to continue from
+	ReadEventsAfter(cursor int64) ([]*Event, int64, error)
+}
+
+// Event is a single entry in the state event table
+type Event struct {
+	Time     int64  `json:"time"`               // Unix timestamp
+	Type     string `json:"type"`               // status|start|stop|...
+	Actor    string `json:"actor"`              // cli:<user>, http:<origin> or reconciler
+	Instance string `json:"instance,omitempty"` // Instance name, if any
+	Detail   string `json:"detail,omitempty"`   // Free-form detail
+}
+
+// stateDir returns the directory holding vp's persisted state (~/.vibeprocess)
+func stateDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		// Fallback to /tmp if home directory cannot be determined
+		homeDir = "/tmp"
+	}
+	return filepath.Join(homeDir, ".vibeprocess")
+}
+
+// NewStore returns the backend selected by VP_STORE (json or bolt, default json)
+func NewStore() (Store, error) {
+	switch backend := os.Getenv("VP_STORE"); backend {
+	case "", "json":
+		return &jsonStore{dir: stateDir()}, nil
+	case "bolt":
+		return &boltStore{path: filepath.Join(stateDir(), "state.db")}, nil
+	default:
+		return nil, fmt.Errorf("unknown state backend: %s", backend)
+	}
+}
+
+// jsonStore keeps the whole state in a single JSON file
+type jsonStore struct {
+	dir string
+}
+
+func (j *jsonStore) stateFile() string  { return filepath.Join(j.dir, "state.json") }
+func (j *jsonStore) eventsFile() string { return filepath.Join(j.dir, "events.jsonl") }
+
+func (j *jsonStore) Load() (*State, error) {
+	data, err := os.ReadFile(j.stateFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (j *jsonStore) Save(s *State) error {
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so readers never see a partial file
+	tmp := j.stateFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.stateFile())
+}
+
+// SaveInstance has no row granularity in a JSON file, so the caller's full
+// Save covers it
+func (j *jsonStore) SaveInstance(inst *Instance) error { return nil }
+func (j *jsonStore) DeleteInstance(name string) error  { return nil }
+
+func (j *jsonStore) AppendEvent(ev *Event) error {
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.eventsFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (j *jsonStore) ReadEvents() ([]*Event, error) {
+	events, _, err := j.ReadEventsAfter(0)
+	return events, err
+}
+
+// ReadEventsAfter reads from a byte offset into events.jsonl, up to the last
+// complete line
+func (j *jsonStore) ReadEventsAfter(cursor int64) ([]*Event, int64, error) {
+	f, err := os.Open(j.eventsFile())
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() < cursor {
+		cursor = 0 // The journal was replaced; start over
+	}
+	if _, err := f.Seek(cursor, io.SeekStart); err != nil {
+		return nil, cursor, err
+	}
+
+	var events []*Event
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // A line still being written is read again next time
+		}
+		if err != nil {
+			return events, cursor, err
+		}
+		cursor += int64(len(line))
+		var ev Event
+		if err := json.Unmarshal(line, &ev); err != nil {
+			continue // Skip torn or corrupt lines
+		}
+		events = append(events, &ev)
+	}
+	return events, cursor, nil
+}
+
+// Bucket names for the bolt backend
+var (
+	bucketInstances = []byte("instances")
+	bucketTemplates = []byte("templates")
+	bucketResources = []byte("resources")
+	bucketCounters  = []byte("counters")
+	bucketTypes     = []byte("types")
+	bucketRemotes   = []byte("remotes_allowed")
+	bucketProjects  = []byte("projects")
+	bucketTokens    = []byte("tokens")
+	bucketScopes    = []byte("remote_scopes")
+	bucketRoles     = []byte("roles")
+	bucketEvents    = []byte("events")
+)
+
+// boltStore keeps state in an embedded bbolt database, one row per entry.
+// The database is opened per operation so the CLI and a running daemon can
+// share it; bolt's file lock serializes writers.
+type boltStore struct {
+	path string
+	mu   sync.Mutex
+	seen map[string]map[string][]byte // bucket -> key -> row as last read or written
+}
+
+func (b *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (b *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(b.path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (b *boltStore) Load() (*State, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var s *State
+	seen := make(map[string]map[string][]byte)
+	err := b.view(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketInstances) == nil {
+			return nil // Never saved
+		}
+
+		s = &State{
+			Instances:      make(map[string]*Instance),
+			Templates:      make(map[string]*Template),
+			Resources:      make(map[string]*Resource),
+			Counters:       make(map[string]int),
+			Types:          make(map[string]*ResourceType),
+			RemotesAllowed: make(map[string]bool),
+			RemoteScopes:   make(map[string]string),
+			Projects:       make(map[string]*Project),
+			Tokens:         make(map[string]*APIToken),
+			Roles:          make(map[string]*Role),
+		}
+
+		loads := []struct {
+			bucket []byte
+			fn     func(k, v []byte) error
+		}{
+			{bucketInstances, func(k, v []byte) error {
+				var inst Instance
+				err := json.Unmarshal(v, &inst)
+				s.Instances[string(k)] = &inst
+				return err
+			}},
+			{bucketTemplates, func(k, v []byte) error {
+				var tmpl Template
+				err := json.Unmarshal(v, &tmpl)
+				s.Templates[string(k)] = &tmpl
+				return err
+			}},
+			{bucketResources, func(k, v []byte) error {
+				var res Resource
+				err := json.Unmarshal(v, &res)
+				s.Resources[string(k)] = &res
+				return err
+			}},
+			{bucketCounters, func(k, v []byte) error {
+				var n int
+				err := json.Unmarshal(v, &n)
+				s.Counters[string(k)] = n
+				return err
+			}},
+			{bucketTypes, func(k, v []byte) error {
+				var rt ResourceType
+				err := json.Unmarshal(v, &rt)
+				s.Types[string(k)] = &rt
+				return err
+			}},
+			{bucketRemotes, func(k, v []byte) error {
+				var allowed bool
+				err := json.Unmarshal(v, &allowed)
+				s.RemotesAllowed[string(k)] = allowed
+				return err
+			}},
+			{bucketScopes, func(k, v []byte) error {
+				var scope string
+				err := json.Unmarshal(v, &scope)
+				s.RemoteScopes[string(k)] = scope
+				return err
+			}},
+			{bucketProjects, func(k, v []byte) error {
+				var p Project
+				err := json.Unmarshal(v, &p)
+				s.Projects[string(k)] = &p
+				return err
+			}},
+			{bucketTokens, func(k, v []byte) error {
+				var t APIToken
+				err := json.Unmarshal(v, &t)
+				s.Tokens[string(k)] = &t
+				return err
+			}},
+			{bucketRoles, func(k, v []byte) error {
+				var role Role
+				err := json.Unmarshal(v, &role)
+				s.Roles[string(k)] = &role
+				return err
+			}},
+		}
+
+		for _, l := range loads {
+			bkt := tx.Bucket(l.bucket)
+			if bkt == nil {
+				continue
+			}
+			rows := make(map[string][]byte)
+			seen[string(l.bucket)] = rows
+			err := bkt.ForEach(func(k, v []byte) error {
+				rows[string(k)] = bytes.Clone(v) // Only valid during the transaction
+				return l.fn(k, v)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", l.bucket, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.seen = seen
+	return s, nil
+}
+
+// syncRows writes the rows of a bucket that changed since this process last
+// read or wrote them (seen), and deletes those it removed since. Rows it
+// never saw, such as ones another vp added meanwhile, are left alone. The
+// bucket's rows as now written are recorded in written.
+func syncRows[V any](tx *bolt.Tx, name []byte, rows map[string]V, seen, written map[string]map[string][]byte) error {
+	bkt, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+	old := seen[string(name)]
+	now := make(map[string][]byte, len(rows))
+	for k, v := range rows {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		now[k] = data
+		if prev, ok := old[k]; ok && bytes.Equal(prev, data) {
+			continue
+		}
+		if err := bkt.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	for k := range old {
+		if _, ok := rows[k]; !ok {
+			if err := bkt.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+	}
+	written[string(name)] = now
+	return nil
+}
+
+// Save writes the rows that changed, so that a CLI command and a running
+// daemon only overwrite each other's changes to the same row
+func (b *boltStore) Save(s *State) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	written := make(map[string]map[string][]byte)
+	err := b.update(func(tx *bolt.Tx) error {
+		if err := syncRows(tx, bucketInstances, s.Instances, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketTemplates, s.Templates, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketResources, s.Resources, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketCounters, s.Counters, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketTypes, s.Types, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketRemotes, s.RemotesAllowed, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketScopes, s.RemoteScopes, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketProjects, s.Projects, b.seen, written); err != nil {
+			return err
+		}
+		if err := syncRows(tx, bucketTokens, s.Tokens, b.seen, written); err != nil {
+			return err
+		}
+		return syncRows(tx, bucketRoles, s.Roles, b.seen, written)
+	})
+	if err == nil {
+		b.seen = written
+	}
+	return err
+}
+
+func (b *boltStore) SaveInstance(inst *Instance) error {
+	data, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bucketInstances)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(inst.Name), data)
+	})
+	if err == nil {
+		b.remember(bucketInstances, inst.Name, data)
+	}
+	return err
+}
+
+func (b *boltStore) DeleteInstance(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketInstances)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(name))
+	})
+	if err == nil {
+		b.remember(bucketInstances, name, nil)
+	}
+	return err
+}
+
+// remember records a row as written, or as deleted if data is nil
+func (b *boltStore) remember(bucket []byte, key string, data []byte) {
+	if b.seen == nil {
+		b.seen = make(map[string]map[string][]byte)
+	}
+	rows := b.seen[string(bucket)]
+	if rows == nil {
+		rows = make(map[string][]byte)
+		b.seen[string(bucket)] = rows
+	}
+	if data == nil {
+		delete(rows, key)
+	} else {
+		rows[key] = data
+	}
+}
+
+func (b *boltStore) AppendEvent(ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bucketEvents)
+		if err != nil {
+			return err
+		}
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bkt.Put(eventKey(seq), data)
+	})
+}
+
+// eventKey returns the key of an event row. Zero-padded sequence keys keep
+// events in insertion order.
+func eventKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", seq))
+}
+
+func (b *boltStore) ReadEvents() ([]*Event, error) {
+	events, _, err := b.ReadEventsAfter(0)
+	return events, err
+}
+
+// ReadEventsAfter reads the rows after a sequence number
+func (b *boltStore) ReadEventsAfter(cursor int64) ([]*Event, int64, error) {
+	var events []*Event
+	err := b.view(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketEvents)
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		for k, v := c.Seek(eventKey(uint64(cursor) + 1)); k != nil; k, v = c.Next() {
+			if seq, err := strconv.ParseInt(string(k), 10, 64); err == nil {
+				cursor = seq
+			}
+			var ev Event
+			if err := json.Unmarshal(v, &ev); err != nil {
+				continue // Skip corrupt rows
+			}
+			events = append(events, &ev)
+		}
+		return nil
+	})
+	return events, cursor, err
+}
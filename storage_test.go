@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBoltStoreRoundTrip tests that the bolt backend persists full state,
+// single instance rows and events
+func TestBoltStoreRoundTrip(t *testing.T) {
+	store := &boltStore{path: filepath.Join(t.TempDir(), "state.db")}
+
+	s := &State{
+		Instances: map[string]*Instance{
+			"web": {Name: "web", Command: "sleep 300", Status: "running", PID: 42},
+		},
+		Templates:      loadDefaultTemplates(),
+		Resources:      map[string]*Resource{"tcpport:3000": {Type: "tcpport", Value: "3000", Owner: "web"}},
+		Counters:       map[string]int{"tcpport": 3001},
+		Types:          DefaultResourceTypes(),
+		RemotesAllowed: map[string]bool{"localhost": true},
+	}
+	if err := store.Save(s); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Update a single row without rewriting the rest
+	s.Instances["web"].Status = "stopped"
+	s.Instances["web"].PID = 0
+	if err := store.SaveInstance(s.Instances["web"]); err != nil {
+		t.Fatalf("SaveInstance failed: %v", err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded == nil {
+		t.Fatalf("Expected state, got nil")
+	}
+	if inst := loaded.Instances["web"]; inst == nil || inst.Status != "stopped" || inst.PID != 0 {
+		t.Errorf("Expected stopped instance 'web', got %+v", inst)
+	}
+	if loaded.Counters["tcpport"] != 3001 {
+		t.Errorf("Expected counter 3001, got %d", loaded.Counters["tcpport"])
+	}
+	if loaded.Resources["tcpport:3000"] == nil {
+		t.Errorf("Expected resource tcpport:3000 to be loaded")
+	}
+	if !loaded.RemotesAllowed["localhost"] {
+		t.Errorf("Expected localhost to be allowed")
+	}
+
+	if err := store.DeleteInstance("web"); err != nil {
+		t.Fatalf("DeleteInstance failed: %v", err)
+	}
+
+	for _, typ := range []string{"start", "stop"} {
+		if err := store.AppendEvent(&Event{Type: typ, Instance: "web"}); err != nil {
+			t.Fatalf("AppendEvent failed: %v", err)
+		}
+	}
+	events, err := store.ReadEvents()
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != "start" || events[1].Type != "stop" {
+		t.Errorf("Expected events [start stop] in order, got %d events", len(events))
+	}
+
+	loaded, _ = store.Load()
+	if loaded.Instances["web"] != nil {
+		t.Errorf("Expected instance 'web' to be deleted")
+	}
+}
+
+// TestBoltStoreSharedSave tests that two vp processes saving the same
+// database keep each other's changes to other rows
+func TestBoltStoreSharedSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	cli, daemon := &boltStore{path: path}, &boltStore{path: path}
+
+	base := &State{Instances: map[string]*Instance{"web": {Name: "web", Status: "running"}}}
+	if err := cli.Save(base); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	a, _ := cli.Load()
+	b, _ := daemon.Load()
+
+	a.Instances["api"] = &Instance{Name: "api", Status: "running"}
+	if err := cli.Save(a); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	b.Instances["web"].Status = "stopped"
+	if err := daemon.Save(b); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, _ := cli.Load()
+	if loaded.Instances["api"] == nil {
+		t.Errorf("Expected the daemon's save to keep instance 'api'")
+	}
+	if inst := loaded.Instances["web"]; inst == nil || inst.Status != "stopped" {
+		t.Errorf("Expected 'web' stopped, got %+v", inst)
+	}
+
+	// Rows a process removed itself are deleted
+	delete(loaded.Instances, "web")
+	cli.Save(loaded)
+	if loaded, _ := daemon.Load(); loaded.Instances["web"] != nil || loaded.Instances["api"] == nil {
+		t.Errorf("Expected only 'api' left, got %v", loaded.Instances)
+	}
+}
+
+// TestLoadStateError tests that unreadable state is an error rather than
+// replaced by defaults
+func TestLoadStateError(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("VP_STORE", "json")
+	os.MkdirAll(filepath.Join(home, ".vibeprocess"), 0755)
+	os.WriteFile(filepath.Join(home, ".vibeprocess", "state.json"), []byte("{"), 0600)
+
+	if _, err := LoadState(); err == nil {
+		t.Errorf("Expected a corrupt state file to fail to load")
+	}
+}
+
+// TestReadEventsAfter tests that both backends return only the events
+// appended since a cursor, and that a torn line is read once complete
+func TestReadEventsAfter(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]Store{
+		"json": &jsonStore{dir: dir},
+		"bolt": &boltStore{path: filepath.Join(dir, "state.db")},
+	}
+	for name, store := range stores {
+		if events, cursor, err := store.ReadEventsAfter(0); err != nil || len(events) != 0 || cursor != 0 {
+			t.Errorf("%s: expected no events, got %d, %d, %v", name, len(events), cursor, err)
+		}
+		store.AppendEvent(&Event{Type: "start"})
+		store.AppendEvent(&Event{Type: "stop"})
+		events, cursor, err := store.ReadEventsAfter(0)
+		if err != nil || len(events) != 2 {
+			t.Fatalf("%s: expected 2 events, got %d, %v", name, len(events), err)
+		}
+
+		store.AppendEvent(&Event{Type: "restart"})
+		events, next, err := store.ReadEventsAfter(cursor)
+		if err != nil || len(events) != 1 || events[0].Type != "restart" || next <= cursor {
+			t.Errorf("%s: expected only the restart event, got %d events, cursor %d -> %d", name, len(events), cursor, next)
+		}
+		if events, again, _ := store.ReadEventsAfter(next); len(events) != 0 || again != next {
+			t.Errorf("%s: expected nothing new, got %d events, cursor %d -> %d", name, len(events), next, again)
+		}
+	}
+
+	// A line still being written is left for the next read
+	journal := stores["json"].(*jsonStore)
+	_, cursor, _ := journal.ReadEventsAfter(0)
+	f, err := os.OpenFile(journal.eventsFile(), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"st`)
+	if events, next, _ := journal.ReadEventsAfter(cursor); len(events) != 0 || next != cursor {
+		t.Errorf("Expected the torn line to be skipped for now, got %d events, cursor %d -> %d", len(events), cursor, next)
+	}
+	f.WriteString(`op"}` + "\n")
+	f.Close()
+	if events, _, _ := journal.ReadEventsAfter(cursor); len(events) != 1 || events[0].Type != "stop" {
+		t.Errorf("Expected the completed line, got %d events", len(events))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StreamMessage is a single push update sent to /api/stream subscribers
+type StreamMessage struct {
+	Kind     string      `json:"kind"`               // event|instances|log
+	Instance string      `json:"instance,omitempty"` // Instance the message is about, if any
+	Data     interface{} `json:"data"`
+}
+
+// broker fans out stream messages to all subscribers
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan *StreamMessage]bool
+}
+
+var streamBroker = &broker{subs: make(map[chan *StreamMessage]bool)}
+
+// Subscribe registers a new subscriber channel
+func (b *broker) Subscribe() chan *StreamMessage {
+	ch := make(chan *StreamMessage, 64)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe removes a subscriber channel
+func (b *broker) Unsubscribe(ch chan *StreamMessage) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// Publish sends a message to every subscriber without blocking.
+// Slow subscribers miss messages rather than stalling vp.
+func (b *broker) Publish(msg *StreamMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// instancesSnapshot marshals the instances of a project ("*" = all) that
+// the request may view; a nil request sees everything. The caller holds
+// state.mu.
+func instancesSnapshot(project string, r *http.Request) []byte {
+	instances := state.Instances
+	if project != "*" {
+		instances = state.ProjectInstances(project)
+	}
+	if r != nil {
+		instances = visibleInstances(r, instances)
+	}
+	data, _ := json.Marshal(instances)
+	return data
+}
+
+// RunReconciler refreshes instance state on a fixed interval, publishing the
+// instance table when it changes and tailing logs. A single loop serves
+// every connected dashboard instead of one /proc scan per poll.
+func RunReconciler(interval time.Duration) {
+	var last []byte
+	for {
+		last = reconcile(last)
+		time.Sleep(interval)
+	}
+}
+
+// reconcile is one pass of RunReconciler. It takes the instance table last
+// published and returns the current one.
+func reconcile(last []byte) []byte {
+	state.mu.Lock()
+	if err := MatchAndUpdateInstances(state); err != nil {
+		fmt.Printf("Reconciler: discovery failed: %v\n", err)
+	}
+	snapshot := instancesSnapshot("*", nil)
+	names := make([]string, 0, len(state.Instances))
+	for name := range state.Instances {
+		names = append(names, name)
+	}
+	state.mu.Unlock()
+
+	if !bytes.Equal(snapshot, last) {
+		streamBroker.Publish(&StreamMessage{Kind: "instances", Data: json.RawMessage(snapshot)})
+	}
+	globalLogTailer.Poll(names)
+	return snapshot
+}
+
+// writeSSE writes a single server-sent event
+func writeSSE(w http.ResponseWriter, kind string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+}
+
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Optional filters: ?project= limits instances, ?instance= limits events and logs
+	project := "*"
+	if r.URL.Query().Has("project") {
+		project = r.URL.Query().Get("project")
+	}
+	instance := r.URL.Query().Get("instance")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := streamBroker.Subscribe()
+	defer streamBroker.Unsubscribe(ch)
+
+	// Start with the current table so clients don't need a separate fetch.
+	// The stream takes the state only for each message from then on.
+	snapshot := instancesSnapshot(project, r)
+	releaseState(r)
+	writeSSE(w, "instances", snapshot)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+
+		case msg := <-ch:
+			if instance != "" && msg.Instance != "" && msg.Instance != instance {
+				continue
+			}
+			state.mu.RLock()
+			visible := msg.Kind == "instances" || canViewEvent(principal(r), msg.Instance)
+			var data []byte
+			if msg.Kind == "instances" {
+				data = instancesSnapshot(project, r)
+			}
+			state.mu.RUnlock()
+			if !visible {
+				continue
+			}
+			if data == nil {
+				data, _ = json.Marshal(msg)
+			}
+			writeSSE(w, msg.Kind, data)
+			flusher.Flush()
+		}
+	}
+}
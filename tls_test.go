@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+// TestEnsureSelfSigned tests that the local CA and server certificate are
+// created once, reused, and verify for the requested hosts
+func TestEnsureSelfSigned(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	hosts := []string{"localhost", "127.0.0.1", "vp.example"}
+	certFile, keyFile, caFile, err := EnsureSelfSigned(hosts)
+	if err != nil {
+		t.Fatalf("EnsureSelfSigned failed: %v", err)
+	}
+	first, _ := os.ReadFile(certFile)
+
+	if _, _, _, err := EnsureSelfSigned(hosts); err != nil {
+		t.Fatalf("Second EnsureSelfSigned failed: %v", err)
+	}
+	if second, _ := os.ReadFile(certFile); string(first) != string(second) {
+		t.Errorf("Expected the server certificate to be reused")
+	}
+
+	if info, err := os.Stat(keyFile); err != nil {
+		t.Errorf("Expected private key file: %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected private key with mode 0600, got %v", info.Mode().Perm())
+	}
+
+	caPEM, _ := os.ReadFile(caFile)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	block, _ := pem.Decode(first)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse server certificate: %v", err)
+	}
+	for _, h := range hosts {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: h, Roots: pool}); err != nil {
+			t.Errorf("Certificate doesn't verify for %s: %v", h, err)
+		}
+	}
+
+	// A new host reissues the server certificate under the same CA
+	if _, _, _, err := EnsureSelfSigned(append(hosts, "other.example")); err != nil {
+		t.Fatalf("Reissue failed: %v", err)
+	}
+	if caAfter, _ := os.ReadFile(caFile); string(caAfter) != string(caPEM) {
+		t.Errorf("Expected the CA to be kept")
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// topSource is where vp top reads instances from and sends commands to:
+// local state, or the daemon when VP_DAEMON is set
+type topSource interface {
+	Instances() (map[string]*Instance, error)
+	Run(verb, name string) error
+	Logs(name string, n int) ([]string, error)
+}
+
+// localTop acts on the state file directly, like the other CLI commands
+type localTop struct {
+	all bool // Show every project instead of the current one
+}
+
+func (l *localTop) Instances() (map[string]*Instance, error) {
+	// Pick up instances started by other vp commands since the last refresh
+	if err := state.Reload(); err != nil {
+		return nil, err
+	}
+	if err := MatchAndUpdateInstances(state); err != nil {
+		return nil, err
+	}
+	if l.all {
+		return state.Instances, nil
+	}
+	return state.ProjectInstances(currentProject), nil
+}
+
+func (l *localTop) Run(verb, name string) error {
+	inst := state.Instances[name]
+	if inst == nil {
+		return fmt.Errorf("instance %s not found", name)
+	}
+
+	actor := cliActor()
+	switch verb {
+	case "start":
+		return RestartProcess(state, inst, actor)
+	case "stop":
+		if err := StopProcess(state, inst, actor); err != nil {
+			return err
+		}
+		state.ReleaseResources(name, actor)
+	case "restart":
+		if inst.Status == "running" {
+			if err := StopProcess(state, inst, actor); err != nil {
+				return err
+			}
+			state.ReleaseResources(name, actor)
+		}
+		return RestartProcess(state, inst, actor)
+	case "delete":
+		return DeleteInstance(state, inst, actor)
+	}
+	return state.Save()
+}
+
+func (l *localTop) Logs(name string, n int) ([]string, error) {
+	return TailLog(name, n)
+}
+
+// daemonTop goes through `vp serve --socket`, so the caller's roles apply
+type daemonTop struct {
+	all bool
+}
+
+func (d *daemonTop) Instances() (map[string]*Instance, error) {
+	path := "/api/instances?project=" + url.QueryEscape(currentProject)
+	if d.all {
+		path = "/api/instances"
+	}
+	var instances map[string]*Instance
+	err := daemonCall("GET", path, nil, &instances)
+	return instances, err
+}
+
+func (d *daemonTop) Run(verb, name string) error {
+	path := "/api/instances/" + url.PathEscape(name)
+	if verb == "delete" {
+		return daemonCall("DELETE", path, nil, nil)
+	}
+	return daemonCall("POST", path+":"+verb, nil, nil)
+}
+
+func (d *daemonTop) Logs(name string, n int) ([]string, error) {
+	var lines []string
+	err := daemonCall("GET", fmt.Sprintf("/api/logs?instance=%s&lines=%d", url.QueryEscape(name), n), nil, &lines)
+	return lines, err
+}
+
+// topSortKeys are the columns vp top can sort by, in the order 'o' cycles them
+var topSortKeys = []string{"name", "status", "pid", "cpu", "mem"}
+
+// topUsage returns the usage shown for an instance: its process tree totals
+// while running, else nil
+func topUsage(inst *Instance) *ProcessStats {
+	if inst.Totals != nil {
+		return &inst.Totals.ProcessStats
+	}
+	return inst.Stats
+}
+
+// topRows filters instances by a case-insensitive name substring and sorts
+// them by one of topSortKeys; ties keep name order
+func topRows(instances map[string]*Instance, filter, sortBy string, desc bool) []*Instance {
+	filter = strings.ToLower(filter)
+	rows := make([]*Instance, 0, len(instances))
+	for name, inst := range instances {
+		if filter == "" || strings.Contains(strings.ToLower(name), filter) {
+			rows = append(rows, inst)
+		}
+	}
+
+	value := func(inst *Instance) float64 {
+		u := topUsage(inst)
+		switch sortBy {
+		case "pid":
+			return float64(inst.PID)
+		case "cpu":
+			if u != nil {
+				return u.CPUPercent
+			}
+		case "mem":
+			if u != nil {
+				return float64(u.RSS)
+			}
+		}
+		return 0
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		less, greater := false, false
+		switch sortBy {
+		case "name":
+			less, greater = a.Name < b.Name, a.Name > b.Name
+		case "status":
+			less, greater = a.Status < b.Status, a.Status > b.Status
+		default:
+			less, greater = value(a) < value(b), value(a) > value(b)
+		}
+		if desc {
+			return greater
+		}
+		return less
+	})
+	return rows
+}
+
+// topPorts lists the ports an instance's process tree listens on
+func topPorts(inst *Instance) string {
+	if inst.Totals == nil || len(inst.Totals.Ports) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(inst.Totals.Ports))
+	for i, p := range inst.Totals.Ports {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// fit pads or cuts s to exactly n columns
+func fit(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) > n {
+		if n == 1 {
+			return "…"
+		}
+		return string(r[:n-1]) + "…"
+	}
+	return s + strings.Repeat(" ", n-len(r))
+}
+
+// topUI is the state of the vp top screen
+type topUI struct {
+	src       topSource
+	instances map[string]*Instance
+	rows      []*Instance
+	selected  string // Name of the selected instance, kept across refreshes
+	cursor    int
+	sortBy    string
+	desc      bool
+	filter    string
+	mode      string // "list", "logs", "inspect", "filter" or "confirm"
+	view      string // Instance shown in the logs or inspect view
+	message   string // Result of the last action, shown in the footer
+	err       error  // Error of the last refresh
+}
+
+// refresh reloads instances
+func (t *topUI) refresh() {
+	instances, err := t.src.Instances()
+	t.err = err
+	if err == nil {
+		t.instances = instances
+	}
+	t.update()
+}
+
+// update re-filters and re-sorts the rows without reloading instances
+func (t *topUI) update() {
+	t.rows = topRows(t.instances, t.filter, t.sortBy, t.desc)
+
+	// Keep the selection on the same instance
+	t.cursor = 0
+	for i, inst := range t.rows {
+		if inst.Name == t.selected {
+			t.cursor = i
+		}
+	}
+	t.selectRow(t.cursor)
+}
+
+func (t *topUI) selectRow(i int) {
+	if i >= len(t.rows) {
+		i = len(t.rows) - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	t.cursor = i
+	t.selected = ""
+	if i < len(t.rows) {
+		t.selected = t.rows[i].Name
+	}
+}
+
+// run performs an action on the selected instance
+func (t *topUI) run(verb string) {
+	if t.selected == "" {
+		return
+	}
+	if err := t.src.Run(verb, t.selected); err != nil {
+		t.message = "Error: " + err.Error()
+	} else {
+		t.message = map[string]string{"start": "Started ", "stop": "Stopped ", "restart": "Restarted ", "delete": "Deleted "}[verb] + t.selected
+	}
+	t.refresh()
+}
+
+// handleKey applies a key press; it reports false when vp top should exit
+func (t *topUI) handleKey(key string) bool {
+	if key == "ctrl-c" {
+		return false
+	}
+
+	switch t.mode {
+	case "filter":
+		switch key {
+		case "enter":
+			t.mode = "list"
+		case "esc":
+			t.filter, t.mode = "", "list"
+		case "backspace":
+			if r := []rune(t.filter); len(r) > 0 {
+				t.filter = string(r[:len(r)-1])
+			}
+		default:
+			if len(key) == 1 && key[0] >= ' ' {
+				t.filter += key
+			}
+		}
+		t.update()
+		return true
+
+	case "confirm":
+		t.mode = "list"
+		if key == "y" || key == "Y" {
+			t.run("delete")
+		} else {
+			t.message = ""
+		}
+		return true
+
+	case "logs", "inspect":
+		switch key {
+		case "q", "esc", "enter":
+			t.mode = "list"
+		case "l":
+			t.mode = "logs"
+		case "i":
+			t.mode = "inspect"
+		}
+		return true
+	}
+
+	switch key {
+	case "q":
+		return false
+	case "up", "k":
+		t.selectRow(t.cursor - 1)
+	case "down", "j":
+		t.selectRow(t.cursor + 1)
+	case "home", "g":
+		t.selectRow(0)
+	case "end", "G":
+		t.selectRow(len(t.rows) - 1)
+	case "s":
+		t.run("start")
+	case "x":
+		t.run("stop")
+	case "r":
+		t.run("restart")
+	case "d":
+		if t.selected != "" {
+			t.mode = "confirm"
+		}
+	case "l":
+		if t.selected != "" {
+			t.mode, t.view = "logs", t.selected
+		}
+	case "i", "enter":
+		if t.selected != "" {
+			t.mode, t.view = "inspect", t.selected
+		}
+	case "/":
+		t.mode = "filter"
+	case "esc":
+		t.filter = ""
+		t.update()
+	case "o":
+		for i, k := range topSortKeys {
+			if k == t.sortBy {
+				t.sortBy = topSortKeys[(i+1)%len(topSortKeys)]
+				break
+			}
+		}
+		t.update()
+	case "O":
+		t.desc = !t.desc
+		t.update()
+	}
+	return true
+}
+
+// render draws the current view into a width x height frame
+func (t *topUI) render(width, height int) []string {
+	var lines []string
+	switch t.mode {
+	case "logs":
+		lines = t.renderLogs(width, height)
+	case "inspect":
+		lines = t.renderInspect(width, height)
+	default:
+		lines = t.renderList(width, height)
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	return append(lines, "\x1b[7m"+fit(t.footer(), width)+"\x1b[0m")
+}
+
+func (t *topUI) footer() string {
+	switch t.mode {
+	case "filter":
+		return "Filter: " + t.filter + "_  (enter to apply, esc to clear)"
+	case "confirm":
+		return fmt.Sprintf("Delete %s? (y/n)", t.selected)
+	case "logs", "inspect":
+		return "q back  l logs  i inspect"
+	}
+	if t.err != nil {
+		return "Error: " + t.err.Error()
+	}
+	if t.message != "" {
+		return t.message
+	}
+	return "↑↓ select  s start  x stop  r restart  d delete  l logs  i inspect  / filter  o sort  O reverse  q quit"
+}
+
+func (t *topUI) renderList(width, height int) []string {
+	running := 0
+	for _, inst := range t.instances {
+		if inst.Status == "running" {
+			running++
+		}
+	}
+	order := "asc"
+	if t.desc {
+		order = "desc"
+	}
+	title := fmt.Sprintf("vp top - %d instances, %d running - sort %s %s", len(t.instances), running, t.sortBy, order)
+	if t.filter != "" {
+		title += " - filter " + t.filter
+	}
+	lines := []string{fit(title, width), ""}
+
+	// The command gets whatever width the fixed columns leave
+	const fixed = 20 + 10 + 8 + 7 + 9 + 16 + 6
+	cmdWidth := width - fixed
+	lines = append(lines, "\x1b[1m"+fit(fmt.Sprintf("%-20s %-9s %-7s %6s %8s  %-15s %s",
+		"NAME", "STATUS", "PID", "CPU%", "MEM", "PORTS", "COMMAND"), width)+"\x1b[0m")
+
+	// Scroll so the selected row stays visible
+	visible := height - 4
+	first := 0
+	if visible > 0 && t.cursor >= visible {
+		first = t.cursor - visible + 1
+	}
+	for i := first; i < len(t.rows) && i-first < visible; i++ {
+		inst := t.rows[i]
+		cpu, mem := "-", "-"
+		if u := topUsage(inst); u != nil {
+			cpu, mem = fmt.Sprintf("%.1f", u.CPUPercent), formatBytes(u.RSS)
+		}
+		pid := "-"
+		if inst.PID > 0 {
+			pid = strconv.Itoa(inst.PID)
+		}
+		line := fit(fmt.Sprintf("%-20s %-9s %-7s %6s %8s  %-15s %s",
+			fit(inst.Name, 20), inst.Status, pid, cpu, mem, fit(topPorts(inst), 15), fit(inst.Command, cmdWidth)), width)
+		if i == t.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	if len(t.rows) == 0 {
+		lines = append(lines, "No instances")
+	}
+	return lines
+}
+
+func (t *topUI) renderLogs(width, height int) []string {
+	lines := []string{fit("Logs: "+t.view+" (following)", width), ""}
+	logs, err := t.src.Logs(t.view, height-3)
+	if err != nil {
+		return append(lines, "Error: "+err.Error())
+	}
+	for _, l := range logs {
+		lines = append(lines, fit(strings.ReplaceAll(l, "\t", "    "), width))
+	}
+	return lines
+}
+
+func (t *topUI) renderInspect(width, height int) []string {
+	lines := []string{fit("Inspect: "+t.view, width), ""}
+	inst := t.instances[t.view]
+	if inst == nil {
+		return append(lines, "Instance is gone")
+	}
+
+	lines = append(lines,
+		"Status:    "+inst.Status,
+		"PID:       "+strconv.Itoa(inst.PID),
+		"Template:  "+inst.Template,
+		"Command:   "+inst.Command,
+		"Directory: "+inst.Cwd,
+		"Ports:     "+topPorts(inst),
+		"", "Resources:")
+	keys := make([]string, 0, len(inst.Resources))
+	for k := range inst.Resources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %s = %s", k, inst.Resources[k]))
+	}
+
+	if u := topUsage(inst); u != nil {
+		data, _ := json.MarshalIndent(u, "  ", "  ")
+		lines = append(lines, "", "Usage:")
+		lines = append(lines, strings.Split("  "+string(data), "\n")...)
+	}
+	for i := range lines {
+		lines[i] = fit(lines[i], width)
+	}
+	return lines
+}
+
+// readKeys turns terminal input into key names: "up", "down", "enter",
+// "esc", "backspace", "ctrl-c", or the character typed
+func readKeys(r *bufio.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
+
+// parseKeys splits one read from the terminal into key names
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		if b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O') {
+			name := map[byte]string{'A': "up", 'B': "down", 'H': "home", 'F': "end"}[b[2]]
+			if name != "" {
+				keys = append(keys, name)
+			}
+			b = b[3:]
+			continue
+		}
+
+		switch b[0] {
+		case 0x1b:
+			keys = append(keys, "esc")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case 0x7f, 0x08:
+			keys = append(keys, "backspace")
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		default:
+			keys = append(keys, string(b[0]))
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// termSize returns the terminal's columns and rows
+func termSize(fd int) (int, int) {
+	var ws struct{ Row, Col, X, Y uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 || ws.Col == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// makeRaw switches the terminal to unbuffered input without echo and returns
+// the previous settings. rawOutput also turns off output processing.
+func makeRaw(fd int, rawOutput bool) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, errno
+	}
+	raw := old
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	if rawOutput {
+		raw.Oflag &^= syscall.OPOST
+	}
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+func setTermios(fd int, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func handleTop(args []string) {
+	vars := parseVars(args)
+
+	interval := 2 * time.Second
+	if v := vars["interval"]; v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			interval = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	var src topSource = &localTop{all: vars["all"] == "true"}
+	if daemonSocket() != "" {
+		src = &daemonTop{all: vars["all"] == "true"}
+	}
+
+	fd := int(os.Stdin.Fd())
+	old, err := makeRaw(fd, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vp top needs a terminal: %v\n", err)
+		os.Exit(1)
+	}
+	// Alternate screen, hidden cursor; both are undone on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		setTermios(fd, old)
+	}()
+
+	t := &topUI{src: src, sortBy: "name", mode: "list"}
+	t.refresh()
+
+	keys := make(chan string)
+	go readKeys(bufio.NewReader(os.Stdin), keys)
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		width, height := termSize(fd)
+		frame := t.render(width, height)
+		fmt.Print("\x1b[H" + strings.Join(frame, "\x1b[K\n") + "\x1b[K\x1b[J")
+
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				return
+			}
+		case <-ticker.C:
+			t.refresh()
+			if t.mode == "list" {
+				t.message = ""
+			}
+		case <-resize:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeTop is a topSource over a fixed set of instances
+type fakeTop struct {
+	instances map[string]*Instance
+	ran       []string
+}
+
+func (f *fakeTop) Instances() (map[string]*Instance, error)  { return f.instances, nil }
+func (f *fakeTop) Logs(name string, n int) ([]string, error) { return []string{"hello"}, nil }
+func (f *fakeTop) Run(verb, name string) error {
+	f.ran = append(f.ran, verb+" "+name)
+	return nil
+}
+
+func topFixture() map[string]*Instance {
+	return map[string]*Instance{
+		"api":    {Name: "api", Status: "running", PID: 30, Totals: &TreeTotals{Ports: []int{8080}, ProcessStats: ProcessStats{CPUPercent: 5, RSS: 300}}},
+		"db":     {Name: "db", Status: "running", PID: 10, Totals: &TreeTotals{ProcessStats: ProcessStats{CPUPercent: 50, RSS: 100}}},
+		"worker": {Name: "worker", Status: "stopped"},
+	}
+}
+
+// TestTopRows tests sorting and filtering of the vp top table
+func TestTopRows(t *testing.T) {
+	names := func(rows []*Instance) []string {
+		var out []string
+		for _, r := range rows {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		filter, sortBy string
+		desc           bool
+		want           []string
+	}{
+		{"", "name", false, []string{"api", "db", "worker"}},
+		{"", "cpu", true, []string{"db", "api", "worker"}},
+		{"", "mem", true, []string{"api", "db", "worker"}},
+		{"", "pid", false, []string{"worker", "db", "api"}},
+		{"", "status", true, []string{"worker", "api", "db"}},
+		{"DB", "name", false, []string{"db"}},
+	}
+	for _, tt := range tests {
+		if got := names(topRows(topFixture(), tt.filter, tt.sortBy, tt.desc)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topRows(%q, %s, desc=%v) = %v, want %v", tt.filter, tt.sortBy, tt.desc, got, tt.want)
+		}
+	}
+}
+
+// TestTopKeys tests selection, actions and the delete confirmation
+func TestTopKeys(t *testing.T) {
+	src := &fakeTop{instances: topFixture()}
+	ui := &topUI{src: src, sortBy: "name", mode: "list"}
+	ui.refresh()
+
+	for _, k := range parseKeys([]byte("j\x1b[Bkx")) {
+		ui.handleKey(k)
+	}
+	if ui.selected != "db" {
+		t.Errorf("Expected db selected, got %q", ui.selected)
+	}
+
+	ui.handleKey("d")
+	ui.handleKey("n")
+	ui.handleKey("d")
+	ui.handleKey("y")
+	if want := []string{"stop db", "delete db"}; !reflect.DeepEqual(src.ran, want) {
+		t.Errorf("Expected actions %v, got %v", want, src.ran)
+	}
+
+	// The selection follows the instance when the order changes
+	ui.handleKey("o") // status
+	if ui.selected != "db" {
+		t.Errorf("Expected selection to stay on db, got %q", ui.selected)
+	}
+
+	for _, k := range parseKeys([]byte("/work\r")) {
+		ui.handleKey(k)
+	}
+	if len(ui.rows) != 1 || ui.selected != "worker" {
+		t.Errorf("Expected filter to leave worker, got %v", ui.rows)
+	}
+
+	frame := ui.render(100, 10)
+	if len(frame) != 10 || !strings.Contains(strings.Join(frame, "\n"), "worker") {
+		t.Errorf("Unexpected frame:\n%s", strings.Join(frame, "\n"))
+	}
+
+	if ui.handleKey("q") {
+		t.Error("Expected q to quit")
+	}
+}
+
+// TestParseKeys tests decoding of terminal input
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("\x1b[A\x1b[Bq\r\x7f\x03\x1b"))
+	want := []string{"up", "down", "q", "enter", "backspace", "ctrl-c", "esc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeys = %v, want %v", got, want)
+	}
+}
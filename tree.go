@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ProcessTree is a process with all of its descendants
+type ProcessTree struct {
+	PID     int     `json:"pid"`
+	Name    string  `json:"name"`
+	Cmdline string  `json:"cmdline"`
+	CPUTime float64 `json:"cputime"`
+	Ports   []int   `json:"ports,omitempty"`
+	ProcessStats
+	Children []*ProcessTree `json:"children,omitempty"`
+}
+
+// TreeTotals sums resource usage over an instance's whole process tree.
+// State and StartTime of the embedded stats are left empty.
+type TreeTotals struct {
+	Processes int     `json:"processes"`       // Processes in the tree
+	CPUTime   float64 `json:"cputime"`         // CPU seconds of all processes
+	Ports     []int   `json:"ports,omitempty"` // Ports any process in the tree listens on
+	ProcessStats
+}
+
+// BuildProcessTree reads pid and its descendants. children comes from
+// GetChildrenMap; processes that exit while walking are skipped.
+func BuildProcessTree(children map[int][]int, pid int) (*ProcessTree, error) {
+	return buildProcessTree(children, pid, make(map[int]bool))
+}
+
+func buildProcessTree(children map[int][]int, pid int, seen map[int]bool) (*ProcessTree, error) {
+	seen[pid] = true
+
+	stats, err := ReadProcessStats(pid)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ReadProcessInfo(pid) // From globalProcessCache, ReadProcessStats just read it
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &ProcessTree{
+		PID:          pid,
+		Name:         info.Name,
+		Cmdline:      info.Cmdline,
+		CPUTime:      info.CPUTime,
+		Ports:        info.Ports,
+		ProcessStats: *stats,
+	}
+
+	kids := append([]int(nil), children[pid]...)
+	sort.Ints(kids)
+	for _, child := range kids {
+		if seen[child] {
+			continue
+		}
+		if sub, err := buildProcessTree(children, child, seen); err == nil {
+			tree.Children = append(tree.Children, sub)
+		}
+	}
+	return tree, nil
+}
+
+// Totals sums the tree's resource usage
+func (t *ProcessTree) Totals() *TreeTotals {
+	totals := &TreeTotals{}
+	totals.FDs = -1
+	ports := make(map[int]bool)
+
+	var walk func(n *ProcessTree)
+	walk = func(n *ProcessTree) {
+		totals.Processes++
+		totals.CPUTime += n.CPUTime
+		totals.CPUPercent += n.CPUPercent
+		totals.Threads += n.Threads
+		totals.RSS += n.RSS
+		totals.PSS += n.PSS
+		totals.ReadBytes += n.ReadBytes
+		totals.WriteBytes += n.WriteBytes
+		if n.FDs >= 0 {
+			if totals.FDs < 0 {
+				totals.FDs = 0
+			}
+			totals.FDs += n.FDs
+		}
+		for _, p := range n.Ports {
+			ports[p] = true
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(t)
+
+	for p := range ports {
+		totals.Ports = append(totals.Ports, p)
+	}
+	sort.Ints(totals.Ports)
+	return totals
+}
+
+// Print writes the tree with box-drawing branches, one process per line
+func (t *ProcessTree) Print(prefix string, last, root bool) {
+	branch := ""
+	childPrefix := ""
+	if !root {
+		branch = "├─ "
+		childPrefix = prefix + "│  "
+		if last {
+			branch = "└─ "
+			childPrefix = prefix + "   "
+		}
+	}
+
+	ports := ""
+	if len(t.Ports) > 0 {
+		parts := make([]string, len(t.Ports))
+		for i, p := range t.Ports {
+			parts[i] = fmt.Sprint(p)
+		}
+		ports = " ports " + strings.Join(parts, ",")
+	}
+	fmt.Printf("%s%s%d %s  [cpu %.1f%% rss %s thr %d%s]\n",
+		prefix, branch, t.PID, truncate(t.Cmdline, 60), t.CPUPercent, formatBytes(t.RSS), t.Threads, ports)
+
+	for i, c := range t.Children {
+		c.Print(childPrefix, i == len(t.Children)-1, false)
+	}
+}
+
+func handleTree(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp tree <name>\n")
+		os.Exit(1)
+	}
+
+	name := cliKey(args[0])
+	inst := state.Instances[name]
+	if inst == nil {
+		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
+		os.Exit(1)
+	}
+	if inst.Status != "running" || inst.PID == 0 {
+		fmt.Fprintf(os.Stderr, "Instance %s is not running\n", name)
+		os.Exit(1)
+	}
+
+	children, err := GetChildrenMap()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	tree, err := BuildProcessTree(children, inst.PID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	printObject(tree, displayName(inst), func(bool) {
+		tree.Print("", true, true)
+
+		totals := tree.Totals()
+		fmt.Printf("\nTotal: %d processes, cpu %.1f%%, cpu time %s, rss %s, threads %d\n",
+			totals.Processes, totals.CPUPercent, formatCPUTime(totals.CPUTime), formatBytes(totals.RSS), totals.Threads)
+	})
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Instances of templates with "tty": true run on a pseudo-terminal. Because
+// `vp start` exits right away, the PTY is held by a `vp tty-host` process
+// that lives as long as the instance. It copies output to the instance log,
+// keeps a scrollback buffer and serves attach clients on a unix socket.
+
+// ttyScrollback is how much recent output a tty host replays to new clients
+const ttyScrollback = 256 * 1024
+
+// Frame types sent by attach clients to the tty host; output flows back
+// unframed
+const (
+	ttyInput  = 'i' // Keyboard input
+	ttyResize = 'r' // uint16 rows, uint16 cols
+)
+
+// TTYSocket returns the socket the tty host of an instance listens on
+func TTYSocket(name string) string {
+	return filepath.Join(stateDir(), "tty", strings.ReplaceAll(name, "/", "__")+".sock")
+}
+
+// StartTTY starts a command on a new PTY under a tty host and returns the
+// command's PID. The command is a session leader, so stopping its process
+// group leaves the host to notice the exit and clean up. A nil env runs it
+// with vp's environment.
+func StartTTY(name string, parts []string, dir string, env []string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	host := exec.Command(exe, append([]string{"tty-host", name, "--"}, parts...)...)
+	host.Dir = dir
+	host.Env = env
+	host.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if logFile, err := openInstanceLog(name); err == nil {
+		host.Stderr = logFile
+		defer logFile.Close()
+	}
+	out, err := host.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := host.Start(); err != nil {
+		return 0, err
+	}
+
+	// The host reports the command's PID on its stdout once it is running
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		host.Wait()
+		return 0, fmt.Errorf("tty host exited, see the instance log")
+	}
+	go host.Wait() // Reap the host when the instance exits
+	return strconv.Atoi(strings.TrimSpace(line))
+}
+
+// ioctl performs an ioctl with a pointer argument
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPTY allocates a pseudo-terminal pair
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlock pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("pty number: %w", err)
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// setWinsize sets a terminal's size
+func setWinsize(f *os.File, rows, cols uint16) error {
+	ws := struct{ Row, Col, X, Y uint16 }{rows, cols, 0, 0}
+	return ioctl(f.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// ttyHost holds the PTY of one instance
+type ttyHost struct {
+	master     *os.File
+	log        io.Writer
+	mu         sync.Mutex
+	scrollback []byte
+	clients    map[net.Conn]bool
+}
+
+// pump copies output to the log, the scrollback and every client until the
+// PTY closes
+func (h *ttyHost) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := h.master.Read(buf)
+		if n > 0 {
+			h.broadcast(buf[:n])
+		}
+		if err != nil {
+			return // EIO once the command and its children have exited
+		}
+	}
+}
+
+func (h *ttyHost) broadcast(data []byte) {
+	if h.log != nil {
+		h.log.Write(data)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scrollback = append(h.scrollback, data...)
+	if over := len(h.scrollback) - ttyScrollback; over > 0 {
+		h.scrollback = append([]byte(nil), h.scrollback[over:]...)
+	}
+	for c := range h.clients {
+		// A client that can't keep up is dropped rather than stalling the command
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := c.Write(data); err != nil {
+			c.Close()
+			delete(h.clients, c)
+		}
+	}
+}
+
+// serve replays the scrollback to a client and then applies its input
+func (h *ttyHost) serve(c net.Conn) {
+	// Replayed under the lock so no output slips in before it, with the same
+	// deadline as broadcast so a stalled client can't hold up the command
+	h.mu.Lock()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write(h.scrollback); err != nil {
+		h.mu.Unlock()
+		c.Close()
+		return
+	}
+	h.clients[c] = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients, c)
+		h.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		typ, payload, err := readTTYFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case ttyInput:
+			h.master.Write(payload)
+		case ttyResize:
+			if len(payload) == 4 {
+				setWinsize(h.master, binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]))
+			}
+		}
+	}
+}
+
+// writeTTYFrame sends one client frame: type, uint32 length, payload
+func writeTTYFrame(w io.Writer, typ byte, payload []byte) error {
+	hdr := make([]byte, 5)
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+func readTTYFrame(r *bufio.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("frame too large")
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0], payload, err
+}
+
+// resizeFrame encodes a terminal size
+func resizeFrame(rows, cols uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, rows)
+	binary.BigEndian.PutUint16(b[2:], cols)
+	return b
+}
+
+// runTTYHost is `vp tty-host <name> -- <command...>`, started by StartTTY.
+// It must not load or save state: it outlives the vp that started it.
+func runTTYHost(args []string) {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintf(os.Stderr, "Usage: vp tty-host <name> -- <command...>\n")
+		os.Exit(1)
+	}
+	name, parts := args[0], args[2:]
+
+	master, slave, err := openPTY()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tty-host: %v\n", err)
+		os.Exit(1)
+	}
+	setWinsize(master, 24, 80)
+
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if os.Getenv("TERM") == "" {
+		cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "tty-host: %v\n", err)
+		os.Exit(1)
+	}
+	slave.Close()
+
+	h := &ttyHost{master: master, clients: make(map[net.Conn]bool)}
+	if logFile, err := openInstanceLog(name); err == nil {
+		h.log = logFile
+	}
+
+	socket := TTYSocket(name)
+	os.MkdirAll(filepath.Dir(socket), 0700)
+	os.Remove(socket)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tty-host: %v\n", err)
+	} else {
+		os.Chmod(socket, 0600)
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go h.serve(c)
+			}
+		}()
+	}
+
+	// Tell StartTTY the PID, then stop holding its pipe open
+	fmt.Println(cmd.Process.Pid)
+	os.Stdout.Close()
+	signal.Ignore(syscall.SIGHUP, syscall.SIGPIPE)
+
+	done := make(chan struct{})
+	go func() {
+		h.pump()
+		close(done)
+	}()
+	cmd.Wait()
+
+	// Background children may hold the terminal open; don't wait on them forever
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+	}
+
+	if ln != nil {
+		ln.Close()
+		os.Remove(socket)
+	}
+	h.mu.Lock()
+	for c := range h.clients {
+		c.Close()
+	}
+	h.mu.Unlock()
+}
+
+// parseDetachKeys parses a detach sequence such as "ctrl-]" or
+// "ctrl-p,ctrl-q" into the bytes a terminal sends for it
+func parseDetachKeys(spec string) ([]byte, error) {
+	var keys []byte
+	for _, k := range strings.Split(spec, ",") {
+		k = strings.TrimSpace(k)
+		switch {
+		case strings.HasPrefix(strings.ToLower(k), "ctrl-") && len(k) == 6:
+			c := k[5]
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			if c < '@' || c > '_' {
+				return nil, fmt.Errorf("invalid detach key %q", k)
+			}
+			keys = append(keys, c&0x1f)
+		case len(k) == 1:
+			keys = append(keys, k[0])
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", k)
+		}
+	}
+	return keys, nil
+}
+
+// detachScanner watches input for the detach sequence. Bytes that might
+// start the sequence are held back until it is clear they don't.
+type detachScanner struct {
+	keys    []byte
+	matched int
+}
+
+// Scan returns the input to forward and whether the sequence was completed
+func (d *detachScanner) Scan(in []byte) ([]byte, bool) {
+	var out []byte
+	for _, b := range in {
+		if b == d.keys[d.matched] {
+			d.matched++
+			if d.matched == len(d.keys) {
+				return out, true
+			}
+			continue
+		}
+		out = append(out, d.keys[:d.matched]...)
+		d.matched = 0
+		if b == d.keys[0] {
+			d.matched = 1
+			if len(d.keys) == 1 {
+				return out, true
+			}
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+func handleAttach(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: vp attach <name> [--detach-keys=ctrl-]]\n")
+		os.Exit(1)
+	}
+	vars := parseVars(args[1:])
+
+	spec := "ctrl-]"
+	if vars["detach-keys"] != "" {
+		spec = vars["detach-keys"]
+	}
+	keys, err := parseDetachKeys(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	name := cliKey(args[0])
+	inst := state.Instances[name]
+	if inst == nil {
+		fmt.Fprintf(os.Stderr, "Instance not found: %s\n", name)
+		os.Exit(1)
+	}
+	if !inst.TTY {
+		fmt.Fprintf(os.Stderr, "Instance %s has no terminal; set \"tty\": true in its template\n", name)
+		os.Exit(1)
+	}
+
+	conn, err := net.Dial("unix", TTYSocket(name))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Instance %s is not running: %v\n", name, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// Output goes through untouched: the instance's PTY already did the
+	// newline translation
+	fd := int(os.Stdin.Fd())
+	old, err := makeRaw(fd, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vp attach needs a terminal: %v\n", err)
+		os.Exit(1)
+	}
+	restore := func() { setTermios(fd, old) }
+	defer restore()
+
+	fmt.Fprintf(os.Stderr, "Attached to %s; detach with %s\r\n", name, spec)
+
+	sendSize := func() {
+		cols, rows := termSize(fd)
+		writeTTYFrame(conn, ttyResize, resizeFrame(uint16(rows), uint16(cols)))
+	}
+	sendSize()
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	go func() {
+		for range resize {
+			sendSize()
+		}
+	}()
+
+	exited := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(exited)
+	}()
+
+	input := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	scanner := &detachScanner{keys: keys}
+	for {
+		select {
+		case <-exited:
+			restore()
+			fmt.Fprintf(os.Stderr, "\n%s exited\n", name)
+			return
+		case data, ok := <-input:
+			if !ok {
+				return
+			}
+			out, detach := scanner.Scan(data)
+			if len(out) > 0 {
+				writeTTYFrame(conn, ttyInput, out)
+			}
+			if detach {
+				restore()
+				fmt.Fprintf(os.Stderr, "\nDetached from %s\n", name)
+				return
+			}
+		}
+	}
+}
+
+// ttyMessage is what the web console sends over the WebSocket
+type ttyMessage struct {
+	Type string `json:"type"` // input|resize
+	Data string `json:"data,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// handleInstanceTTY serves GET /api/instances/{name}/tty, a WebSocket onto
+// the instance's terminal. Output arrives as binary messages; the client
+// sends ttyMessage JSON as text messages.
+func handleInstanceTTY(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !authorize(w, r, VerbAttach, "instance", name) {
+		return
+	}
+	inst := state.Instances[name]
+	if inst == nil {
+		writeError(w, http.StatusNotFound, "instance %s not found", name)
+		return
+	}
+	if !inst.TTY {
+		writeError(w, http.StatusBadRequest, "instance %s has no terminal", name)
+		return
+	}
+
+	conn, err := net.Dial("unix", TTYSocket(name))
+	if err != nil {
+		writeError(w, http.StatusConflict, "instance %s is not running", name)
+		return
+	}
+	defer conn.Close()
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	defer ws.Close()
+	state.RecordEvent(httpActor(r), "attach", name, "web console")
+	releaseState(r) // The session needs nothing more from the state
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if ws.WriteMessage(wsBinary, buf[:n]) != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		ws.Close()
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ttyMessage
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "input":
+			err = writeTTYFrame(conn, ttyInput, []byte(msg.Data))
+		case "resize":
+			err = writeTTYFrame(conn, ttyResize, resizeFrame(msg.Rows, msg.Cols))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
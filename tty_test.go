@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestParseDetachKeys tests parsing of --detach-keys
+func TestParseDetachKeys(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []byte
+	}{
+		{"ctrl-]", []byte{0x1d}},
+		{"ctrl-p,ctrl-q", []byte{0x10, 0x11}},
+		{"CTRL-A, x", []byte{0x01, 'x'}},
+	}
+	for _, tt := range tests {
+		got, err := parseDetachKeys(tt.spec)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("parseDetachKeys(%q) = %v, %v, want %v", tt.spec, got, err, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"ctrl-1", "alt-x", ""} {
+		if _, err := parseDetachKeys(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+// TestDetachScanner tests that partial sequences are passed through and a
+// complete one detaches, also when split across reads
+func TestDetachScanner(t *testing.T) {
+	d := &detachScanner{keys: []byte{0x10, 0x11}}
+
+	if out, done := d.Scan([]byte("ab\x10")); done || string(out) != "ab" {
+		t.Errorf("Scan = %q, %v", out, done)
+	}
+	// Not the sequence after all: the held byte is sent
+	if out, done := d.Scan([]byte("c")); done || string(out) != "\x10c" {
+		t.Errorf("Scan = %q, %v", out, done)
+	}
+	if out, done := d.Scan([]byte("\x10\x10")); done || string(out) != "\x10" {
+		t.Errorf("Scan = %q, %v", out, done)
+	}
+	if out, done := d.Scan([]byte("\x11rest")); !done || len(out) != 0 {
+		t.Errorf("Expected detach, got %q, %v", out, done)
+	}
+}
+
+// TestTTYHostServe tests the scrollback limit, its replay and live output
+func TestTTYHostServe(t *testing.T) {
+	h := &ttyHost{clients: map[net.Conn]bool{}}
+	h.broadcast(bytes.Repeat([]byte("x"), ttyScrollback))
+	h.broadcast([]byte("tail"))
+	if len(h.scrollback) != ttyScrollback || !bytes.HasSuffix(h.scrollback, []byte("tail")) {
+		t.Fatalf("Expected scrollback trimmed to %d ending in tail, got %d", ttyScrollback, len(h.scrollback))
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go h.serve(server)
+
+	replay := make([]byte, ttyScrollback)
+	r := bufio.NewReader(client)
+	if _, err := io.ReadFull(r, replay); err != nil || !bytes.HasSuffix(replay, []byte("tail")) {
+		t.Fatalf("Expected scrollback replay, got err %v", err)
+	}
+
+	go h.broadcast([]byte("live"))
+	live := make([]byte, 4)
+	if _, err := io.ReadFull(r, live); err != nil || string(live) != "live" {
+		t.Errorf("Expected live output, got %q, %v", live, err)
+	}
+
+	// A client that never reads is dropped instead of holding the lock
+	stalled, server := net.Pipe()
+	defer stalled.Close()
+	done := make(chan struct{})
+	go func() {
+		h.serve(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the replay to a stalled client to time out")
+	}
+	h.mu.Lock()
+	if len(h.clients) != 1 {
+		t.Errorf("Expected only the reading client to remain, got %d", len(h.clients))
+	}
+	h.mu.Unlock()
+}
+
+// TestTTYFrames tests the client frame encoding
+func TestTTYFrames(t *testing.T) {
+	var buf bytes.Buffer
+	writeTTYFrame(&buf, ttyInput, []byte("ls\r"))
+	writeTTYFrame(&buf, ttyResize, resizeFrame(24, 80))
+
+	r := bufio.NewReader(&buf)
+	if typ, payload, err := readTTYFrame(r); err != nil || typ != ttyInput || string(payload) != "ls\r" {
+		t.Errorf("readTTYFrame = %c %q %v", typ, payload, err)
+	}
+	if typ, payload, err := readTTYFrame(r); err != nil || typ != ttyResize || !bytes.Equal(payload, []byte{0, 24, 0, 80}) {
+		t.Errorf("readTTYFrame = %c %v %v", typ, payload, err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchSettings make vp serve restart or reload an instance when files under
+// its workdir change, like nodemon or air do for a single language
+type WatchSettings struct {
+	Paths    []string `json:"paths,omitempty"`    // Files or directories, relative to ${workdir} (default ".")
+	Include  []string `json:"include,omitempty"`  // Globs a changed file must match (default any)
+	Exclude  []string `json:"exclude,omitempty"`  // Globs of files and directories to ignore
+	Debounce string   `json:"debounce,omitempty"` // Quiet period before acting (default 500ms)
+	Action   string   `json:"action,omitempty"`   // restart (default) or reload
+}
+
+// defaultWatchExcludes are ignored when a template sets no excludes:
+// version control, dependencies and editor swap files
+var defaultWatchExcludes = []string{".git", "node_modules", ".*.swp", "*~"}
+
+// debounce returns the quiet period before acting on changes
+func (ws *WatchSettings) debounce() (time.Duration, error) {
+	if ws.Debounce == "" {
+		return 500 * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(ws.Debounce)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid watch debounce %q", ws.Debounce)
+	}
+	return d, nil
+}
+
+// validateWatch checks the watch settings of a template
+func validateWatch(tmpl *Template) error {
+	ws := tmpl.Watch
+	if ws == nil {
+		return nil
+	}
+	if tmpl.Kind == KindJob {
+		return fmt.Errorf("watch does not apply to jobs")
+	}
+	// Without one, the root would be wherever vp happened to run, such as $HOME
+	if !slices.Contains(tmpl.Resources, "workdir") {
+		return fmt.Errorf("watch needs the template to have a workdir resource")
+	}
+	if _, err := ws.debounce(); err != nil {
+		return err
+	}
+	for _, glob := range append(append([]string{}, ws.Include...), ws.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid watch glob %q", glob)
+		}
+	}
+	switch ws.Action {
+	case "", "restart":
+		return nil
+	case "reload":
+		if tmpl.Reload == "" {
+			return fmt.Errorf("watch action reload needs the template's reload to be set")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown watch action %q, use restart or reload", ws.Action)
+}
+
+// matchGlob matches a path relative to the watch root against a glob. Globs
+// without a '/' match any path element (*.go, node_modules); others match
+// the whole path or a directory it is in (src/*.go, docs/generated).
+func matchGlob(glob, rel string) bool {
+	if !strings.Contains(glob, "/") {
+		for _, elem := range strings.Split(rel, "/") {
+			if ok, _ := path.Match(glob, elem); ok {
+				return true
+			}
+		}
+		return false
+	}
+	glob = strings.TrimSuffix(glob, "/")
+	if ok, _ := path.Match(glob, rel); ok {
+		return true
+	}
+	return strings.HasPrefix(rel, glob+"/")
+}
+
+// fileWatch watches the files selected by watch settings under a root
+type fileWatch struct {
+	root     string
+	include  []string
+	exclude  []string
+	debounce time.Duration
+	watcher  *fsnotify.Watcher
+	key      string // What the watch was set up from, to notice changes
+
+	mu      sync.Mutex
+	changed map[string]bool // Relative paths changed since the last call
+	timer   *time.Timer
+}
+
+// watchFiles starts watching the files under root that ws selects, walking
+// directories recursively. onChange is called with the changed paths once
+// no further changes arrive for the debounce period.
+func watchFiles(root string, ws *WatchSettings, onChange func(changed []string)) (*fileWatch, error) {
+	debounce, err := ws.debounce()
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	w := &fileWatch{
+		root:     root,
+		include:  ws.Include,
+		exclude:  ws.Exclude,
+		debounce: debounce,
+		watcher:  watcher,
+		changed:  make(map[string]bool),
+	}
+	if w.exclude == nil {
+		w.exclude = defaultWatchExcludes
+	}
+
+	paths := ws.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		if err := w.add(p); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	go w.run(onChange)
+	return w, nil
+}
+
+// add watches a file, or a directory and the directories below it
+func (w *fileWatch) add(p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return w.watcher.Add(p)
+	}
+	return filepath.WalkDir(p, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil // Unreadable entries are skipped
+		}
+		if rel := w.rel(p); rel != "." && w.excluded(rel) {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(p)
+	})
+}
+
+// rel returns a path relative to the watch root, with '/' separators
+func (w *fileWatch) rel(p string) string {
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (w *fileWatch) excluded(rel string) bool {
+	for _, glob := range w.exclude {
+		if matchGlob(glob, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected reports whether a change to a file counts
+func (w *fileWatch) selected(rel string) bool {
+	if w.excluded(rel) {
+		return false
+	}
+	if len(w.include) == 0 {
+		return true
+	}
+	for _, glob := range w.include {
+		if matchGlob(glob, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fileWatch) run(onChange func(changed []string)) {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			// Permission and timestamp changes don't change content
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			rel := w.rel(event.Name)
+
+			// New directories are watched too
+			if event.Has(fsnotify.Create) && !w.excluded(rel) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.add(event.Name)
+				}
+			}
+			if !w.selected(rel) {
+				continue
+			}
+
+			// Debounce: act once changes stop coming in
+			w.mu.Lock()
+			w.changed[rel] = true
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			w.timer = time.AfterFunc(w.debounce, func() {
+				w.mu.Lock()
+				changed := make([]string, 0, len(w.changed))
+				for rel := range w.changed {
+					changed = append(changed, rel)
+				}
+				w.changed = make(map[string]bool)
+				w.mu.Unlock()
+
+				sort.Strings(changed)
+				onChange(changed)
+			})
+			w.mu.Unlock()
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("File watcher error: %v\n", err)
+		}
+	}
+}
+
+// Close stops watching, including a pending call
+func (w *fileWatch) Close() {
+	w.watcher.Close()
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+}
+
+// watchManager keeps a fileWatch for every running instance whose template
+// has watch settings
+type watchManager struct {
+	mu      sync.Mutex
+	watches map[string]*fileWatch // Instance name -> watch
+	failed  map[string]string     // Instance name -> key of a watch that failed to start
+}
+
+var globalWatches = &watchManager{watches: make(map[string]*fileWatch), failed: make(map[string]string)}
+
+// RunWatches keeps the file watches in step with the instances. It runs in
+// vp serve.
+func RunWatches(state *State, interval time.Duration) {
+	for {
+		globalWatches.Sync(state)
+		time.Sleep(interval)
+	}
+}
+
+// Sync starts watching newly running instances and stops watching stopped
+// or deleted ones. A watch is set up again when its settings or the
+// instance's workdir change.
+func (m *watchManager) Sync(state *State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type wanted struct {
+		root string
+		ws   *WatchSettings
+	}
+	want := make(map[string]wanted)
+	state.mu.RLock()
+	for name, inst := range state.Instances {
+		tmpl := state.Templates[inst.Template]
+		if inst.Status != "running" || tmpl == nil || tmpl.Watch == nil {
+			continue
+		}
+		// Templates saved before watch needed a workdir are never watched
+		root := inst.Resources["workdir"]
+		if root == "" {
+			continue
+		}
+
+		// Watch paths may refer to the instance's vars
+		ws := *tmpl.Watch
+		vars := ExecVars(state, inst)
+		ws.Paths = make([]string, len(tmpl.Watch.Paths))
+		for i, p := range tmpl.Watch.Paths {
+			ws.Paths[i] = interpolate(p, vars)
+		}
+		want[name] = wanted{root, &ws}
+	}
+	state.mu.RUnlock()
+
+	for name, w := range m.watches {
+		if _, ok := want[name]; !ok {
+			w.Close()
+			delete(m.watches, name)
+		}
+	}
+	for name := range m.failed {
+		if _, ok := want[name]; !ok {
+			delete(m.failed, name)
+		}
+	}
+
+	for name, wt := range want {
+		settings, _ := json.Marshal(wt.ws)
+		key := wt.root + "\x00" + string(settings)
+		if w := m.watches[name]; w != nil {
+			if w.key == key {
+				continue
+			}
+			w.Close()
+			delete(m.watches, name)
+		}
+		if m.failed[name] == key {
+			continue // Reported already
+		}
+
+		name := name
+		w, err := watchFiles(wt.root, wt.ws, func(changed []string) {
+			filesChanged(state, name, changed)
+		})
+		if err != nil {
+			fmt.Printf("Watch: %s: %v\n", name, err)
+			m.failed[name] = key
+			continue
+		}
+		w.key = key
+		m.watches[name] = w
+		delete(m.failed, name)
+	}
+}
+
+// filesChanged restarts or reloads an instance after its files changed
+func filesChanged(state *State, name string, changed []string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	inst := state.Instances[name]
+	if inst == nil || inst.Status != "running" {
+		return
+	}
+	tmpl := state.Templates[inst.Template]
+	if tmpl == nil || tmpl.Watch == nil {
+		return
+	}
+
+	detail := strings.Join(changed, ", ")
+	if len(changed) > 3 {
+		detail = fmt.Sprintf("%s and %d more", strings.Join(changed[:3], ", "), len(changed)-3)
+	}
+	state.RecordEvent(actorWatcher, "watch", name, detail)
+
+	var err error
+	if tmpl.Watch.Action == "reload" {
+		err = ReloadProcess(state, inst, actorWatcher)
+	} else if err = StopProcess(state, inst, actorWatcher); err == nil {
+		state.ReleaseResources(name, actorWatcher)
+		err = RestartProcess(state, inst, actorWatcher)
+	}
+	if err != nil {
+		fmt.Printf("Watch: %s: %v\n", name, err)
+	}
+}
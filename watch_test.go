@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMatchGlob tests matching watch globs against relative paths
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		glob, rel string
+		want      bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/vp/main.go", true},
+		{"*.go", "main.go.orig", false},
+		{"node_modules", "web/node_modules/x/index.js", true},
+		{"src/*.go", "src/a.go", true},
+		{"src/*.go", "src/sub/a.go", false},
+		{"docs/generated", "docs/generated/api.md", true},
+		{"docs/generated/", "docs/generated/api.md", true},
+		{"docs/generated", "docs/other.md", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.glob, tt.rel); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.glob, tt.rel, got, tt.want)
+		}
+	}
+}
+
+// TestValidateWatch tests the checks on watch settings
+func TestValidateWatch(t *testing.T) {
+	valid := []*Template{
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{}},
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{Include: []string{"*.go"}, Debounce: "1s"}},
+		{ID: "web", Resources: []string{"workdir"}, Reload: "SIGHUP", Watch: &WatchSettings{Action: "reload"}},
+	}
+	for _, tmpl := range valid {
+		if err := validateWatch(tmpl); err != nil {
+			t.Errorf("validateWatch(%+v): %v", tmpl.Watch, err)
+		}
+	}
+
+	invalid := []*Template{
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{Debounce: "soon"}},
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{Include: []string{"[x"}}},
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{Action: "reload"}},
+		{ID: "web", Resources: []string{"workdir"}, Watch: &WatchSettings{Action: "rebuild"}},
+		{ID: "backup", Kind: KindJob, Watch: &WatchSettings{}},
+		{ID: "web", Watch: &WatchSettings{}},
+	}
+	for _, tmpl := range invalid {
+		if err := validateWatch(tmpl); err == nil {
+			t.Errorf("Expected error for %+v", tmpl.Watch)
+		}
+	}
+}
+
+// TestWatchFiles tests that changes are filtered and debounced into one call
+func TestWatchFiles(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "src"), 0755)
+	os.Mkdir(filepath.Join(root, "node_modules"), 0755)
+
+	calls := make(chan []string, 10)
+	w, err := watchFiles(root, &WatchSettings{Include: []string{"*.go"}, Debounce: "200ms"}, func(changed []string) {
+		calls <- changed
+	})
+	if err != nil {
+		t.Fatalf("watchFiles failed: %v", err)
+	}
+	defer w.Close()
+
+	write := func(rel string) {
+		if err := os.WriteFile(filepath.Join(root, rel), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go")
+	write("README.md")           // Not included
+	write("node_modules/dep.go") // Excluded by default
+	os.Mkdir(filepath.Join(root, "src/new"), 0755)
+	time.Sleep(50 * time.Millisecond) // Let the new directory be watched
+	write("src/new/a.go")
+	write("main.go")
+
+	select {
+	case changed := <-calls:
+		if want := []string{"main.go", "src/new/a.go"}; !reflect.DeepEqual(changed, want) {
+			t.Errorf("Expected %v, got %v", want, changed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected a call after the changes")
+	}
+
+	select {
+	case changed := <-calls:
+		t.Errorf("Expected one debounced call, got another with %v", changed)
+	case <-time.After(400 * time.Millisecond):
+	}
+}